@@ -0,0 +1,294 @@
+/*
+ * appledouble.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+
+// AppleDouble version 2 as written by macOS for ._name files
+const (
+	appleDoubleMagic   = 0x00051607
+	appleDoubleVersion = 0x00020000
+	appleDoubleFinder  = 9          // entry with Finder info and the attributes
+	appleDoubleRsrc    = 2          // resource fork entry
+	appleAttrMagic     = 0x41545452 // "ATTR"
+	appleFinderInfo    = "com.apple.FinderInfo"
+	appleFinderOffset  = 50         // Finder info right after the two entries
+	appleAttrOffset    = 84         // attribute header after the Finder info
+	appleAttrEntries   = 120
+)
+
+
+// Decoded ._name file
+type appleDouble struct {
+	finfo [32]byte
+	attrs map[string][]byte
+	rsrc  []byte
+}
+
+
+func (self *appleDouble) empty() bool {
+	return 0 == len(self.attrs) && 0 == len(self.rsrc) && [32]byte{} == self.finfo
+}
+
+
+func appleAttrEntryLen(name string) int {
+	// offset, length, flags, name length, then the name with its NUL
+	return (11 + len(name) + 1 + 3) &^ 3
+}
+
+
+func decodeAppleDouble(data []byte) (*appleDouble, error) {
+
+	be := binary.BigEndian
+	if len(data) < 26 || appleDoubleMagic != be.Uint32(data) {
+		return nil, errors.New("not an AppleDouble file")
+	}
+
+	self := &appleDouble{attrs: make(map[string][]byte)}
+	count := int(be.Uint16(data[24:]))
+	for i := 0; i < count; i++ {
+		e := 26 + 12 * i
+		if e + 12 > len(data) {
+			return nil, errors.New("truncated AppleDouble header")
+		}
+		kind, ofst, size := be.Uint32(data[e:]), int(be.Uint32(data[e+4:])), int(be.Uint32(data[e+8:]))
+		if ofst < 0 || size < 0 || ofst + size > len(data) {
+			return nil, fmt.Errorf("AppleDouble entry %d out of bounds", kind)
+		}
+
+		switch kind {
+		case appleDoubleRsrc:
+			self.rsrc = bytes.Clone(data[ofst : ofst+size])
+
+		case appleDoubleFinder:
+			if size < 32 {
+				continue
+			}
+			copy(self.finfo[:], data[ofst:])
+			h := ofst + 34
+			if size < 34 + 36 || appleAttrMagic != be.Uint32(data[h:]) {
+				continue
+			}
+			n := int(be.Uint16(data[h+34:]))
+			p := h + 36
+			for j := 0; j < n; j++ {
+				if p + 11 > len(data) {
+					return nil, errors.New("truncated AppleDouble attribute")
+				}
+				vofst, vlen, namelen := int(be.Uint32(data[p:])), int(be.Uint32(data[p+4:])), int(data[p+10])
+				if p + 11 + namelen > len(data) || vofst + vlen > len(data) || 0 == namelen {
+					return nil, errors.New("AppleDouble attribute out of bounds")
+				}
+				name := string(data[p+11 : p+11+namelen-1])
+				self.attrs[name] = bytes.Clone(data[vofst : vofst+vlen])
+				p += appleAttrEntryLen(name)
+			}
+		}
+	}
+	return self, nil
+}
+
+
+func (self *appleDouble) encode() []byte {
+
+	names := make([]string, 0, len(self.attrs))
+	entries := 0
+	for name := range self.attrs {
+		names = append(names, name)
+		entries += appleAttrEntryLen(name)
+	}
+	sort.Strings(names)
+
+	start := appleAttrEntries + entries
+	end := start
+	for _, name := range names {
+		end += len(self.attrs[name])
+	}
+	data := make([]byte, end + len(self.rsrc))
+
+	be := binary.BigEndian
+	be.PutUint32(data[0:], appleDoubleMagic)
+	be.PutUint32(data[4:], appleDoubleVersion)
+	copy(data[8:24], "Mac OS X        ")
+	be.PutUint16(data[24:], 2)
+	be.PutUint32(data[26:], appleDoubleFinder)
+	be.PutUint32(data[30:], appleFinderOffset)
+	be.PutUint32(data[34:], uint32(end - appleFinderOffset))
+	be.PutUint32(data[38:], appleDoubleRsrc)
+	be.PutUint32(data[42:], uint32(end))
+	be.PutUint32(data[46:], uint32(len(self.rsrc)))
+	copy(data[appleFinderOffset:], self.finfo[:])
+
+	h := appleAttrOffset
+	be.PutUint32(data[h:], appleAttrMagic)
+	be.PutUint32(data[h+8:], uint32(end))
+	be.PutUint32(data[h+12:], uint32(start))
+	be.PutUint32(data[h+16:], uint32(end - start))
+	be.PutUint16(data[h+34:], uint16(len(names)))
+
+	p, v := appleAttrEntries, start
+	for _, name := range names {
+		value := self.attrs[name]
+		be.PutUint32(data[p:], uint32(v))
+		be.PutUint32(data[p+4:], uint32(len(value)))
+		data[p+10] = byte(len(name) + 1)
+		copy(data[p+11:], name)
+		copy(data[v:], value)
+		p += appleAttrEntryLen(name)
+		v += len(value)
+	}
+	copy(data[end:], self.rsrc)
+	return data
+}
+
+
+// Attributes in ._name files next to the files, readable by macOS
+type appleDoubleXattrs struct {
+	fs   Backend
+	lock sync.Mutex
+}
+
+
+func appleDoubleName(name string) string {
+	return path.Join(path.Dir(name), "._" + path.Base(name))
+}
+
+
+func (self *appleDoubleXattrs) load(name string) (*appleDouble, error) {
+	data, err := readBackendFile(self.fs, appleDoubleName(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return &appleDouble{attrs: make(map[string][]byte)}, nil
+	}
+	if nil != err {
+		return nil, err
+	}
+	return decodeAppleDouble(data)
+}
+
+
+func (self *appleDoubleXattrs) update(name string, fn func(ad *appleDouble) error) error {
+
+	defer self.synchronize()()
+
+	ad, err := self.load(name)
+	if nil != err {
+		return err
+	}
+	err = fn(ad)
+	if nil != err {
+		return err
+	}
+
+	if ad.empty() {
+		err = self.fs.Remove(appleDoubleName(name))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return writeBackendFile(self.fs, appleDoubleName(name), ad.encode())
+}
+
+
+func (self *appleDoubleXattrs) List(name string) (map[string][]byte, error) {
+
+	defer self.synchronize()()
+
+	ad, err := self.load(name)
+	if nil != err {
+		return nil, err
+	}
+	if [32]byte{} != ad.finfo {
+		ad.attrs[appleFinderInfo] = ad.finfo[:]
+	}
+	return ad.attrs, nil
+}
+
+
+func (self *appleDoubleXattrs) Set(name string, attr string, value []byte) error {
+	if 254 < len(attr) {
+		return errors.ErrUnsupported
+	}
+	return self.update(name, func(ad *appleDouble) error {
+		if appleFinderInfo == attr {
+			if 32 != len(value) {
+				return errors.ErrUnsupported
+			}
+			copy(ad.finfo[:], value)
+			return nil
+		}
+		ad.attrs[attr] = bytes.Clone(value)
+		return nil
+	})
+}
+
+
+func (self *appleDoubleXattrs) Remove(name string, attr string) error {
+	return self.update(name, func(ad *appleDouble) error {
+		if appleFinderInfo == attr {
+			ad.finfo = [32]byte{}
+		}
+		delete(ad.attrs, attr)
+		return nil
+	})
+}
+
+
+func (self *appleDoubleXattrs) Rename(oldpath string, newpath string) error {
+
+	defer self.synchronize()()
+
+	err := self.fs.Rename(appleDoubleName(oldpath), appleDoubleName(newpath))
+	if errors.Is(err, os.ErrNotExist) {
+		// nothing to carry over, but a replaced file takes its own along
+		err = self.fs.Remove(appleDoubleName(newpath))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+	}
+	return err
+}
+
+
+func (self *appleDoubleXattrs) Delete(name string) error {
+	defer self.synchronize()()
+	err := self.fs.Remove(appleDoubleName(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+
+func (self *appleDoubleXattrs) Hidden(name string) bool {
+	return strings.HasPrefix(name, "._")
+}
+
+
+func (self *appleDoubleXattrs) synchronize() func() {
+	self.lock.Lock()
+	return func() {
+		self.lock.Unlock()
+	}
+}
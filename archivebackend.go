@@ -0,0 +1,780 @@
+/*
+ * archivebackend.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// File or directory inside an archive
+//
+// Offset is where the content starts in the tar stream (after gzip
+// decompression), or in the zip file for stored entries; -1 means the zip
+// entry at index Zip must be inflated.
+type archiveEntry struct {
+	Name   string
+	Mode   os.FileMode
+	Size   int64
+	Mtime  int64
+	Link   string `json:",omitempty"`
+	Offset int64
+	Zip    int    `json:",omitempty"`
+	Sparse bool   `json:",omitempty"`
+}
+
+
+// Read-only backend over a tar, tar.gz or zip archive
+//
+// The archive is read through an io.ReaderAt, so it can live on another
+// backend. Tar archives are indexed with one pass; for tar.gz the index can
+// be saved so later mounts start without decompressing anything, and content
+// is decompressed on demand from the nearest gzip checkpoint.
+type archiveBackend struct {
+	src      io.ReaderAt
+	size     int64
+	stream   io.ReaderAt
+	zip      *zip.Reader
+	gz       *gzipSpool
+	entries  map[string]*archiveEntry
+	children map[string][]string
+	closers  []io.Closer
+}
+
+
+// index a mounted archive; indexFile caches a tar index if not empty
+func openArchive(src io.ReaderAt, size int64, indexFile string) (*archiveBackend, error) {
+
+	self := &archiveBackend{}
+	self.src = src
+	self.size = size
+	self.entries = make(map[string]*archiveEntry)
+	self.children = make(map[string][]string)
+	self.add(&archiveEntry{Name: "/", Mode: os.ModeDir | 0755})
+
+	magic := make([]byte, 4)
+	n, _ := src.ReadAt(magic, 0)
+	magic = magic[:n]
+
+	var err error
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")) || bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		err = self.indexZip()
+		return self, err
+
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		self.gz, err = newGzipSpool(src, size)
+		if nil != err {
+			return nil, err
+		}
+		self.stream = self.gz
+
+	default:
+		self.stream = src
+	}
+
+	if self.loadIndex(indexFile) {
+		return self, nil
+	}
+
+	if nil != self.gz {
+		// one pass for the tar entries and the gzip checkpoints
+		pr, pw := io.Pipe()
+		result := make(chan error, 1)
+		go func() {
+			index, err := indexGzip(src, size, pw, gzipSpan)
+			self.gz.index = index
+			pw.CloseWithError(err)
+			result <- err
+		}()
+		counter := &countingReader{r: pr}
+		err = self.indexTar(counter, func() int64 { return counter.n })
+		if nil == err {
+			// checkpoints need the tar padding too
+			_, err = io.Copy(io.Discard, pr)
+		}
+		pr.Close()
+		if gerr := <-result; nil == err {
+			err = gerr
+		}
+	} else {
+		sr := io.NewSectionReader(src, 0, size)
+		err = self.indexTar(sr, func() int64 {
+			pos, _ := sr.Seek(0, io.SeekCurrent)
+			return pos
+		})
+	}
+	if nil != err {
+		self.Close()
+		return nil, err
+	}
+
+	self.saveIndex(indexFile)
+	return self, nil
+}
+
+
+// mount archive name stored on fs; the backend owns fs from here on
+func openArchiveFile(fs Backend, host string, name string, indexDir string) (*archiveBackend, error) {
+
+	fp, err := fs.Open(name, os.O_RDONLY)
+	if nil != err {
+		return nil, err
+	}
+	info, err := fp.Stat()
+	if nil != err {
+		fp.Close()
+		return nil, err
+	}
+
+	index := ""
+	if "" != indexDir && nil == os.MkdirAll(indexDir, 0700) {
+		version := fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())
+		index = filepath.Join(indexDir, "archive-" + cacheKey(host, name + "@" + version) + ".json")
+	}
+
+	self, err := openArchive(fp, info.Size(), index)
+	if nil != err {
+		fp.Close()
+		return nil, err
+	}
+	self.closers = append(self.closers, fp, fs)
+	return self, nil
+}
+
+
+func (self *archiveBackend) add(entry *archiveEntry) {
+
+	if _, found := self.entries[entry.Name]; !found && "/" != entry.Name {
+		parent := path.Dir(entry.Name)
+		if _, found := self.entries[parent]; !found {
+			// directory implied by a deeper entry
+			self.add(&archiveEntry{Name: parent, Mode: os.ModeDir | 0755, Mtime: entry.Mtime})
+		}
+		self.children[parent] = append(self.children[parent], path.Base(entry.Name))
+	}
+	self.entries[entry.Name] = entry
+}
+
+
+func archiveName(name string) string {
+	return path.Clean("/" + strings.TrimPrefix(name, "./"))
+}
+
+
+// offset tells where the reader is in the tar stream
+func (self *archiveBackend) indexTar(r io.Reader, offset func() int64) error {
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if io.EOF == err {
+			return nil
+		}
+		if nil != err {
+			return err
+		}
+
+		name := archiveName(hdr.Name)
+		if "/" == name {
+			continue
+		}
+
+		entry := &archiveEntry{
+			Name:   name,
+			Mode:   hdr.FileInfo().Mode(),
+			Size:   hdr.Size,
+			Mtime:  hdr.ModTime.UnixNano(),
+			Offset: offset(),
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeGNUSparse:
+		case tar.TypeDir:
+			entry.Size = 0
+		case tar.TypeSymlink:
+			entry.Link = hdr.Linkname
+			entry.Size = int64(len(hdr.Linkname))
+		case tar.TypeLink:
+			target, found := self.entries[archiveName(hdr.Linkname)]
+			if !found {
+				continue
+			}
+			entry.Mode = target.Mode
+			entry.Size = target.Size
+			entry.Offset = target.Offset
+			entry.Sparse = target.Sparse
+		default:
+			// devices and fifos
+			continue
+		}
+
+		if tar.TypeGNUSparse == hdr.Typeflag {
+			entry.Sparse = true
+		}
+		for key := range hdr.PAXRecords {
+			if strings.HasPrefix(key, "GNU.sparse.") {
+				entry.Sparse = true
+			}
+		}
+		self.add(entry)
+	}
+}
+
+
+func (self *archiveBackend) indexZip() error {
+
+	zr, err := zip.NewReader(self.src, self.size)
+	if nil != err {
+		return err
+	}
+	self.zip = zr
+
+	for i, f := range zr.File {
+		name := archiveName(f.Name)
+		if "/" == name {
+			continue
+		}
+
+		entry := &archiveEntry{
+			Name:   name,
+			Mode:   f.Mode(),
+			Size:   int64(f.UncompressedSize64),
+			Mtime:  f.Modified.UnixNano(),
+			Offset: -1,
+			Zip:    i,
+		}
+
+		if zip.Store == f.Method {
+			if ofst, err := f.DataOffset(); nil == err {
+				entry.Offset = ofst
+			}
+		}
+		if 0 != entry.Mode&os.ModeSymlink {
+			// the link target is the content
+			if rc, err := f.Open(); nil == err {
+				target, _ := io.ReadAll(io.LimitReader(rc, 4096))
+				rc.Close()
+				entry.Link = string(target)
+			}
+		}
+		if entry.Mode.IsDir() {
+			entry.Size = 0
+		}
+		self.add(entry)
+	}
+	return nil
+}
+
+
+type archiveIndex struct {
+	Entries []*archiveEntry
+	Gzip    *gzipIndex `json:",omitempty"`
+}
+
+
+func (self *archiveBackend) loadIndex(indexFile string) bool {
+
+	if "" == indexFile {
+		return false
+	}
+	data, err := os.ReadFile(indexFile)
+	if nil != err {
+		return false
+	}
+	index := &archiveIndex{}
+	if nil != json.Unmarshal(data, index) {
+		return false
+	}
+	if nil != self.gz {
+		if nil == index.Gzip {
+			// from before checkpoints were kept
+			return false
+		}
+		self.gz.index = index.Gzip
+	}
+	for _, entry := range index.Entries {
+		self.add(entry)
+	}
+	return true
+}
+
+
+func (self *archiveBackend) saveIndex(indexFile string) {
+
+	if "" == indexFile {
+		return
+	}
+
+	index := &archiveIndex{}
+	if nil != self.gz {
+		index.Gzip = self.gz.index
+	}
+	for _, entry := range self.entries {
+		index.Entries = append(index.Entries, entry)
+	}
+	// parents first so loading rebuilds the same tree
+	sort.Slice(index.Entries, func(i, j int) bool {
+		return index.Entries[i].Name < index.Entries[j].Name
+	})
+
+	data, _ := json.Marshal(index)
+	tmp := indexFile + ".tmp"
+	err := os.WriteFile(tmp, data, 0600)
+	if nil == err {
+		err = os.Rename(tmp, indexFile)
+	}
+	if nil != err {
+		fmt.Printf("archive index %s: %s\n", indexFile, err)
+	}
+}
+
+
+func (self *archiveBackend) lookup(name string) (*archiveEntry, error) {
+	entry, found := self.entries[path.Clean("/" + name)]
+	if !found {
+		return nil, os.ErrNotExist
+	}
+	return entry, nil
+}
+
+
+func (self *archiveEntry) info() os.FileInfo {
+	return &fileInfo{path.Base(self.Name), self.Size, self.Mode, time.Unix(0, self.Mtime), self.Link}
+}
+
+
+// entry of name with symlinks inside the archive followed
+func (self *archiveBackend) resolve(name string) (*archiveEntry, error) {
+
+	entry, err := self.lookup(name)
+	for hops := 0; nil == err && "" != entry.Link; hops++ {
+		if 8 <= hops {
+			return nil, fmt.Errorf("%s: too many links: %w", name, os.ErrInvalid)
+		}
+		target := entry.Link
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(entry.Name), target)
+		}
+		entry, err = self.lookup(target)
+	}
+	return entry, err
+}
+
+
+func (self *archiveBackend) Stat(name string) (os.FileInfo, error) {
+
+	entry, err := self.resolve(name)
+	if nil != err {
+		return nil, err
+	}
+	info := entry.info().(*fileInfo)
+	info.name = path.Base(name)
+	return info, nil
+}
+
+
+func (self *archiveBackend) Lstat(name string) (os.FileInfo, error) {
+	entry, err := self.lookup(name)
+	if nil != err {
+		return nil, err
+	}
+	return entry.info(), nil
+}
+
+
+func (self *archiveBackend) ReadDir(name string) ([]os.FileInfo, error) {
+
+	entry, err := self.lookup(name)
+	if nil != err {
+		return nil, err
+	}
+	if !entry.Mode.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory: %w", name, os.ErrInvalid)
+	}
+
+	names := self.children[entry.Name]
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, child := range names {
+		infos = append(infos, self.entries[path.Join(entry.Name, child)].info())
+	}
+	return infos, nil
+}
+
+
+func (self *archiveBackend) Readlink(name string) (string, error) {
+	entry, err := self.lookup(name)
+	if nil != err {
+		return "", err
+	}
+	if "" == entry.Link {
+		return "", fmt.Errorf("%s is not a symlink: %w", name, os.ErrInvalid)
+	}
+	return entry.Link, nil
+}
+
+
+func (self *archiveBackend) Open(name string, flags int) (File, error) {
+
+	if 0 != flags&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) {
+		return nil, errReadOnly
+	}
+
+	entry, err := self.resolve(name)
+	if nil != err {
+		return nil, err
+	}
+	if !entry.Mode.IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file: %w", name, os.ErrInvalid)
+	}
+	if entry.Sparse {
+		return nil, fmt.Errorf("%s: sparse tar entries: %w", name, errors.ErrUnsupported)
+	}
+
+	fp := &archiveFile{info: entry.info()}
+	switch {
+	case nil != self.zip && 0 > entry.Offset:
+		stream := &zipStream{file: self.zip.File[entry.Zip]}
+		fp.ReaderAt = stream
+		fp.closer = stream
+	case nil != self.zip:
+		fp.ReaderAt = io.NewSectionReader(self.src, entry.Offset, entry.Size)
+	default:
+		fp.ReaderAt = io.NewSectionReader(self.stream, entry.Offset, entry.Size)
+	}
+	return fp, nil
+}
+
+
+func (self *archiveBackend) Create(name string) (File, error) {
+	return nil, errReadOnly
+}
+
+
+func (self *archiveBackend) Remove(name string) error {
+	return errReadOnly
+}
+
+
+func (self *archiveBackend) Rename(oldpath string, newpath string) error {
+	return errReadOnly
+}
+
+
+func (self *archiveBackend) Mkdir(name string) error {
+	return errReadOnly
+}
+
+
+func (self *archiveBackend) Chmod(name string, mode os.FileMode) error {
+	return errReadOnly
+}
+
+
+func (self *archiveBackend) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return errReadOnly
+}
+
+
+func (self *archiveBackend) Symlink(target string, newpath string) error {
+	return errReadOnly
+}
+
+
+// a full volume the size of the archive
+func (self *archiveBackend) StatVFS(name string, stat *fuse.Statfs_t) error {
+	stat.Bsize = 4096
+	stat.Frsize = 4096
+	stat.Blocks = uint64(self.size + 4095) / 4096
+	stat.Files = uint64(len(self.entries))
+	stat.Namemax = 255
+	return nil
+}
+
+
+func (self *archiveBackend) Close() error {
+	if nil != self.gz {
+		self.gz.Close()
+	}
+	var err error
+	for _, closer := range self.closers {
+		if cerr := closer.Close(); nil == err {
+			err = cerr
+		}
+	}
+	return err
+}
+
+
+// Open file inside an archive
+type archiveFile struct {
+	io.ReaderAt
+	info   os.FileInfo
+	closer io.Closer
+}
+
+
+func (self *archiveFile) WriteAt(buff []byte, ofst int64) (int, error) {
+	return 0, errReadOnly
+}
+
+
+func (self *archiveFile) Truncate(size int64) error {
+	return errReadOnly
+}
+
+
+func (self *archiveFile) Stat() (os.FileInfo, error) {
+	return self.info, nil
+}
+
+
+func (self *archiveFile) Close() error {
+	if nil != self.closer {
+		return self.closer.Close()
+	}
+	return nil
+}
+
+
+// Compressed zip entry; reading backwards starts inflating again
+type zipStream struct {
+	file *zip.File
+	lock sync.Mutex
+	rc   io.ReadCloser
+	pos  int64
+}
+
+
+func (self *zipStream) ReadAt(buff []byte, ofst int64) (int, error) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if nil == self.rc || ofst < self.pos {
+		if nil != self.rc {
+			self.rc.Close()
+		}
+		rc, err := self.file.Open()
+		if nil != err {
+			self.rc = nil
+			return 0, err
+		}
+		self.rc = rc
+		self.pos = 0
+	}
+
+	if ofst > self.pos {
+		n, err := io.CopyN(io.Discard, self.rc, ofst - self.pos)
+		self.pos += n
+		if nil != err {
+			return 0, io.EOF
+		}
+	}
+
+	n, err := io.ReadFull(self.rc, buff)
+	self.pos += int64(n)
+	if io.ErrUnexpectedEOF == err {
+		err = io.EOF
+	}
+	return n, err
+}
+
+
+func (self *zipStream) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if nil == self.rc {
+		return nil
+	}
+	err := self.rc.Close()
+	self.rc = nil
+	return err
+}
+
+
+// Decompressed gzip stream
+//
+// With checkpoints, a read decompresses from the nearest one before it and
+// the next read carries on if it follows. Without, the stream is spooled
+// to a local file as far as it was read.
+type gzipSpool struct {
+	src   io.ReaderAt
+	size  int64
+	lock  sync.Mutex
+	gz    *gzip.Reader
+	spool *os.File
+	done  int64
+	err   error
+	index *gzipIndex
+	rc    io.ReadCloser
+	pos   int64
+}
+
+
+func newGzipSpool(src io.ReaderAt, size int64) (*gzipSpool, error) {
+
+	spool, err := os.CreateTemp("", "sshfs-gunzip-")
+	if nil != err {
+		return nil, err
+	}
+	os.Remove(spool.Name())
+
+	self := &gzipSpool{}
+	self.src = src
+	self.size = size
+	self.spool = spool
+	return self, nil
+}
+
+
+func (self *gzipSpool) ReadAt(buff []byte, ofst int64) (int, error) {
+
+	if nil != self.index && 0 < len(self.index.Points) {
+		return self.readIndexed(buff, ofst)
+	}
+
+	self.lock.Lock()
+	need := ofst + int64(len(buff))
+	for self.done < need && nil == self.err {
+		if nil == self.gz {
+			self.gz, self.err = gzip.NewReader(io.NewSectionReader(self.src, 0, self.size))
+			continue
+		}
+		var n int64
+		n, self.err = io.CopyN(self.spool, self.gz, 1024 * 1024)
+		self.done += n
+	}
+	done, err := self.done, self.err
+	self.lock.Unlock()
+
+	if ofst >= done {
+		if nil == err || io.EOF == err {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	if need > done {
+		n, rerr := self.spool.ReadAt(buff[:done-ofst], ofst)
+		if nil == rerr {
+			rerr = io.EOF
+			if io.EOF != err {
+				rerr = err
+			}
+		}
+		return n, rerr
+	}
+	return self.spool.ReadAt(buff, ofst)
+}
+
+
+func (self *gzipSpool) readIndexed(buff []byte, ofst int64) (int, error) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if ofst >= self.index.Size {
+		return 0, io.EOF
+	}
+
+	points := self.index.Points
+	i := sort.Search(len(points), func(i int) bool {
+		return points[i].Out > ofst
+	})
+	point := points[i-1]
+
+	// restart unless carrying on is closer
+	if nil == self.rc || ofst < self.pos || self.pos < point.Out {
+		if nil != self.rc {
+			self.rc.Close()
+			self.rc = nil
+		}
+		rc, err := point.open(self.src, self.size)
+		if nil != err {
+			return 0, err
+		}
+		self.rc = rc
+		self.pos = point.Out
+	}
+
+	if ofst > self.pos {
+		n, err := io.CopyN(io.Discard, self.rc, ofst - self.pos)
+		self.pos += n
+		if nil != err {
+			return 0, gzipEOF(err)
+		}
+	}
+
+	n, err := io.ReadFull(self.rc, buff)
+	self.pos += int64(n)
+	switch {
+	case nil == err:
+	case self.pos == self.index.Size:
+		err = io.EOF
+	default:
+		err = gzipEOF(err)
+	}
+	return n, err
+}
+
+
+func (self *gzipSpool) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if nil != self.gz {
+		self.gz.Close()
+	}
+	if nil != self.rc {
+		self.rc.Close()
+	}
+	return self.spool.Close()
+}
+
+
+// the stream ending before the index says is a broken archive
+func gzipEOF(err error) error {
+	if io.EOF == err {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+
+// Reader that counts what went through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+
+func (self *countingReader) Read(buff []byte) (int, error) {
+	n, err := self.r.Read(buff)
+	self.n += int64(n)
+	return n, err
+}
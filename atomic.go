@@ -0,0 +1,190 @@
+//go:build !memfs && !sftpfs
+
+/*
+ * atomic.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+
+// Atomic uploads
+//
+// A file open for writing is written to a hidden temp file in the same
+// remote directory and renamed over the file on close, so nobody on the
+// server sees it half written. The temp starts as a server side copy
+// unless the open truncates, and gets the permissions of the original
+// before the rename. A file made by Mknod only appears with that rename.
+// Temps left behind by a crashed mount are removed when their directory
+// is listed and they haven't been touched for atomicStale.
+const (
+	atomicPrefix = ".sshfs-upload."
+	atomicStale  = 24 * time.Hour
+)
+
+
+func isAtomicTemp(name string) bool {
+	return strings.HasPrefix(name, atomicPrefix)
+}
+
+
+func atomicTempName(target string) string {
+	nonce := make([]byte, 6)
+	rand.Read(nonce)
+	return path.Join(path.Dir(target), atomicPrefix + path.Base(target) + "." + hex.EncodeToString(nonce))
+}
+
+
+// point handle at a new temp file standing in for path
+func (self *Sshfs) openAtomic(handle *Handle, path string, trunc bool) error {
+
+	self.lock.Lock()
+	pending := handle.node.Pending
+	handle.mode = handle.node.Mode.Perm()
+	self.lock.Unlock()
+
+	handle.target = path
+	if !pending {
+		info, err := self.fs.Stat(path)
+		if nil != err {
+			return err
+		}
+		handle.base = statBase(info)
+		handle.mode = info.Mode().Perm()
+	}
+
+	temp := atomicTempName(path)
+	if !pending && !trunc {
+		err := backendCopy(self.fs, path, temp)
+		if nil != err {
+			self.fs.Remove(temp)
+			return err
+		}
+	}
+
+	fp, err := self.fs.Open(temp, os.O_RDWR|os.O_CREATE)
+	if nil != err {
+		self.fs.Remove(temp)
+		return err
+	}
+	handle.fp = fp
+	handle.temp = temp
+	handle.dirty = trunc
+	return nil
+}
+
+
+// the file at path is gone; handles still writing it must not bring it
+// back on release
+func (self *Sshfs) discard(path string) {
+	self.lock.Lock()
+	for _, handle := range self.handles {
+		if path == handle.target {
+			handle.discarded = true
+		}
+	}
+	self.lock.Unlock()
+}
+
+
+// move the temp over its file, or just get rid of it if writing failed
+func (self *Sshfs) finishAtomic(handle *Handle, failed bool) error {
+
+	temp := handle.temp
+	handle.temp = ""
+	if failed {
+		self.fs.Remove(temp)
+		return nil
+	}
+
+	// renames move target, unlinks discard it
+	self.lock.Lock()
+	pending := handle.node.Pending
+	dirty := handle.dirty
+	target := handle.target
+	discarded := handle.discarded
+	self.lock.Unlock()
+
+	// unlinked while open, or unchanged; leave the file and its mtime alone
+	if discarded || (!dirty && !pending) {
+		self.fs.Remove(temp)
+		return nil
+	}
+
+	if conflictOff != self.conflict && !pending {
+		info, err := self.fs.Stat(target)
+		if nil != err || statBase(info) != handle.base {
+			fmt.Printf("[conflict] %s changed remotely since open (policy %s)\n", target, self.conflict)
+			switch self.conflict {
+			case conflictFail:
+				self.fs.Remove(temp)
+				return errConflict
+			case conflictRename:
+				target = conflictName(target)
+				fmt.Printf("[conflict] saving our changes as %s\n", target)
+			}
+		}
+	}
+
+	// 0 when nobody said; the temp keeps what the server gave it
+	if 0 != handle.mode {
+		err := self.fs.Chmod(temp, handle.mode)
+		if nil != err && !errors.Is(err, errors.ErrUnsupported) {
+			self.fs.Remove(temp)
+			return err
+		}
+	}
+
+	err := self.fs.Rename(temp, target)
+	if nil != err {
+		if _, serr := self.fs.Stat(target); nil == serr {
+			// no posix-rename; not atomic, but better than losing the upload
+			fmt.Printf("replacing %s non-atomically: %s\n", target, err)
+			err = self.fs.Remove(target)
+			if nil == err {
+				err = self.fs.Rename(temp, target)
+			}
+		}
+	}
+	if nil != err {
+		self.fs.Remove(temp)
+		return err
+	}
+
+	self.lock.Lock()
+	if target == handle.target {
+		handle.node.Pending = false
+	}
+	handle.target = target
+	self.lock.Unlock()
+	return nil
+}
+
+
+// temps of uploads whose mount went away
+func (self *Sshfs) cleanAtomic(dir string, entries []cacheAttr) {
+	for _, entry := range entries {
+		if isAtomicTemp(entry.Name) && time.Since(time.Unix(entry.Mtime, 0)) > atomicStale {
+			fmt.Printf("removing stale upload %s\n", entry.Name)
+			self.fs.Remove(path.Join(dir, entry.Name))
+		}
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * backend.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// Storage behind the FUSE layer
+//
+// Paths are slash separated and absolute, exactly as received from FUSE.
+// Errors should wrap os.ErrNotExist, os.ErrExist or os.ErrPermission where
+// they apply; errors.ErrUnsupported becomes ENOSYS and errOffline means
+// the storage is unreachable right now.
+type Backend interface {
+	Stat(path string) (os.FileInfo, error)
+	Lstat(path string) (os.FileInfo, error)
+	ReadDir(path string) ([]os.FileInfo, error)
+
+	// flags are os.O_* flags
+	Open(path string, flags int) (File, error)
+	Create(path string) (File, error)
+
+	// removes a file or an empty directory
+	Remove(path string) error
+	Rename(oldpath string, newpath string) error
+	Mkdir(path string) error
+	Chmod(path string, mode os.FileMode) error
+	Chtimes(path string, atime time.Time, mtime time.Time) error
+	Symlink(target string, newpath string) error
+	StatVFS(path string, stat *fuse.Statfs_t) error
+
+	Close() error
+}
+
+
+// Open file of a Backend
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+}
+
+
+// Optional capabilities, checked with a type assertion
+
+// Backends with symbolic links
+type Readlinker interface {
+	Readlink(path string) (string, error)
+}
+
+
+// Files that can be flushed to stable storage on the server
+type Syncer interface {
+	Sync() error
+}
+
+
+// Backends that run commands on the server
+type Execer interface {
+	// start cmd; the reader yields its stdout and Close waits for it to exit
+	Exec(cmd string) (io.ReadCloser, error)
+}
+
+
+// Backends with server side advisory locks
+type Locker interface {
+	// take or refresh a lock on path
+	Lock(path string, exclusive bool) error
+	Unlock(path string) error
+}
+
+
+// Backends that know more about a file than its attributes
+type Describer interface {
+	// canonical path on the server, symbolic links resolved
+	RealPath(path string) (string, error)
+	// user name that owns path
+	Owner(path string) (string, error)
+}
+
+
+// Backends that can hash a file without downloading it
+type Hasher interface {
+	// alg is a lower case name such as sha256
+	Hash(path string, alg string) ([]byte, error)
+}
+
+
+// Backends that copy a file without the content leaving the server
+//
+// cgofuse has no copy_file_range hook, so in the mount a copy still reads
+// and writes; this is for the cp command.
+type Copier interface {
+	// replaces newpath if it exists
+	Copy(oldpath string, newpath string) error
+}
+
+
+// Backends that can lose and regain their connection
+type Reconnector interface {
+	Online() bool
+	OnReconnect(fn func())
+}
+
+
+// Plain file attributes for backends without their own FileInfo
+type fileInfo struct {
+	name   string
+	size   int64
+	mode   fs.FileMode
+	mtime  time.Time
+	target string
+}
+
+func (self *fileInfo) Name() string       { return self.name }
+func (self *fileInfo) Size() int64        { return self.size }
+func (self *fileInfo) Mode() fs.FileMode  { return self.mode }
+func (self *fileInfo) ModTime() time.Time { return self.mtime }
+func (self *fileInfo) IsDir() bool        { return self.mode.IsDir() }
+func (self *fileInfo) Sys() interface{}   { return nil }
+
+
+// copy a whole file between backends
+func copyFile(dst File, src File) (int64, error) {
+	return io.Copy(io.NewOffsetWriter(dst, 0), io.NewSectionReader(src, 0, 1<<62))
+}
+
+
+// run cmd on the server and collect its output
+func execOutput(e Execer, cmd string) ([]byte, error) {
+
+	out, err := e.Exec(cmd)
+	if nil != err {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(out)
+	if cerr := out.Close(); nil == err {
+		err = cerr
+	}
+	return data, err
+}
@@ -0,0 +1,251 @@
+/*
+ * commands.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+
+// Commands run against the backend instead of mounting it; they return
+// the exit status
+
+
+// verify remote local [remote local ...]
+//
+// Compares local files with remote ones, hashing the remote side on the
+// server when the backend can so nothing is downloaded.
+func verifyCommand(fs Backend, alg string, args []string) int {
+
+	if _, err := newHash(alg); nil != err {
+		fmt.Println(err)
+		return 2
+	}
+	if 0 == len(args) || 0 != len(args) % 2 {
+		fmt.Println("usage: verify remote local [remote local ...]")
+		return 2
+	}
+
+	status := 0
+	for i := 0; i < len(args); i += 2 {
+		remote, local := path.Clean("/" + args[i]), args[i+1]
+
+		fp, err := os.Open(local)
+		if nil != err {
+			fmt.Println(err)
+			status = 1
+			continue
+		}
+		want, err := hashReader(fp, alg)
+		fp.Close()
+		if nil != err {
+			fmt.Println(err)
+			status = 1
+			continue
+		}
+
+		got, err := backendHash(fs, remote, alg)
+		if nil != err {
+			fmt.Printf("%s: %s\n", remote, err)
+			status = 1
+			continue
+		}
+
+		if bytes.Equal(want, got) {
+			fmt.Printf("%s: OK\n", remote)
+		} else {
+			fmt.Printf("%s: MISMATCH (%s %x, local %x)\n", remote, alg, got, want)
+			status = 1
+		}
+	}
+	return status
+}
+
+
+// cp src dst
+//
+// Copies a remote file on the server when the backend can, otherwise by
+// reading it through. A dst that is a directory gets src's name inside it.
+func copyCommand(fs Backend, args []string) int {
+
+	if 2 != len(args) {
+		fmt.Println("usage: cp src dst")
+		return 2
+	}
+	src, dst := path.Clean("/" + args[0]), path.Clean("/" + args[1])
+	if info, err := fs.Stat(dst); nil == err && info.IsDir() {
+		dst = path.Join(dst, path.Base(src))
+	}
+
+	err := backendCopy(fs, src, dst)
+	if nil != err {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+
+func backendCopy(fs Backend, src string, dst string) error {
+
+	if path.Clean("/" + src) == path.Clean("/" + dst) {
+		return fmt.Errorf("cp %s: %w", src, errSameFile)
+	}
+
+	if copier, ok := fs.(Copier); ok {
+		err := copier.Copy(src, dst)
+		if !errors.Is(err, errors.ErrUnsupported) && !errors.Is(err, errCrossDevice) {
+			return err
+		}
+	}
+
+	info, err := fs.Stat(src)
+	if nil != err {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s: not a regular file", src)
+	}
+	in, err := fs.Open(src, os.O_RDONLY)
+	if nil != err {
+		return err
+	}
+	defer in.Close()
+	out, err := fs.Open(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if nil != err {
+		return err
+	}
+	_, err = copyFile(out, in)
+	if cerr := out.Close(); nil == err {
+		err = cerr
+	}
+	if nil != err {
+		return err
+	}
+	err = fs.Chmod(dst, info.Mode().Perm())
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	return err
+}
+
+
+// trash list [path]
+// trash restore path|id ...
+// trash purge [path|id ...]
+// trash expire
+//
+// Looks after what -trash kept. Restoring a path brings back the last
+// deleted version of it and of everything deleted under it; purging with
+// no arguments empties the trash.
+func trashCommand(fs Backend, keep time.Duration, args []string) int {
+
+	usage := "usage: trash list [path] | restore path|id ... | purge [path|id ...] | expire"
+	if 0 == len(args) {
+		fmt.Println(usage)
+		return 2
+	}
+	bin := newTrashBin(fs, keep)
+
+	if "expire" == args[0] {
+		if err := bin.Expire(); nil != err {
+			fmt.Println(err)
+			return 1
+		}
+		return 0
+	}
+
+	entries, err := bin.List()
+	if nil != err {
+		fmt.Println(err)
+		return 1
+	}
+
+	// entries for the arguments: by id, or by path and below
+	selected := func(names []string, latest bool) []*trashEntry {
+		var out []*trashEntry
+		seen := make(map[string]bool)
+		for i := len(entries) - 1; i >= 0; i-- {
+			entry := entries[i]
+			for _, name := range names {
+				match := entry.Id == name || entry.under(path.Clean("/" + name))
+				if match && !(latest && seen[entry.Path]) {
+					out = append(out, entry)
+					seen[entry.Path] = true
+					break
+				}
+			}
+		}
+		return out
+	}
+
+	status := 0
+	switch args[0] {
+	case "list":
+		if 1 < len(args) {
+			entries = selected(args[1:], false)
+			sort.Slice(entries, func(i, j int) bool {
+				return entries[i].Id < entries[j].Id
+			})
+		}
+		for _, entry := range entries {
+			kind := fmt.Sprintf("%d", entry.Size)
+			if entry.IsDir {
+				kind = "dir"
+			}
+			fmt.Printf("%s  %s  %8s  %s\n", entry.Id, entry.Deleted.Local().Format("2006-01-02 15:04:05"), kind, entry.Path)
+		}
+
+	case "restore":
+		if 1 == len(args) {
+			fmt.Println(usage)
+			return 2
+		}
+		// directories before what goes in them
+		restore := selected(args[1:], true)
+		sort.Slice(restore, func(i, j int) bool {
+			return strings.Count(restore[i].Path, "/") < strings.Count(restore[j].Path, "/")
+		})
+		for _, entry := range restore {
+			if err := bin.Restore(entry); nil != err {
+				fmt.Println(err)
+				status = 1
+				continue
+			}
+			fmt.Printf("restored %s\n", entry.Path)
+		}
+
+	case "purge":
+		if 1 < len(args) {
+			entries = selected(args[1:], false)
+		}
+		for _, entry := range entries {
+			if err := bin.Purge(entry); nil != err {
+				fmt.Println(err)
+				status = 1
+			}
+		}
+
+	default:
+		fmt.Println(usage)
+		return 2
+	}
+	return status
+}
@@ -0,0 +1,219 @@
+//go:build !memfs && !sftpfs
+
+/*
+ * conflict.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+
+// what to do when a file changed remotely while we had it open for writing
+const (
+	conflictOff    = "off"    // don't check
+	conflictFail   = "fail"   // refuse the write with EIO
+	conflictRename = "rename" // save ours as name.conflict-<host>-<time>
+	conflictLWW    = "lww"    // last writer wins, just log
+)
+
+
+var errConflict = errors.New("remote file changed while open")
+
+
+// remote attributes our writes are based on
+type fileBase struct {
+	size  int64
+	mtime int64
+}
+
+
+func statBase(info os.FileInfo) fileBase {
+	return fileBase{info.Size(), info.ModTime().Unix()}
+}
+
+
+// set up conflict checks for a handle opened for writing
+func (self *Sshfs) guard(handle *Handle, path string) error {
+
+	handle.target = path
+	if conflictOff == self.conflict {
+		return nil
+	}
+
+	// by path: Stat of a spooled file would upload it
+	info, err := self.fs.Stat(path)
+	if nil != err {
+		// not there until the first upload
+		info, err = handle.fp.Stat()
+	}
+	if nil != err {
+		return err
+	}
+	handle.base = statBase(info)
+
+	handle.wbuf.precommit = func() (io.WriterAt, error) {
+		return self.commit(handle)
+	}
+	handle.wbuf.postcommit = func() {
+		// our own writes moved the remote mtime
+		self.lock.Lock()
+		target := handle.target
+		self.lock.Unlock()
+		if info, err := self.fs.Stat(target); nil == err {
+			handle.base = statBase(info)
+		}
+	}
+	return nil
+}
+
+
+// our own chmod, utimens or rename of path, now at newpath: handles open
+// on it follow instead of seeing a remote change
+func (self *Sshfs) rebase(path string, newpath string) {
+
+	self.lock.Lock()
+	var moved []*Handle
+	for _, handle := range self.handles {
+		if path == handle.target {
+			handle.target = newpath
+			moved = append(moved, handle)
+		} else if strings.HasPrefix(handle.target, path + "/") {
+			handle.target = newpath + handle.target[len(path):]
+			moved = append(moved, handle)
+		}
+	}
+	self.lock.Unlock()
+
+	for _, handle := range moved {
+		if info, err := self.fs.Stat(handle.target); nil == err {
+			handle.base = statBase(info)
+		}
+	}
+}
+
+
+// runs before buffered data is committed to the remote file
+func (self *Sshfs) commit(handle *Handle) (io.WriterAt, error) {
+
+	var w io.WriterAt
+
+	if conflictOff != self.conflict {
+		self.lock.Lock()
+		target := handle.target
+		self.lock.Unlock()
+		info, err := self.fs.Stat(target)
+		if nil != err || statBase(info) != handle.base {
+			fmt.Printf("[conflict] %s changed remotely since open (policy %s)\n", target, self.conflict)
+
+			switch self.conflict {
+			case conflictFail:
+				return nil, errConflict
+			case conflictRename:
+				name := conflictName(target)
+				fp, err := saveConflict(self.fs, target, name, handle.trunc)
+				if nil != err {
+					return nil, err
+				}
+				fmt.Printf("[conflict] saving our changes as %s\n", name)
+
+				handle.fplock.Lock()
+				handle.fp.Close()
+				handle.fp = fp
+				handle.fplock.Unlock()
+				self.lock.Lock()
+				handle.target = name
+				self.lock.Unlock()
+				handle.trunc = false
+				if info, err := fp.Stat(); nil == err {
+					handle.base = statBase(info)
+				}
+				w = fp
+			}
+		}
+	}
+
+	// O_TRUNC is applied only once the commit is allowed
+	if handle.trunc {
+		err := handle.fp.Truncate(0)
+		if nil != err {
+			return nil, err
+		}
+		handle.trunc = false
+	}
+	return w, nil
+}
+
+
+// create name, seeded with the current remote content unless we replace it all
+func saveConflict(fs Backend, path string, name string, empty bool) (File, error) {
+
+	dst, err := fs.Open(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if nil != err {
+		return nil, err
+	}
+	if empty {
+		return dst, nil
+	}
+
+	src, err := fs.Open(path, os.O_RDONLY)
+	if nil != err {
+		// deleted remotely; ours starts from nothing
+		return dst, nil
+	}
+	defer src.Close()
+
+	_, err = copyFile(dst, src)
+	if nil != err {
+		dst.Close()
+		return nil, err
+	}
+	return dst, nil
+}
+
+
+// a rename-based save replaces newpath; check it against what we last saw
+func (self *Sshfs) renameTarget(newpath string) (string, error) {
+
+	if conflictOff == self.conflict {
+		return newpath, nil
+	}
+
+	node, found := self.lookup(newpath)
+	if !found || node.IsDir {
+		return newpath, nil
+	}
+
+	info, err := self.fs.Stat(newpath)
+	if nil != err {
+		return newpath, nil
+	}
+	if statBase(info) == (fileBase{int64(node.Size), node.Mtime.Unix()}) {
+		return newpath, nil
+	}
+
+	fmt.Printf("[conflict] %s changed remotely before rename (policy %s)\n", newpath, self.conflict)
+	switch self.conflict {
+	case conflictFail:
+		return "", errConflict
+	case conflictRename:
+		name := conflictName(newpath)
+		fmt.Printf("[conflict] saving our changes as %s\n", name)
+		return name, nil
+	}
+	return newpath, nil
+}
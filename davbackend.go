@@ -0,0 +1,549 @@
+/*
+ * davbackend.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// lifetime asked for with LOCK
+const davLockTimeout = 10 * time.Minute
+
+
+// Backend over WebDAV
+//
+// Attributes and listings come from PROPFIND, reads are ranged GETs and
+// changes are spooled locally and sent with a single PUT. Locks taken with
+// Lock are sent in an If header with every request that modifies the path.
+type davBackend struct {
+	base     *url.URL
+	user     string
+	password string
+	client   *http.Client
+	lock     sync.Mutex
+	tokens   map[string]string
+}
+
+
+func newDavBackend(rawurl string, user string, password string) (*davBackend, error) {
+
+	base, err := url.Parse(rawurl)
+	if nil != err {
+		return nil, err
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+
+	self := &davBackend{}
+	self.base = base
+	self.user = user
+	self.password = password
+	self.client = &http.Client{}
+	self.tokens = make(map[string]string)
+
+	// fail early on bad address or credentials
+	info, err := self.Stat("/")
+	if nil != err {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a collection", rawurl)
+	}
+	return self, nil
+}
+
+
+func (self *davBackend) url(name string) string {
+	u := *self.base
+	u.Path = self.base.Path + path.Clean("/" + name)
+	return u.String()
+}
+
+
+func (self *davBackend) request(method string, name string, body io.Reader, header map[string]string) (*http.Response, error) {
+
+	req, err := http.NewRequest(method, self.url(name), body)
+	if nil != err {
+		return nil, err
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	return self.do(req, name)
+}
+
+
+func davError(method string, name string, resp *http.Response) error {
+	err := fmt.Errorf("%s %s: %s", method, name, resp.Status)
+	switch resp.StatusCode {
+	case 404, 409:
+		// 409 is a missing parent collection
+		return fmt.Errorf("%w: %w", err, os.ErrNotExist)
+	case 401, 403, 423:
+		return fmt.Errorf("%w: %w", err, os.ErrPermission)
+	case 412:
+		return fmt.Errorf("%w: %w", err, os.ErrExist)
+	case 405, 501:
+		return fmt.Errorf("%w: %w", err, errors.ErrUnsupported)
+	}
+	return err
+}
+
+
+func (self *davBackend) token(name string) (string, bool) {
+	defer self.synchronize()()
+	token, found := self.tokens[path.Clean(name)]
+	return token, found
+}
+
+
+// PROPFIND replies
+type davMultistatus struct {
+	Responses []davResponse `xml:"DAV: response"`
+}
+
+type davResponse struct {
+	Href     string        `xml:"DAV: href"`
+	Propstat []davPropstat `xml:"DAV: propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"DAV: prop"`
+	Status string  `xml:"DAV: status"`
+}
+
+type davProp struct {
+	ResourceType struct {
+		Collection *struct{} `xml:"DAV: collection"`
+	} `xml:"DAV: resourcetype"`
+	Length    string `xml:"DAV: getcontentlength"`
+	Modified  string `xml:"DAV: getlastmodified"`
+	Available string `xml:"DAV: quota-available-bytes"`
+	Used      string `xml:"DAV: quota-used-bytes"`
+}
+
+
+const davPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop>
+<D:resourcetype/><D:getcontentlength/><D:getlastmodified/>
+</D:prop></D:propfind>`
+
+
+const davQuota = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop>
+<D:quota-available-bytes/><D:quota-used-bytes/>
+</D:prop></D:propfind>`
+
+
+// PROPFIND name; entries are keyed by their path below the mount root
+func (self *davBackend) propfind(name string, depth string, body string) (map[string]davProp, error) {
+
+	resp, err := self.request("PROPFIND", name, strings.NewReader(body), map[string]string{
+		"Depth":        depth,
+		"Content-Type": "application/xml; charset=utf-8",
+	})
+	if nil != err {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	ms := &davMultistatus{}
+	err = xml.NewDecoder(resp.Body).Decode(ms)
+	if nil != err {
+		return nil, err
+	}
+
+	props := make(map[string]davProp)
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if nil != err {
+			continue
+		}
+		entry := path.Clean("/" + strings.TrimPrefix(href.Path, self.base.Path))
+		for _, ps := range r.Propstat {
+			if strings.Contains(ps.Status, " 200 ") {
+				props[entry] = ps.Prop
+			}
+		}
+	}
+	return props, nil
+}
+
+
+func davInfo(name string, prop davProp) os.FileInfo {
+	info := &fileInfo{name: path.Base(name), mode: 0644}
+	if nil != prop.ResourceType.Collection {
+		info.mode = fs.ModeDir | 0755
+	}
+	info.size, _ = strconv.ParseInt(prop.Length, 10, 64)
+	info.mtime, _ = http.ParseTime(prop.Modified)
+	return info
+}
+
+
+func (self *davBackend) Stat(name string) (os.FileInfo, error) {
+
+	props, err := self.propfind(name, "0", davPropfind)
+	if nil != err {
+		return nil, err
+	}
+	for _, prop := range props {
+		return davInfo(name, prop), nil
+	}
+	return nil, os.ErrNotExist
+}
+
+
+func (self *davBackend) Lstat(name string) (os.FileInfo, error) {
+	return self.Stat(name)
+}
+
+
+func (self *davBackend) ReadDir(name string) ([]os.FileInfo, error) {
+
+	props, err := self.propfind(name, "1", davPropfind)
+	if nil != err {
+		return nil, err
+	}
+
+	var infos []os.FileInfo
+	for entry, prop := range props {
+		if path.Clean("/" + name) != entry {
+			infos = append(infos, davInfo(entry, prop))
+		}
+	}
+	return infos, nil
+}
+
+
+func (self *davBackend) Open(name string, flags int) (File, error) {
+
+	fp := self.file(name)
+
+	info, err := self.Stat(name)
+	switch {
+	case nil == err && info.IsDir():
+		return nil, fmt.Errorf("%s is a collection: %w", name, os.ErrInvalid)
+	case nil == err && 0 != flags&os.O_CREATE && 0 != flags&os.O_EXCL:
+		return nil, os.ErrExist
+	case nil == err:
+		fp.size = info.Size()
+		fp.mtime = info.ModTime()
+	case !errors.Is(err, os.ErrNotExist) || 0 == flags&os.O_CREATE:
+		return nil, err
+	}
+
+	if 0 != flags&(os.O_WRONLY|os.O_RDWR) && (nil != err || 0 != flags&os.O_TRUNC) {
+		err = fp.Truncate(0)
+		if nil == err {
+			err = fp.Sync()
+		}
+		if nil != err {
+			fp.Close()
+			return nil, err
+		}
+	}
+	return fp, nil
+}
+
+
+func (self *davBackend) file(name string) *spoolFile {
+
+	fp := &spoolFile{}
+	fp.name = path.Base(name)
+	fp.read = func(buff []byte, ofst int64) error {
+		resp, err := self.request("GET", name, nil, map[string]string{
+			"Range": fmt.Sprintf("bytes=%d-%d", ofst, ofst + int64(len(buff)) - 1),
+		})
+		if nil != err {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if http.StatusPartialContent != resp.StatusCode {
+			// the server ignored the range
+			_, err = io.CopyN(io.Discard, resp.Body, ofst)
+			if nil != err {
+				return err
+			}
+		}
+		_, err = io.ReadFull(resp.Body, buff)
+		return err
+	}
+	fp.fetch = func(w io.Writer) error {
+		resp, err := self.request("GET", name, nil, nil)
+		if nil != err {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = io.Copy(w, resp.Body)
+		return err
+	}
+	fp.upload = func(r io.Reader, size int64) (time.Time, error) {
+		req, err := http.NewRequest("PUT", self.url(name), r)
+		if nil != err {
+			return time.Time{}, err
+		}
+		req.ContentLength = size
+
+		resp, err := self.do(req, name)
+		if nil != err {
+			return time.Time{}, err
+		}
+		resp.Body.Close()
+
+		// the server picks the modification time
+		info, err := self.Stat(name)
+		if nil != err {
+			return time.Time{}, nil
+		}
+		return info.ModTime(), nil
+	}
+	return fp
+}
+
+
+// send a prepared request (for bodies with a known length)
+func (self *davBackend) do(req *http.Request, name string) (*http.Response, error) {
+
+	if "" != self.user {
+		req.SetBasicAuth(self.user, self.password)
+	}
+
+	switch req.Method {
+	case "PUT", "DELETE", "MOVE":
+		if token, found := self.token(name); found {
+			req.Header.Set("If", "(<" + token + ">)")
+		}
+	}
+
+	resp, err := self.client.Do(req)
+	if nil != err {
+		return nil, err
+	}
+	if 300 <= resp.StatusCode {
+		defer resp.Body.Close()
+		return nil, davError(req.Method, name, resp)
+	}
+	return resp, nil
+}
+
+
+func (self *davBackend) Create(name string) (File, error) {
+	return self.Open(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+
+func (self *davBackend) Remove(name string) error {
+
+	info, err := self.Stat(name)
+	if nil != err {
+		return err
+	}
+	if info.IsDir() {
+		// DELETE on a collection removes everything below it
+		infos, err := self.ReadDir(name)
+		if nil != err {
+			return err
+		}
+		if 0 != len(infos) {
+			return fmt.Errorf("%s: collection not empty: %w", name, os.ErrExist)
+		}
+	}
+
+	resp, err := self.request("DELETE", name, nil, nil)
+	if nil != err {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+
+func (self *davBackend) Rename(oldpath string, newpath string) error {
+	return self.transfer("MOVE", oldpath, newpath)
+}
+
+
+// server side copy of a file or collection
+func (self *davBackend) Copy(oldpath string, newpath string) error {
+	return self.transfer("COPY", oldpath, newpath)
+}
+
+
+func (self *davBackend) transfer(method string, oldpath string, newpath string) error {
+
+	resp, err := self.request(method, oldpath, nil, map[string]string{
+		"Destination": self.url(newpath),
+		"Overwrite":   "T",
+	})
+	if nil != err {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+
+func (self *davBackend) Mkdir(name string) error {
+
+	resp, err := self.request("MKCOL", name, nil, nil)
+	if errors.Is(err, errors.ErrUnsupported) {
+		// 405 here means the name is taken
+		return fmt.Errorf("%w: %w", err, os.ErrExist)
+	}
+	if nil != err {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+
+func (self *davBackend) Chmod(name string, mode os.FileMode) error {
+	return errors.ErrUnsupported
+}
+
+
+func (self *davBackend) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	// getlastmodified is protected on most servers
+	return errors.ErrUnsupported
+}
+
+
+func (self *davBackend) Symlink(target string, newpath string) error {
+	return errors.ErrUnsupported
+}
+
+
+// RFC 4331 quota properties, where the server has them
+func (self *davBackend) StatVFS(name string, stat *fuse.Statfs_t) error {
+
+	props, err := self.propfind(name, "0", davQuota)
+	if nil != err {
+		return err
+	}
+
+	for _, prop := range props {
+		avail, aerr := strconv.ParseUint(prop.Available, 10, 64)
+		used, uerr := strconv.ParseUint(prop.Used, 10, 64)
+		if nil != aerr || nil != uerr {
+			break
+		}
+		stat.Bsize = 4096
+		stat.Frsize = 4096
+		stat.Blocks = (avail + used) / 4096
+		stat.Bfree = avail / 4096
+		stat.Bavail = stat.Bfree
+		stat.Namemax = 255
+		return nil
+	}
+	return errors.ErrUnsupported
+}
+
+
+// take a write lock on name; exclusive or shared
+func (self *davBackend) Lock(name string, exclusive bool) error {
+
+	scope := "<D:shared/>"
+	if exclusive {
+		scope = "<D:exclusive/>"
+	}
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope>` + scope + `</D:lockscope>
+<D:locktype><D:write/></D:locktype></D:lockinfo>`
+
+	header := map[string]string{
+		"Depth":        "0",
+		"Timeout":      fmt.Sprintf("Second-%d", int(davLockTimeout.Seconds())),
+		"Content-Type": "application/xml; charset=utf-8",
+	}
+	if token, found := self.token(name); found {
+		// refresh the lock we hold
+		body = ""
+		header["If"] = "(<" + token + ">)"
+	}
+
+	resp, err := self.request("LOCK", name, strings.NewReader(body), header)
+	if nil != err {
+		return err
+	}
+	resp.Body.Close()
+
+	token := strings.Trim(resp.Header.Get("Lock-Token"), "<>")
+	if "" != token {
+		defer self.synchronize()()
+		self.tokens[path.Clean(name)] = token
+	}
+	return nil
+}
+
+
+func (self *davBackend) Unlock(name string) error {
+
+	token, found := self.token(name)
+	if !found {
+		return nil
+	}
+
+	self.lock.Lock()
+	delete(self.tokens, path.Clean(name))
+	self.lock.Unlock()
+
+	resp, err := self.request("UNLOCK", name, nil, map[string]string{
+		"Lock-Token": "<" + token + ">",
+	})
+	if nil != err {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+
+func (self *davBackend) Close() error {
+
+	self.lock.Lock()
+	var names []string
+	for name := range self.tokens {
+		names = append(names, name)
+	}
+	self.lock.Unlock()
+
+	for _, name := range names {
+		self.Unlock(name)
+	}
+	return nil
+}
+
+
+func (self *davBackend) synchronize() func() {
+	self.lock.Lock()
+	return func() {
+		self.lock.Unlock()
+	}
+}
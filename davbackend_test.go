@@ -0,0 +1,314 @@
+/*
+ * davbackend_test.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+
+// WebDAV server below /dav, counting requests by method
+type testDavServer struct {
+	*httptest.Server
+	lock     sync.Mutex
+	requests map[string]int
+}
+
+
+func newTestDavServer(t *testing.T) *testDavServer {
+	self := &testDavServer{}
+	self.requests = make(map[string]int)
+	handler := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	}
+	self.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		self.lock.Lock()
+		self.requests[r.Method]++
+		self.lock.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(self.Close)
+	return self
+}
+
+
+func (self *testDavServer) backend(t *testing.T) *davBackend {
+	fs, err := newDavBackend(self.URL + "/dav/", "", "")
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		fs.Close()
+	})
+	return fs
+}
+
+
+func (self *testDavServer) count(method string) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.requests[method]
+}
+
+
+func writeDav(t *testing.T, fs Backend, name string, flags int, data string, ofst int64) {
+	fp, err := fs.Open(name, flags)
+	if nil != err {
+		t.Fatal(err)
+	}
+	_, err = fp.WriteAt([]byte(data), ofst)
+	if nil != err {
+		t.Fatal(err)
+	}
+	err = fp.Close()
+	if nil != err {
+		t.Fatal(err)
+	}
+}
+
+
+func TestDavFiles(t *testing.T) {
+
+	server := newTestDavServer(t)
+	fs := server.backend(t)
+
+	err := fs.Mkdir("/dir")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if err = fs.Mkdir("/dir"); !errors.Is(err, os.ErrExist) {
+		t.Errorf("second mkdir got %v", err)
+	}
+
+	writeDav(t, fs, "/dir/file.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, "hello world", 0)
+	if _, err = fs.Open("/dir/file.txt", os.O_RDWR|os.O_CREATE|os.O_EXCL); !errors.Is(err, os.ErrExist) {
+		t.Errorf("exclusive create got %v", err)
+	}
+
+	// changes in the middle keep the rest of the file
+	writeDav(t, fs, "/dir/file.txt", os.O_RDWR, "WORLD", 6)
+	if data, err := readBackendFile(fs, "/dir/file.txt"); nil != err || "hello WORLD" != string(data) {
+		t.Errorf("got %q, %v", data, err)
+	}
+
+	info, err := fs.Stat("/dir/file.txt")
+	if nil != err || 11 != info.Size() || info.IsDir() || info.ModTime().IsZero() {
+		t.Errorf("stat got %v, %v", info, err)
+	}
+	info, err = fs.Stat("/dir")
+	if nil != err || !info.IsDir() {
+		t.Errorf("stat of collection got %v, %v", info, err)
+	}
+	if _, err = fs.Stat("/missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stat of missing file got %v", err)
+	}
+	if _, err = fs.Open("/dir", os.O_RDONLY); nil == err {
+		t.Error("opened a collection")
+	}
+
+	err = fs.Copy("/dir/file.txt", "/dir/copy.txt")
+	if nil != err {
+		t.Fatal(err)
+	}
+	err = fs.Rename("/dir/copy.txt", "/dir/moved name.txt")
+	if nil != err {
+		t.Fatal(err)
+	}
+	infos, err := fs.ReadDir("/dir")
+	if nil != err {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	if "file.txt,moved name.txt" != strings.Join(names, ",") {
+		t.Errorf("listing got %q", names)
+	}
+
+	if err = fs.Remove("/dir"); !errors.Is(err, os.ErrExist) {
+		t.Errorf("remove of full collection got %v", err)
+	}
+	for _, name := range []string{"/dir/file.txt", "/dir/moved name.txt", "/dir"} {
+		if err = fs.Remove(name); nil != err {
+			t.Errorf("remove %s: %s", name, err)
+		}
+	}
+	if _, err = fs.Stat("/dir"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stat after remove got %v", err)
+	}
+}
+
+
+func TestDavRead(t *testing.T) {
+
+	server := newTestDavServer(t)
+	fs := server.backend(t)
+	content := strings.Repeat("0123456789", 1000)
+	writeDav(t, fs, "/file.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, content, 0)
+
+	fp, err := fs.Open("/file.txt", os.O_RDONLY)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	gets := server.count("GET")
+	buff := make([]byte, 16)
+	n, err := fp.ReadAt(buff, 1234)
+	if nil != err || 16 != n || content[1234:1250] != string(buff) {
+		t.Errorf("read got %q, %v", buff[:n], err)
+	}
+	n, err = fp.ReadAt(buff, int64(len(content)) - 5)
+	if io.EOF != err || 5 != n || content[len(content)-5:] != string(buff[:n]) {
+		t.Errorf("read at the end got %q, %v", buff[:n], err)
+	}
+	if _, err = fp.ReadAt(buff, int64(len(content))); io.EOF != err {
+		t.Errorf("read past the end got %v", err)
+	}
+	if 2 != server.count("GET") - gets {
+		t.Errorf("%d GETs for two ranged reads", server.count("GET") - gets)
+	}
+}
+
+
+func TestDavLock(t *testing.T) {
+
+	server := newTestDavServer(t)
+	owner := server.backend(t)
+	other := server.backend(t)
+	writeDav(t, owner, "/file.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, "one", 0)
+
+	err := owner.Lock("/file.txt", true)
+	if nil != err {
+		t.Fatal(err)
+	}
+	// refreshing keeps the lock we hold
+	err = owner.Lock("/file.txt", true)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	writeDav(t, owner, "/file.txt", os.O_RDWR, "two", 0)
+
+	fp, err := other.Open("/file.txt", os.O_RDWR)
+	if nil != err {
+		t.Fatal(err)
+	}
+	fp.WriteAt([]byte("three"), 0)
+	if err = fp.Close(); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("write to locked file got %v", err)
+	}
+	if err = other.Remove("/file.txt"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("remove of locked file got %v", err)
+	}
+
+	err = owner.Unlock("/file.txt")
+	if nil != err {
+		t.Fatal(err)
+	}
+	writeDav(t, other, "/file.txt", os.O_RDWR|os.O_TRUNC, "four", 0)
+	if data, _ := readBackendFile(owner, "/file.txt"); "four" != string(data) {
+		t.Errorf("got %q", data)
+	}
+}
+
+
+func TestSpoolFile(t *testing.T) {
+
+	remote := []byte("remote content")
+	var reads, fetches, uploads int
+	newSpool := func() *spoolFile {
+		fp := &spoolFile{}
+		fp.name = "file"
+		fp.size = int64(len(remote))
+		fp.read = func(buff []byte, ofst int64) error {
+			reads++
+			copy(buff, remote[ofst:])
+			return nil
+		}
+		fp.fetch = func(w io.Writer) error {
+			fetches++
+			_, err := w.Write(remote)
+			return err
+		}
+		fp.upload = func(r io.Reader, size int64) (time.Time, error) {
+			uploads++
+			data, err := io.ReadAll(r)
+			if int64(len(data)) != size {
+				t.Errorf("upload of %d bytes said %d", len(data), size)
+			}
+			remote = data
+			return time.Time{}, err
+		}
+		return fp
+	}
+
+	// untouched: reads go to the remote, nothing is uploaded
+	fp := newSpool()
+	buff := make([]byte, 7)
+	n, err := fp.ReadAt(buff, 7)
+	if nil != err || "content" != string(buff[:n]) {
+		t.Errorf("read got %q, %v", buff[:n], err)
+	}
+	fp.Close()
+	if 1 != reads || 0 != fetches || 0 != uploads {
+		t.Errorf("untouched: %d reads, %d fetches, %d uploads", reads, fetches, uploads)
+	}
+
+	// a write is made to the remote content and uploaded once on close
+	fp = newSpool()
+	fp.WriteAt([]byte("REMOTE"), 0)
+	n, err = fp.ReadAt(buff, 0)
+	if nil != err || "REMOTE " != string(buff[:n]) {
+		t.Errorf("read back got %q, %v", buff[:n], err)
+	}
+	info, err := fp.Stat()
+	if nil != err || int64(len("REMOTE content")) != info.Size() || info.ModTime().IsZero() {
+		t.Errorf("stat got %v, %v", info, err)
+	}
+	err = fp.Close()
+	if nil != err || !bytes.Equal([]byte("REMOTE content"), remote) {
+		t.Errorf("close got %q, %v", remote, err)
+	}
+	if 1 != fetches || 1 != uploads {
+		t.Errorf("after a write: %d fetches, %d uploads", fetches, uploads)
+	}
+
+	// truncating to zero doesn't download what it throws away
+	fp = newSpool()
+	fp.Truncate(0)
+	fp.WriteAt([]byte("new"), 0)
+	err = fp.Close()
+	if nil != err || "new" != string(remote) {
+		t.Errorf("close got %q, %v", remote, err)
+	}
+	if 1 != fetches || 2 != uploads {
+		t.Errorf("after a truncate: %d fetches, %d uploads", fetches, uploads)
+	}
+}
@@ -0,0 +1,406 @@
+/*
+ * diskcache.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+
+// cached content is stored in blocks of this size
+const cacheBlockSize = 256 * 1024
+
+
+// metadata lives beside the content blocks and is never evicted
+const (
+	cacheMetaDir    = "meta"
+	cacheJournalDir = "journal"
+)
+
+
+// Persistent content cache
+//
+// Layout: <dir>/<key[:2]>/<key>/<validator>/<block index>
+//         <dir>/meta/<key[:2]>/<key>           attributes and listing
+//         <dir>/journal/<key>.json, <key>.data offline writes
+//
+// The key is derived from host and remote path, the validator from the
+// remote size and mtime (or a server side hash). Every block is its own
+// file, written to a temp name and renamed into place, so partially read
+// files are cached sparsely and several mounts can share one directory:
+// a block is either complete or absent, and a changed remote file gets a
+// new validator directory instead of overwriting the old one.
+type DiskCache struct {
+	dir   string
+	limit int64
+	lock  sync.Mutex
+	used  int64
+}
+
+
+// Cached attributes of a remote file or directory entry
+type cacheAttr struct {
+	Name  string
+	IsDir bool
+	Size  int64
+	Mtime int64
+	Mode  os.FileMode `json:",omitempty"`
+}
+
+
+func infoAttr(info os.FileInfo) cacheAttr {
+	return cacheAttr{info.Name(), info.IsDir(), info.Size(), info.ModTime().Unix(), info.Mode()}
+}
+
+
+// Cached remote file
+type cacheEntry struct {
+	cache *DiskCache
+	dir   string
+	size  int64
+}
+
+
+func OpenDiskCache(dir string, limit int64) (*DiskCache, error) {
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	self := &DiskCache{}
+	self.dir = dir
+	self.limit = limit
+	self.used = self.usage()
+	return self, nil
+}
+
+
+func cacheKey(host string, path string) string {
+	sum := sha256.Sum256([]byte(host + "\x00" + path))
+	return hex.EncodeToString(sum[:])
+}
+
+
+func cacheValidator(size int64, mtime time.Time, hash string) string {
+	if "" != hash {
+		return "h-" + hash
+	}
+	return fmt.Sprintf("%x-%x", size, mtime.UnixNano())
+}
+
+
+// look up the entry for a remote file, dropping content of older versions
+func (self *DiskCache) Entry(host string, path string, size int64, mtime time.Time, hash string) *cacheEntry {
+
+	key := cacheKey(host, path)
+	base := filepath.Join(self.dir, key[:2], key)
+	validator := cacheValidator(size, mtime, hash)
+
+	entries, _ := os.ReadDir(base)
+	for _, entry := range entries {
+		if entry.Name() != validator {
+			os.RemoveAll(filepath.Join(base, entry.Name()))
+		}
+	}
+
+	cent := &cacheEntry{}
+	cent.cache = self
+	cent.dir = filepath.Join(base, validator)
+	cent.size = size
+	return cent
+}
+
+
+// forget everything cached for a remote file
+func (self *DiskCache) Invalidate(host string, path string) {
+	key := cacheKey(host, path)
+	os.RemoveAll(filepath.Join(self.dir, key[:2], key))
+}
+
+
+// check a fully cached file against the server's hash of it and drop the
+// content if it doesn't match; partly cached files are left alone
+func (self *cacheEntry) Verify(alg string, sum []byte) bool {
+
+	marker := filepath.Join(self.dir, "verified-" + alg)
+	if seen, err := os.ReadFile(marker); nil == err && bytes.Equal(seen, sum) {
+		return true
+	}
+
+	h, err := newHash(alg)
+	if nil != err {
+		fmt.Println(err)
+		return false
+	}
+	for index := int64(0); index * cacheBlockSize < self.size; index++ {
+		block, err := os.ReadFile(filepath.Join(self.dir, fmt.Sprint(index)))
+		if nil != err {
+			return false
+		}
+		h.Write(block)
+	}
+
+	if !bytes.Equal(h.Sum(nil), sum) {
+		fmt.Printf("cached content of %s doesn't match the server's %s; dropped\n", self.dir, alg)
+		os.RemoveAll(self.dir)
+		return false
+	}
+	os.WriteFile(marker, sum, 0600)
+	return true
+}
+
+
+// read through the cache; missing blocks are fetched with fetch
+func (self *cacheEntry) ReadAt(buff []byte, ofst int64, fetch func([]byte, int64) (int, error)) (n int, err error) {
+
+	if ofst >= self.size {
+		return 0, io.EOF
+	}
+	if end := ofst + int64(len(buff)); end > self.size {
+		buff = buff[:self.size-ofst]
+	}
+
+	for n < len(buff) {
+		pos := ofst + int64(n)
+		index := pos / cacheBlockSize
+
+		block, err := self.block(index, fetch)
+		if nil != err {
+			return n, err
+		}
+
+		skip := pos - index*cacheBlockSize
+		if skip >= int64(len(block)) {
+			return n, io.EOF
+		}
+		n += copy(buff[n:], block[skip:])
+	}
+
+	if ofst+int64(n) >= self.size {
+		err = io.EOF
+	}
+	return n, err
+}
+
+
+func (self *cacheEntry) block(index int64, fetch func([]byte, int64) (int, error)) ([]byte, error) {
+
+	name := filepath.Join(self.dir, fmt.Sprint(index))
+
+	block, err := os.ReadFile(name)
+	if nil == err {
+		// file mtime is the LRU clock
+		now := time.Now()
+		os.Chtimes(name, now, now)
+		return block, nil
+	}
+
+	size := self.size - index*cacheBlockSize
+	if size > cacheBlockSize {
+		size = cacheBlockSize
+	}
+	block = make([]byte, size)
+	n := 0
+	for n < len(block) {
+		m, err := fetch(block[n:], index*cacheBlockSize + int64(n))
+		n += m
+		if io.EOF == err || (nil == err && 0 == m) {
+			break
+		}
+		if nil != err {
+			return nil, err
+		}
+	}
+
+	// a short block means the file changed under us; serve it, don't keep it
+	if n < len(block) {
+		return block[:n], nil
+	}
+	self.cache.store(self.dir, name, block)
+	return block, nil
+}
+
+
+func (self *DiskCache) store(dir string, name string, block []byte) {
+
+	err := os.MkdirAll(dir, 0700)
+	if nil != err {
+		fmt.Println(err)
+		return
+	}
+
+	tmp := fmt.Sprintf("%s.tmp-%d-%d", name, os.Getpid(), rand.Int63())
+	err = os.WriteFile(tmp, block, 0600)
+	if nil == err {
+		err = os.Rename(tmp, name)
+	}
+	if nil != err {
+		// another mount may have stored the same block
+		os.Remove(tmp)
+		return
+	}
+
+	self.lock.Lock()
+	self.used += int64(len(block))
+	over := self.used > self.limit
+	self.lock.Unlock()
+
+	if over {
+		self.evict()
+	}
+}
+
+
+type cacheBlock struct {
+	path  string
+	size  int64
+	atime time.Time
+}
+
+
+// drop least recently used blocks until the cache is below 90% of its limit
+func (self *DiskCache) evict() {
+
+	var blocks []cacheBlock
+	var used int64
+
+	filepath.WalkDir(self.dir, func(path string, entry fs.DirEntry, err error) error {
+		if nil != err {
+			return nil
+		}
+		if entry.IsDir() {
+			return self.skip(path)
+		}
+		info, err := entry.Info()
+		if nil != err {
+			return nil
+		}
+		if strings.Contains(entry.Name(), ".tmp-") {
+			// leftover from a crashed mount
+			if time.Since(info.ModTime()) > time.Hour {
+				os.Remove(path)
+			}
+			return nil
+		}
+		blocks = append(blocks, cacheBlock{path, info.Size(), info.ModTime()})
+		used += info.Size()
+		return nil
+	})
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].atime.Before(blocks[j].atime)
+	})
+
+	target := self.limit / 10 * 9
+	for _, block := range blocks {
+		if used <= target {
+			break
+		}
+		if nil == os.Remove(block.path) {
+			used -= block.size
+			os.Remove(filepath.Dir(block.path))
+		}
+	}
+
+	self.lock.Lock()
+	self.used = used
+	self.lock.Unlock()
+}
+
+
+func (self *DiskCache) usage() int64 {
+	var used int64
+	filepath.WalkDir(self.dir, func(path string, entry fs.DirEntry, err error) error {
+		if nil == err && entry.IsDir() {
+			return self.skip(path)
+		}
+		if nil == err {
+			if info, err := entry.Info(); nil == err {
+				used += info.Size()
+			}
+		}
+		return nil
+	})
+	return used
+}
+
+
+// only content blocks count against the limit
+func (self *DiskCache) skip(path string) error {
+	if path == filepath.Join(self.dir, cacheMetaDir) || path == filepath.Join(self.dir, cacheJournalDir) {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+
+func (self *DiskCache) metaPath(host string, path string) string {
+	key := cacheKey(host, path)
+	return filepath.Join(self.dir, cacheMetaDir, key[:2], key)
+}
+
+
+// remember a directory listing for offline use
+func (self *DiskCache) StoreListing(host string, path string, entries []cacheAttr) {
+
+	data, err := json.Marshal(entries)
+	if nil != err {
+		fmt.Println(err)
+		return
+	}
+
+	name := self.metaPath(host, path)
+	err = os.MkdirAll(filepath.Dir(name), 0700)
+	if nil != err {
+		fmt.Println(err)
+		return
+	}
+
+	tmp := fmt.Sprintf("%s.tmp-%d-%d", name, os.Getpid(), rand.Int63())
+	err = os.WriteFile(tmp, data, 0600)
+	if nil == err {
+		err = os.Rename(tmp, name)
+	}
+	if nil != err {
+		os.Remove(tmp)
+	}
+}
+
+
+func (self *DiskCache) LoadListing(host string, path string) ([]cacheAttr, bool) {
+
+	data, err := os.ReadFile(self.metaPath(host, path))
+	if nil != err {
+		return nil, false
+	}
+
+	var entries []cacheAttr
+	if nil != json.Unmarshal(data, &entries) {
+		return nil, false
+	}
+	return entries, true
+}
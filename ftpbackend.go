@@ -0,0 +1,532 @@
+/*
+ * ftpbackend.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// idle control connections kept for reuse
+const ftpPoolSize = 4
+
+
+// Backend over FTP or FTPS
+//
+// FTP has one transfer per control connection, so connections come from a
+// small pool and every open file holds its own while a transfer runs.
+// Reads and writes are streamed; a read at another offset restarts the
+// transfer with REST, while writes must be sequential (out of order chunks
+// from the write buffer are held until the gap fills). Symlinks, statfs
+// and random writes are not available and fail with ENOSYS.
+type ftpBackend struct {
+	cfg  *ftpConfig
+	lock sync.Mutex
+	idle []*ftpConn
+}
+
+
+func newFtpBackend(cfg *ftpConfig) (*ftpBackend, error) {
+
+	self := &ftpBackend{}
+	self.cfg = cfg
+
+	// fail early on bad address or credentials
+	conn, err := self.get()
+	if nil != err {
+		return nil, err
+	}
+	self.put(conn, nil)
+	return self, nil
+}
+
+
+func (self *ftpBackend) get() (*ftpConn, error) {
+
+	self.lock.Lock()
+	for 0 < len(self.idle) {
+		conn := self.idle[len(self.idle)-1]
+		self.idle = self.idle[:len(self.idle)-1]
+		self.lock.Unlock()
+
+		// servers drop idle sessions; check ones that sat for a while
+		if time.Since(conn.used) < time.Minute {
+			return conn, nil
+		}
+		if _, _, err := conn.cmd(200, "NOOP"); nil == err {
+			return conn, nil
+		}
+		conn.Close()
+		self.lock.Lock()
+	}
+	self.lock.Unlock()
+
+	return dialFtp(self.cfg)
+}
+
+
+// return conn to the pool unless err left it in an unknown state
+func (self *ftpBackend) put(conn *ftpConn, err error) {
+
+	var ferr *ftpError
+	healthy := nil == err || errors.As(err, &ferr) || errors.Is(err, os.ErrNotExist) ||
+		errors.Is(err, errors.ErrUnsupported)
+
+	self.lock.Lock()
+	if healthy && len(self.idle) < ftpPoolSize {
+		self.idle = append(self.idle, conn)
+		conn = nil
+	}
+	self.lock.Unlock()
+
+	if nil != conn {
+		conn.Close()
+	}
+}
+
+
+func (self *ftpBackend) with(fn func(conn *ftpConn) error) error {
+	conn, err := self.get()
+	if nil != err {
+		return err
+	}
+	err = fn(conn)
+	self.put(conn, err)
+	return err
+}
+
+
+func (self *ftpBackend) Stat(path string) (info os.FileInfo, err error) {
+	err = self.with(func(conn *ftpConn) error {
+		info, err = conn.Stat(path)
+		return err
+	})
+	return
+}
+
+
+func (self *ftpBackend) Lstat(path string) (os.FileInfo, error) {
+	return self.Stat(path)
+}
+
+
+func (self *ftpBackend) ReadDir(path string) (infos []os.FileInfo, err error) {
+	err = self.with(func(conn *ftpConn) error {
+		infos, err = conn.List(path)
+		return err
+	})
+	return
+}
+
+
+func (self *ftpBackend) Open(path string, flags int) (File, error) {
+
+	fp := &ftpFile{}
+	fp.backend = self
+	fp.path = path
+	fp.pending = make(map[int64][]byte)
+
+	err := self.with(func(conn *ftpConn) error {
+		info, err := conn.Stat(path)
+		switch {
+		case nil == err && 0 != flags&os.O_CREATE && 0 != flags&os.O_EXCL:
+			return os.ErrExist
+		case nil == err:
+			fp.size = info.Size()
+			if 0 == flags&os.O_TRUNC || 0 == flags&(os.O_WRONLY|os.O_RDWR) {
+				return nil
+			}
+		case !errors.Is(err, os.ErrNotExist) || 0 == flags&os.O_CREATE:
+			return err
+		}
+		fp.size = 0
+		return conn.store(path)
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	fp.wpos = fp.size
+	return fp, nil
+}
+
+
+func (self *ftpBackend) Create(path string) (File, error) {
+	return self.Open(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+
+func (self *ftpBackend) Remove(path string) error {
+	return self.with(func(conn *ftpConn) error {
+		_, _, err := conn.cmd(250, "DELE %s", path)
+		if errors.Is(err, os.ErrNotExist) {
+			// DELE refuses directories with the same 550
+			if _, _, rerr := conn.cmd(250, "RMD %s", path); nil == rerr {
+				return nil
+			}
+		}
+		return err
+	})
+}
+
+
+func (self *ftpBackend) Rename(oldpath string, newpath string) error {
+	return self.with(func(conn *ftpConn) error {
+		_, _, err := conn.cmd(350, "RNFR %s", oldpath)
+		if nil == err {
+			_, _, err = conn.cmd(250, "RNTO %s", newpath)
+		}
+		return err
+	})
+}
+
+
+func (self *ftpBackend) Mkdir(path string) error {
+	return self.with(func(conn *ftpConn) error {
+		_, _, err := conn.cmd(257, "MKD %s", path)
+		return err
+	})
+}
+
+
+func (self *ftpBackend) Chmod(path string, mode os.FileMode) error {
+	return self.with(func(conn *ftpConn) error {
+		// not every server has SITE CHMOD; 500/502 map to ENOSYS
+		_, _, err := conn.cmd(200, "SITE CHMOD %o %s", mode.Perm(), path)
+		return err
+	})
+}
+
+
+func (self *ftpBackend) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	return self.with(func(conn *ftpConn) error {
+		if !conn.Has("MFMT") {
+			return errors.ErrUnsupported
+		}
+		_, _, err := conn.cmd(213, "MFMT %s %s", mtime.UTC().Format("20060102150405"), path)
+		return err
+	})
+}
+
+
+func (self *ftpBackend) Symlink(target string, newpath string) error {
+	return errors.ErrUnsupported
+}
+
+
+func (self *ftpBackend) StatVFS(path string, stat *fuse.Statfs_t) error {
+	return errors.ErrUnsupported
+}
+
+
+func (self *ftpBackend) Close() error {
+	self.lock.Lock()
+	idle := self.idle
+	self.idle = nil
+	self.lock.Unlock()
+
+	for _, conn := range idle {
+		conn.Close()
+	}
+	return nil
+}
+
+
+// create or truncate path to an empty file
+func (self *ftpConn) store(path string) error {
+	data, err := self.transfer("STOR %s", path)
+	if nil != err {
+		return err
+	}
+	data.Close()
+	return self.finish()
+}
+
+
+// Open FTP file
+type ftpFile struct {
+	backend *ftpBackend
+	path    string
+	lock    sync.Mutex
+	size    int64
+
+	// running download
+	rconn *ftpConn
+	rdata net.Conn
+	rpos  int64
+
+	// running upload; chunks past wpos wait in pending
+	wconn   *ftpConn
+	wdata   net.Conn
+	wpos    int64
+	pending map[int64][]byte
+	werr    error
+}
+
+
+func (self *ftpFile) ReadAt(buff []byte, ofst int64) (int, error) {
+
+	defer self.synchronize()()
+
+	// read back what we wrote
+	err := self.endWrite()
+	if nil != err {
+		return 0, err
+	}
+
+	if nil == self.rdata || self.rpos != ofst {
+		self.endRead(false)
+		if ofst >= self.size {
+			return 0, io.EOF
+		}
+		err = self.startRead(ofst)
+		if nil != err {
+			return 0, err
+		}
+	}
+
+	n, err := io.ReadFull(self.rdata, buff)
+	self.rpos += int64(n)
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		err = self.endRead(true)
+		if nil == err {
+			err = io.EOF
+		}
+	default:
+		self.endRead(false)
+	}
+	return n, err
+}
+
+
+func (self *ftpFile) startRead(ofst int64) error {
+
+	conn, err := self.backend.get()
+	if nil != err {
+		return err
+	}
+
+	if 0 < ofst {
+		_, _, err = conn.cmd(350, "REST %d", ofst)
+	}
+	if nil == err {
+		self.rdata, err = conn.transfer("RETR %s", self.path)
+	}
+	if nil != err {
+		self.backend.put(conn, err)
+		return err
+	}
+
+	self.rconn = conn
+	self.rpos = ofst
+	return nil
+}
+
+
+// stop the download; complete when the data connection hit EOF
+func (self *ftpFile) endRead(complete bool) error {
+
+	if nil == self.rdata {
+		return nil
+	}
+
+	self.rdata.Close()
+	var err error
+	if complete {
+		err = self.rconn.finish()
+		self.backend.put(self.rconn, err)
+	} else {
+		// servers answer an aborted transfer with 426, 226 or both; no
+		// telling which, so the connection can't be reused
+		self.rconn.Close()
+	}
+
+	self.rconn = nil
+	self.rdata = nil
+	return err
+}
+
+
+func (self *ftpFile) WriteAt(buff []byte, ofst int64) (int, error) {
+
+	defer self.synchronize()()
+
+	if nil != self.werr {
+		return 0, self.werr
+	}
+	self.endRead(false)
+
+	if nil == self.wdata && ofst <= self.wpos {
+		self.werr = self.startWrite(ofst)
+		if nil != self.werr {
+			return 0, self.werr
+		}
+	}
+
+	switch {
+	case ofst < self.wpos:
+		return 0, errors.ErrUnsupported
+	case ofst > self.wpos:
+		self.pending[ofst] = append([]byte(nil), buff...)
+		return len(buff), nil
+	}
+
+	err := self.write(buff)
+	for nil == err {
+		data, found := self.pending[self.wpos]
+		if !found {
+			break
+		}
+		delete(self.pending, self.wpos)
+		err = self.write(data)
+	}
+	if nil != err {
+		self.werr = err
+		return 0, err
+	}
+	return len(buff), nil
+}
+
+
+func (self *ftpFile) write(data []byte) error {
+	n, err := self.wdata.Write(data)
+	self.wpos += int64(n)
+	return err
+}
+
+
+func (self *ftpFile) startWrite(ofst int64) error {
+
+	conn, err := self.backend.get()
+	if nil != err {
+		return err
+	}
+
+	// servers disagree on whether REST+STOR keeps what follows the data
+	// (vsftpd truncates at 0), so only whole files and appends are written
+	switch {
+	case 0 == ofst && 0 == self.size:
+		// nothing to keep; O_TRUNC already stored an empty file
+		self.wdata, err = conn.transfer("STOR %s", self.path)
+	case self.size == ofst:
+		self.wdata, err = conn.transfer("APPE %s", self.path)
+	default:
+		err = fmt.Errorf("ftp write at %d of %s: %w", ofst, self.path, errors.ErrUnsupported)
+	}
+	if nil != err {
+		self.backend.put(conn, err)
+		return err
+	}
+
+	self.wconn = conn
+	self.wpos = ofst
+	return nil
+}
+
+
+// complete the upload so the server has everything written so far
+func (self *ftpFile) endWrite() error {
+
+	if nil == self.wdata {
+		return self.werr
+	}
+
+	if 0 != len(self.pending) && nil == self.werr {
+		// a hole in the data; FTP can't write it
+		self.werr = errors.ErrUnsupported
+	}
+	self.pending = make(map[int64][]byte)
+
+	self.wdata.Close()
+	err := self.wconn.finish()
+	self.backend.put(self.wconn, err)
+	if nil == self.werr {
+		self.werr = err
+	}
+
+	self.wconn = nil
+	self.wdata = nil
+	if self.wpos > self.size {
+		self.size = self.wpos
+	}
+	return self.werr
+}
+
+
+func (self *ftpFile) Sync() error {
+	defer self.synchronize()()
+	return self.endWrite()
+}
+
+
+func (self *ftpFile) Stat() (os.FileInfo, error) {
+	self.lock.Lock()
+	self.endWrite()
+	self.lock.Unlock()
+	return self.backend.Stat(self.path)
+}
+
+
+func (self *ftpFile) Truncate(size int64) error {
+
+	defer self.synchronize()()
+
+	err := self.endWrite()
+	if nil != err {
+		return err
+	}
+	self.endRead(false)
+
+	switch size {
+	case self.size:
+		return nil
+	case 0:
+	default:
+		return fmt.Errorf("ftp truncate to %d: %w", size, errors.ErrUnsupported)
+	}
+
+	err = self.backend.with(func(conn *ftpConn) error {
+		return conn.store(self.path)
+	})
+	if nil == err {
+		self.size = 0
+		self.wpos = 0
+	}
+	return err
+}
+
+
+func (self *ftpFile) Close() error {
+	defer self.synchronize()()
+	err := self.endWrite()
+	self.endRead(false)
+	return err
+}
+
+
+func (self *ftpFile) synchronize() func() {
+	self.lock.Lock()
+	return func() {
+		self.lock.Unlock()
+	}
+}
@@ -0,0 +1,499 @@
+/*
+ * ftpbackend_test.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+
+// Just enough of an FTP server for the backend
+type testFtpServer struct {
+	listener net.Listener
+	lock     sync.Mutex
+	files    map[string][]byte
+	mtime    time.Time
+	mlst     bool // MLST/MLSD, else LIST
+	rest     bool // REST STREAM
+	commands []string
+}
+
+
+func newTestFtpServer(t *testing.T, mlst bool, rest bool) *testFtpServer {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	self := &testFtpServer{}
+	self.listener = listener
+	self.files = make(map[string][]byte)
+	self.mtime = time.Date(2022, 1, 31, 10, 15, 0, 0, time.UTC)
+	self.mlst = mlst
+	self.rest = rest
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if nil != err {
+				return
+			}
+			go self.serve(conn)
+		}
+	}()
+	return self
+}
+
+
+func (self *testFtpServer) backend(t *testing.T) *ftpBackend {
+	fs, err := newFtpBackend(&ftpConfig{
+		addr: self.listener.Addr().String(),
+		user: "user",
+		password: "secret",
+		tls: "none",
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		fs.Close()
+	})
+	return fs
+}
+
+
+func (self *testFtpServer) file(name string) (data []byte, found bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	data, found = self.files[name]
+	return
+}
+
+
+func (self *testFtpServer) saw(verb string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, command := range self.commands {
+		if strings.HasPrefix(command, verb + " ") {
+			return true
+		}
+	}
+	return false
+}
+
+
+func (self *testFtpServer) serve(conn net.Conn) {
+
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format + "\r\n", args...)
+	}
+
+	var passive net.Listener
+	defer func() {
+		if nil != passive {
+			passive.Close()
+		}
+	}()
+	accept := func() net.Conn {
+		if nil == passive {
+			return nil
+		}
+		data, _ := passive.Accept()
+		passive.Close()
+		passive = nil
+		return data
+	}
+
+	rest := int64(-1)
+	rnfr := ""
+	reply("220 test")
+	for {
+		line, err := reader.ReadString('\n')
+		if nil != err {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+
+		self.lock.Lock()
+		self.commands = append(self.commands, verb + " " + arg)
+		self.lock.Unlock()
+
+		// REST applies to the next transfer, past the EPSV before it
+		ofst := rest
+		if "EPSV" != verb {
+			rest = -1
+		}
+
+		switch verb {
+		case "USER":
+			reply("331 password")
+		case "PASS":
+			reply("230 in")
+		case "FEAT":
+			feats := []string{"211-Features:", " UTF8"}
+			if self.mlst {
+				feats = append(feats, " MLST type*;size*;modify*;")
+			}
+			if self.rest {
+				feats = append(feats, " REST STREAM")
+			}
+			reply("%s\r\n211 End", strings.Join(feats, "\r\n"))
+		case "OPTS", "TYPE", "NOOP":
+			reply("200 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		case "EPSV":
+			passive, err = net.Listen("tcp", "127.0.0.1:0")
+			if nil != err {
+				reply("425 %s", err)
+				continue
+			}
+			reply("229 Entering Extended Passive Mode (|||%d|)", passive.Addr().(*net.TCPAddr).Port)
+		case "REST":
+			if !self.rest {
+				reply("502 no REST")
+				continue
+			}
+			rest, _ = strconv.ParseInt(arg, 10, 64)
+			reply("350 restarting")
+		case "MLST":
+			info := self.info(arg)
+			if "" == info {
+				reply("550 not found")
+				continue
+			}
+			reply("250-Listing\r\n %s %s\r\n250 End", info, arg)
+		case "MLSD", "LIST":
+			dir := strings.TrimPrefix(arg, "-a ")
+			data := accept()
+			reply("150 listing")
+			for _, name := range self.list(dir) {
+				if "MLSD" == verb {
+					fmt.Fprintf(data, "%s %s\r\n", self.info(path.Join(dir, name)), name)
+				} else {
+					fmt.Fprintf(data, "%s\r\n", self.unix(path.Join(dir, name), name))
+				}
+			}
+			data.Close()
+			reply("226 done")
+		case "STOR", "APPE":
+			data := accept()
+			reply("150 receiving")
+			buff, _ := io.ReadAll(data)
+			data.Close()
+			self.lock.Lock()
+			old := self.files[arg]
+			switch {
+			case "APPE" == verb:
+				self.files[arg] = append(old, buff...)
+			case 0 < ofst:
+				// like vsftpd: REST keeps what follows the data, except at 0
+				for int64(len(old)) < ofst {
+					old = append(old, 0)
+				}
+				merged := append([]byte{}, old[:ofst]...)
+				merged = append(merged, buff...)
+				if end := ofst + int64(len(buff)); end < int64(len(old)) {
+					merged = append(merged, old[end:]...)
+				}
+				self.files[arg] = merged
+			default:
+				self.files[arg] = buff
+			}
+			self.lock.Unlock()
+			reply("226 stored")
+		case "RETR":
+			content, found := self.file(arg)
+			if !found {
+				reply("550 not found")
+				continue
+			}
+			data := accept()
+			reply("150 sending")
+			if 0 < ofst {
+				content = content[ofst:]
+			}
+			_, err := data.Write(content)
+			data.Close()
+			if nil != err {
+				// what many servers say to an aborted transfer
+				reply("426 connection closed; transfer aborted")
+				reply("226 aborted")
+				continue
+			}
+			reply("226 sent")
+		case "DELE":
+			self.lock.Lock()
+			_, found := self.files[arg]
+			delete(self.files, arg)
+			self.lock.Unlock()
+			if !found {
+				reply("550 not found")
+				continue
+			}
+			reply("250 deleted")
+		case "RNFR":
+			rnfr = arg
+			reply("350 ready")
+		case "RNTO":
+			self.lock.Lock()
+			self.files[arg] = self.files[rnfr]
+			delete(self.files, rnfr)
+			self.lock.Unlock()
+			reply("250 renamed")
+		default:
+			reply("502 %s not implemented", verb)
+		}
+	}
+}
+
+
+func (self *testFtpServer) list(dir string) []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var names []string
+	for name := range self.files {
+		if path.Dir(name) == dir {
+			names = append(names, path.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+
+func (self *testFtpServer) info(name string) string {
+	data, found := self.file(name)
+	if !found {
+		return ""
+	}
+	return fmt.Sprintf("type=file;size=%d;modify=%s;unix.mode=0640;",
+		len(data), self.mtime.Format("20060102150405"))
+}
+
+
+func (self *testFtpServer) unix(name string, base string) string {
+	data, _ := self.file(name)
+	return fmt.Sprintf("-rw-r----- 1 user group %d %s %s", len(data), self.mtime.Format("Jan 2 2006"), base)
+}
+
+
+func writeFtp(t *testing.T, fs *ftpBackend, name string, flags int, data string, ofst int64) error {
+	fp, err := fs.Open(name, flags)
+	if nil != err {
+		t.Fatal(err)
+	}
+	_, err = fp.WriteAt([]byte(data), ofst)
+	if cerr := fp.Close(); nil == err {
+		err = cerr
+	}
+	return err
+}
+
+
+func TestFtpWrite(t *testing.T) {
+
+	server := newTestFtpServer(t, true, true)
+	fs := server.backend(t)
+
+	steps := []struct {
+		flags int
+		data  string
+		ofst  int64
+		want  string
+		verb  string
+	}{
+		{os.O_RDWR | os.O_CREATE | os.O_TRUNC, "hello", 0, "hello", "STOR"},
+		{os.O_RDWR, " world", 5, "hello world", "APPE"},
+		{os.O_WRONLY | os.O_TRUNC, "new", 0, "new", "STOR"},
+	}
+	for _, step := range steps {
+		server.lock.Lock()
+		server.commands = nil
+		server.lock.Unlock()
+
+		err := writeFtp(t, fs, "/file.txt", step.flags, step.data, step.ofst)
+		if nil != err {
+			t.Fatalf("%q at %d: %s", step.data, step.ofst, err)
+		}
+		data, _ := server.file("/file.txt")
+		if step.want != string(data) {
+			t.Errorf("%q at %d: got %q, want %q", step.data, step.ofst, data, step.want)
+		}
+		if !server.saw(step.verb) {
+			t.Errorf("%q at %d: no %s", step.data, step.ofst, step.verb)
+		}
+	}
+}
+
+
+// writes that would have to keep part of the file are refused, REST or not
+func TestFtpOverwrite(t *testing.T) {
+
+	for _, rest := range []bool{true, false} {
+		server := newTestFtpServer(t, true, rest)
+		server.files["/file.txt"] = []byte("keep me")
+		fs := server.backend(t)
+
+		for _, ofst := range []int64{0, 2} {
+			err := writeFtp(t, fs, "/file.txt", os.O_RDWR, "K", ofst)
+			if !errors.Is(err, errors.ErrUnsupported) {
+				t.Errorf("rest=%v: write at %d got %v, want ErrUnsupported", rest, ofst, err)
+			}
+			if data, _ := server.file("/file.txt"); "keep me" != string(data) {
+				t.Errorf("rest=%v: file is now %q", rest, data)
+			}
+		}
+
+		err := writeFtp(t, fs, "/file.txt", os.O_RDWR, "!", 7)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if data, _ := server.file("/file.txt"); "keep me!" != string(data) {
+			t.Errorf("rest=%v: file is now %q", rest, data)
+		}
+	}
+}
+
+
+func TestFtpReadDir(t *testing.T) {
+
+	for _, mlst := range []bool{true, false} {
+		server := newTestFtpServer(t, mlst, true)
+		server.files["/a.txt"] = []byte("abc")
+		server.files["/with space.txt"] = []byte("12345")
+		fs := server.backend(t)
+
+		infos, err := fs.ReadDir("/")
+		if nil != err {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, info := range infos {
+			got = append(got, fmt.Sprintf("%s %d %v", info.Name(), info.Size(), info.Mode()))
+			if !info.ModTime().Equal(server.mtime.Truncate(24 * time.Hour)) && !info.ModTime().Equal(server.mtime) {
+				t.Errorf("mlst=%v: %s modified %v", mlst, info.Name(), info.ModTime())
+			}
+		}
+		want := "a.txt 3 -rw-r-----,with space.txt 5 -rw-r-----"
+		if want != strings.Join(got, ",") {
+			t.Errorf("mlst=%v: got %q, want %q", mlst, strings.Join(got, ","), want)
+		}
+
+		info, err := fs.Stat("/with space.txt")
+		if nil != err || 5 != info.Size() {
+			t.Errorf("mlst=%v: stat got %v, %v", mlst, info, err)
+		}
+		_, err = fs.Stat("/missing")
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("mlst=%v: stat of missing file got %v", mlst, err)
+		}
+	}
+}
+
+
+func TestFtpParse(t *testing.T) {
+
+	tests := []struct {
+		line   string
+		mlsx   bool
+		name   string
+		size   int64
+		mode   os.FileMode
+		target string
+	}{
+		{"type=file;size=123;modify=20220131101500;unix.mode=0600; a b", true, "a b", 123, 0600, ""},
+		{"type=dir;modify=20220131101500; sub", true, "sub", 0, os.ModeDir | 0755, ""},
+		{"-rw-r--r-- 1 user group 42 Jan 31 2022 a  b.txt", false, "a  b.txt", 42, 0644, ""},
+		{"drwxr-x--- 2 user group 4096 Jan 31 10:15 dir", false, "dir", 4096, os.ModeDir | 0750, ""},
+		{"lrwxrwxrwx 1 user group 7 Jan 31 2022 link -> target", false, "link", 7, os.ModeSymlink | 0777, "target"},
+		{"01-31-22  10:15AM  <DIR>  My Dir", false, "My Dir", 0, os.ModeDir | 0755, ""},
+		{"01-31-22  10:15AM  1024  file.bin", false, "file.bin", 1024, 0644, ""},
+	}
+	for _, test := range tests {
+		var info *fileInfo
+		if test.mlsx {
+			info = parseMlsx(test.line)
+		} else {
+			info = parseList(test.line)
+		}
+		if nil == info {
+			t.Errorf("%q: not parsed", test.line)
+			continue
+		}
+		if test.name != info.name || test.size != info.size || test.mode != info.mode || test.target != info.target {
+			t.Errorf("%q: got %q %d %v %q", test.line, info.name, info.size, info.mode, info.target)
+		}
+	}
+
+	if nil != parseList("total 12") {
+		t.Error("parsed a total line")
+	}
+}
+
+
+// reads that stop early must not leave stray replies on pooled connections
+func TestFtpAbortedRead(t *testing.T) {
+
+	server := newTestFtpServer(t, true, true)
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1 << 18)
+	server.files["/big.bin"] = content
+	server.files["/small.txt"] = []byte("small")
+	fs := server.backend(t)
+
+	fp, err := fs.Open("/big.bin", os.O_RDONLY)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	buff := make([]byte, 4096)
+	for _, ofst := range []int64{0, 1 << 20, 17, 3 << 20, 0} {
+		n, err := fp.ReadAt(buff, ofst)
+		if nil != err || len(buff) != n {
+			t.Fatalf("read at %d: %d, %v", ofst, n, err)
+		}
+		if !bytes.Equal(content[ofst:ofst+int64(n)], buff) {
+			t.Fatalf("read at %d: wrong data", ofst)
+		}
+
+		// every pooled connection must still be in step
+		for i := 0; ftpPoolSize > i; i++ {
+			info, err := fs.Stat("/small.txt")
+			if nil != err || 5 != info.Size() {
+				t.Fatalf("stat after read at %d: %v, %v", ofst, info, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,518 @@
+/*
+ * ftpclient.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+
+const ftpTimeout = 30 * time.Second
+
+
+// FTP connection settings
+type ftpConfig struct {
+	addr     string
+	user     string
+	password string
+	tls      string // none, explicit or implicit
+	active   bool
+	tlsConfig *tls.Config
+}
+
+
+// FTP control connection
+//
+// One transfer at a time; data connections are opened per command in
+// passive (EPSV, then PASV) or active (EPRT, then PORT) mode and are
+// protected with TLS whenever the control connection is.
+type ftpConn struct {
+	cfg     *ftpConfig
+	conn    net.Conn
+	text    *textproto.Conn
+	feats   map[string]string
+	tlsData bool
+	used    time.Time
+}
+
+
+// FTP reply that is not what the command expected
+type ftpError struct {
+	code int
+	msg  string
+}
+
+
+func (self *ftpError) Error() string {
+	return fmt.Sprintf("ftp: %d %s", self.code, self.msg)
+}
+
+
+func (self *ftpError) Unwrap() error {
+	switch self.code {
+	case 550:
+		return os.ErrNotExist
+	case 530, 532, 553:
+		return os.ErrPermission
+	case 500, 502, 504:
+		return errors.ErrUnsupported
+	}
+	return nil
+}
+
+
+func dialFtp(cfg *ftpConfig) (*ftpConn, error) {
+
+	dialer := &net.Dialer{Timeout: ftpTimeout}
+
+	var conn net.Conn
+	var err error
+	if "implicit" == cfg.tls {
+		conn, err = tls.DialWithDialer(dialer, "tcp", cfg.addr, cfg.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", cfg.addr)
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	self := &ftpConn{}
+	self.cfg = cfg
+	self.conn = conn
+	self.text = textproto.NewConn(conn)
+	self.used = time.Now()
+
+	err = self.login()
+	if nil != err {
+		self.Close()
+		return nil, err
+	}
+	return self, nil
+}
+
+
+func (self *ftpConn) login() error {
+
+	_, _, err := self.text.ReadResponse(220)
+	if nil != err {
+		return ftpReplyError(err)
+	}
+
+	if "explicit" == self.cfg.tls {
+		_, _, err = self.cmd(234, "AUTH TLS")
+		if nil != err {
+			return err
+		}
+		self.conn = tls.Client(self.conn, self.cfg.tlsConfig)
+		self.text = textproto.NewConn(self.conn)
+	}
+
+	code, _, err := self.cmd(0, "USER %s", self.cfg.user)
+	if nil != err {
+		return err
+	}
+	if 331 == code {
+		_, _, err = self.cmd(230, "PASS %s", self.cfg.password)
+	} else if 230 != code {
+		err = &ftpError{code, "login failed"}
+	}
+	if nil != err {
+		return err
+	}
+
+	if "none" != self.cfg.tls {
+		_, _, err = self.cmd(200, "PBSZ 0")
+		if nil == err {
+			_, _, err = self.cmd(200, "PROT P")
+		}
+		if nil != err {
+			return err
+		}
+		self.tlsData = true
+	}
+
+	self.feats = make(map[string]string)
+	_, msg, err := self.cmd(211, "FEAT")
+	if nil == err {
+		for _, line := range strings.Split(msg, "\n")[1:] {
+			name, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+			if "" != name && "End" != name {
+				self.feats[strings.ToUpper(name)] = args
+			}
+		}
+	}
+
+	if self.Has("UTF8") {
+		self.cmd(0, "OPTS UTF8 ON")
+	}
+	_, _, err = self.cmd(200, "TYPE I")
+	return err
+}
+
+
+func (self *ftpConn) Has(feat string) bool {
+	_, found := self.feats[feat]
+	return found
+}
+
+
+// send a command and check the reply class; expect 0 accepts any reply
+func (self *ftpConn) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+
+	self.used = time.Now()
+	self.conn.SetDeadline(time.Now().Add(ftpTimeout))
+	defer self.conn.SetDeadline(time.Time{})
+
+	if strings.ContainsAny(fmt.Sprint(args...), "\r\n") {
+		return 0, "", os.ErrInvalid
+	}
+
+	id, err := self.text.Cmd(format, args...)
+	if nil != err {
+		return 0, "", err
+	}
+	self.text.StartResponse(id)
+	defer self.text.EndResponse(id)
+
+	code, msg, err := self.text.ReadResponse(expect)
+	return code, msg, ftpReplyError(err)
+}
+
+
+func ftpReplyError(err error) error {
+	var proto *textproto.Error
+	if errors.As(err, &proto) {
+		return &ftpError{proto.Code, proto.Msg}
+	}
+	return err
+}
+
+
+// open a data connection and start a transfer command on it
+func (self *ftpConn) transfer(format string, args ...interface{}) (net.Conn, error) {
+
+	var conn net.Conn
+	var err error
+	if self.cfg.active {
+		conn, err = self.active(format, args...)
+	} else {
+		conn, err = self.passive(format, args...)
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	if self.tlsData {
+		tconn := tls.Client(conn, self.cfg.tlsConfig)
+		err = tconn.Handshake()
+		if nil != err {
+			conn.Close()
+			self.finish()
+			return nil, err
+		}
+		conn = tconn
+	}
+	return conn, nil
+}
+
+
+func (self *ftpConn) passive(format string, args ...interface{}) (net.Conn, error) {
+
+	// always connect to the control host; PASV addresses are often private
+	host, _, _ := net.SplitHostPort(self.conn.RemoteAddr().String())
+
+	port := 0
+	_, msg, err := self.cmd(229, "EPSV")
+	if nil == err {
+		// Entering Extended Passive Mode (|||port|)
+		start := strings.Index(msg, "(")
+		end := strings.LastIndex(msg, ")")
+		if 0 > start || start > end {
+			return nil, &ftpError{229, msg}
+		}
+		fields := strings.Split(msg[start+1:end], string(msg[start+1]))
+		if 5 != len(fields) {
+			return nil, &ftpError{229, msg}
+		}
+		port, err = strconv.Atoi(fields[3])
+	} else {
+		// Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+		_, msg, err = self.cmd(227, "PASV")
+		if nil != err {
+			return nil, err
+		}
+		start := strings.Index(msg, "(")
+		end := strings.LastIndex(msg, ")")
+		if 0 > start || start > end {
+			return nil, &ftpError{227, msg}
+		}
+		fields := strings.Split(msg[start+1:end], ",")
+		if 6 != len(fields) {
+			return nil, &ftpError{227, msg}
+		}
+		p1, _ := strconv.Atoi(fields[4])
+		p2, _ := strconv.Atoi(fields[5])
+		port = p1<<8 | p2
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), ftpTimeout)
+	if nil != err {
+		return nil, err
+	}
+
+	_, _, err = self.cmd(1, format, args...)
+	if nil != err {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+
+func (self *ftpConn) active(format string, args ...interface{}) (net.Conn, error) {
+
+	// listen on the address the server already reaches us at
+	host, _, _ := net.SplitHostPort(self.conn.LocalAddr().String())
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if nil != err {
+		return nil, err
+	}
+	defer listener.Close()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	if ip4 := addr.IP.To4(); nil != ip4 {
+		_, _, err = self.cmd(200, "PORT %d,%d,%d,%d,%d,%d", ip4[0], ip4[1], ip4[2], ip4[3], addr.Port>>8, addr.Port&0xff)
+	} else {
+		_, _, err = self.cmd(200, "EPRT |2|%s|%d|", addr.IP, addr.Port)
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	_, _, err = self.cmd(1, format, args...)
+	if nil != err {
+		return nil, err
+	}
+
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(ftpTimeout))
+	conn, err := listener.Accept()
+	if nil != err {
+		self.finish()
+		return nil, err
+	}
+	return conn, nil
+}
+
+
+// read the reply that ends a transfer
+func (self *ftpConn) finish() error {
+	self.conn.SetDeadline(time.Now().Add(ftpTimeout))
+	defer self.conn.SetDeadline(time.Time{})
+	_, _, err := self.text.ReadResponse(2)
+	return ftpReplyError(err)
+}
+
+
+func (self *ftpConn) Close() error {
+	self.conn.SetDeadline(time.Now().Add(time.Second))
+	self.text.Cmd("QUIT")
+	return self.text.Close()
+}
+
+
+// list a directory with MLSD, or LIST where MLSD is missing
+func (self *ftpConn) List(dir string) ([]os.FileInfo, error) {
+
+	mlsd := self.Has("MLST")
+
+	var conn net.Conn
+	var err error
+	if mlsd {
+		conn, err = self.transfer("MLSD %s", dir)
+	} else {
+		conn, err = self.transfer("LIST -a %s", dir)
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	var infos []os.FileInfo
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	for {
+		line, err := reader.ReadLine()
+		if nil != err {
+			break
+		}
+
+		var info *fileInfo
+		if mlsd {
+			info = parseMlsx(line)
+		} else {
+			info = parseList(line)
+		}
+		if nil != info && "." != info.name && ".." != info.name {
+			infos = append(infos, info)
+		}
+	}
+	conn.Close()
+
+	err = self.finish()
+	return infos, err
+}
+
+
+// attributes of a single path; MLST where supported, else a parent listing
+func (self *ftpConn) Stat(name string) (os.FileInfo, error) {
+
+	if "/" == name {
+		return &fileInfo{"/", 0, fs.ModeDir | 0755, time.Time{}, ""}, nil
+	}
+
+	if self.Has("MLST") {
+		_, msg, err := self.cmd(250, "MLST %s", name)
+		if nil != err {
+			return nil, err
+		}
+		lines := strings.Split(msg, "\n")
+		if 2 > len(lines) {
+			return nil, &ftpError{250, msg}
+		}
+		info := parseMlsx(strings.TrimSpace(lines[1]))
+		if nil == info {
+			return nil, &ftpError{250, msg}
+		}
+		info.name = path.Base(name)
+		return info, nil
+	}
+
+	infos, err := self.List(path.Dir(name))
+	if nil != err {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.Name() == path.Base(name) {
+			return info, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+
+// type=file;size=123;modify=20220101120000;unix.mode=0644; name
+func parseMlsx(line string) *fileInfo {
+
+	facts, name, found := strings.Cut(line, " ")
+	if !found {
+		return nil
+	}
+
+	info := &fileInfo{name: name, mode: 0644}
+	for _, fact := range strings.Split(facts, ";") {
+		key, value, _ := strings.Cut(fact, "=")
+		switch strings.ToLower(key) {
+		case "type":
+			switch strings.ToLower(value) {
+			case "dir", "cdir", "pdir":
+				info.mode = info.mode.Perm() | fs.ModeDir | 0111
+			case "os.unix=symlink", "os.unix=slink":
+				info.mode = info.mode.Perm() | fs.ModeSymlink
+			}
+		case "size", "sizd":
+			info.size, _ = strconv.ParseInt(value, 10, 64)
+		case "modify":
+			if len(value) >= 14 {
+				info.mtime, _ = time.Parse("20060102150405", value[:14])
+			}
+		case "unix.mode":
+			if mode, err := strconv.ParseUint(value, 8, 32); nil == err {
+				info.mode = info.mode.Type() | fs.FileMode(mode).Perm()
+			}
+		}
+	}
+	return info
+}
+
+
+// unix ls -l or DOS style LIST lines
+func parseList(line string) *fileInfo {
+
+	fields := strings.Fields(line)
+
+	// 01-31-22  10:15AM  <DIR>  name
+	if 4 <= len(fields) && strings.Count(fields[0], "-") == 2 {
+		mtime, _ := time.Parse("01-02-06 03:04PM", fields[0]+" "+fields[1])
+		name := strings.Join(fields[3:], " ")
+		if "<DIR>" == fields[2] {
+			return &fileInfo{name, 0, fs.ModeDir | 0755, mtime, ""}
+		}
+		size, _ := strconv.ParseInt(fields[2], 10, 64)
+		return &fileInfo{name, size, 0644, mtime, ""}
+	}
+
+	// drwxr-xr-x 2 user group 4096 Jan 31 10:15 name
+	if 9 > len(fields) || 10 > len(fields[0]) {
+		return nil
+	}
+
+	info := &fileInfo{}
+	for i, c := range fields[0][1:10] {
+		if '-' != c {
+			info.mode |= 1 << uint(8-i)
+		}
+	}
+	switch fields[0][0] {
+	case 'd':
+		info.mode |= fs.ModeDir
+	case 'l':
+		info.mode |= fs.ModeSymlink
+	}
+	info.size, _ = strconv.ParseInt(fields[4], 10, 64)
+
+	stamp := strings.Join(fields[5:8], " ")
+	if strings.Contains(fields[7], ":") {
+		info.mtime, _ = time.Parse("Jan 2 15:04", stamp)
+		now := time.Now()
+		info.mtime = info.mtime.AddDate(now.Year(), 0, 0)
+		if info.mtime.After(now.Add(24 * time.Hour)) {
+			info.mtime = info.mtime.AddDate(-1, 0, 0)
+		}
+	} else {
+		info.mtime, _ = time.Parse("Jan 2 2006", stamp)
+	}
+
+	// the name may contain spaces; find it after the time field
+	rest := line
+	for _, field := range fields[:8] {
+		rest = strings.TrimLeft(rest, " ")
+		rest = rest[len(field):]
+	}
+	info.name = strings.TrimLeft(rest, " ")
+	if 0 != info.mode&fs.ModeSymlink {
+		info.name, info.target, _ = strings.Cut(info.name, " -> ")
+	}
+	return info
+}
@@ -0,0 +1,143 @@
+/*
+ * fuseutil.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// changes to read-only storage
+var errReadOnly = errors.New("read-only file system")
+
+// renames between independent storages
+var errCrossDevice = errors.New("cross-device link")
+
+// renames over a directory that still has entries
+var errNotEmpty = errors.New("directory not empty")
+
+// copies onto themselves, which would truncate the source
+var errSameFile = errors.New("source and destination are the same file")
+
+
+// map a remote error to a negative fuse error code
+func fuseErrc(err error) int {
+
+	if nil == err {
+		return 0
+	}
+
+	if errors.Is(err, errReadOnly) {
+		return -fuse.EROFS
+	}
+	if errors.Is(err, errCrossDevice) {
+		return -fuse.EXDEV
+	}
+	if errors.Is(err, errNotEmpty) {
+		return -fuse.ENOTEMPTY
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return -fuse.ENOENT
+	}
+	if errors.Is(err, os.ErrExist) {
+		return -fuse.EEXIST
+	}
+	if errors.Is(err, os.ErrPermission) {
+		return -fuse.EACCES
+	}
+	if errors.Is(err, errors.ErrUnsupported) {
+		return -fuse.ENOSYS
+	}
+
+	var status *sftp.StatusError
+	if errors.As(err, &status) {
+		switch status.FxCode() {
+		case sftp.ErrSSHFxNoSuchFile:
+			return -fuse.ENOENT
+		case sftp.ErrSSHFxPermissionDenied:
+			return -fuse.EACCES
+		case sftp.ErrSSHFxOpUnsupported:
+			return -fuse.ENOSYS
+		}
+	}
+
+	return -fuse.EIO
+}
+
+
+// convert fuse.O_* open flags to os.O_* flags
+func osFlags(flags int) int {
+
+	f := 0
+	switch flags & fuse.O_ACCMODE {
+	case fuse.O_WRONLY:
+		f = os.O_WRONLY
+	case fuse.O_RDWR:
+		f = os.O_RDWR
+	default:
+		f = os.O_RDONLY
+	}
+
+	if 0 != flags&fuse.O_APPEND {
+		f |= os.O_APPEND
+	}
+	if 0 != flags&fuse.O_CREAT {
+		f |= os.O_CREATE
+	}
+	if 0 != flags&fuse.O_EXCL {
+		f |= os.O_EXCL
+	}
+	if 0 != flags&fuse.O_TRUNC {
+		f |= os.O_TRUNC
+	}
+	return f
+}
+
+
+// open flags that need a writable remote file
+func writeFlags(flags int) bool {
+	return fuse.O_RDONLY != flags&fuse.O_ACCMODE
+}
+
+
+// Repeatable -o, handed to FUSE along with whatever follows the flags
+//
+// FUSE options used to go straight from the command line to the mount;
+// "-o allow_other" in front of our own flags still does.
+type mountOptions []string
+
+
+func (self *mountOptions) String() string {
+	return strings.Join(*self, ",")
+}
+
+
+func (self *mountOptions) Set(value string) error {
+	*self = append(*self, value)
+	return nil
+}
+
+
+// mount arguments: ours, then the -o options, then the rest
+func (self *mountOptions) Args(base []string, rest []string) []string {
+	args := append([]string{}, base...)
+	for _, opt := range *self {
+		args = append(args, "-o", opt)
+	}
+	return append(args, rest...)
+}
@@ -0,0 +1,622 @@
+/*
+ * gzindex.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+
+const (
+	// decompressed bytes between gzip checkpoints
+	gzipSpan = 4 * 1024 * 1024
+
+	// deflate back-reference window
+	inflateWindow = 32 * 1024
+)
+
+
+var errInflate = errors.New("gzip: invalid deflate data")
+
+
+// Seek points of a gzip stream, as in zlib's zran example
+//
+// Deflate can't be entered at an arbitrary place: a block may refer back to
+// the 32K of output before it. A checkpoint is a block boundary together
+// with that window, so decompression can restart there. Only blocks that
+// start on a byte qualify, and only single-member files get checkpoints;
+// decompression doesn't carry over from one member to the next.
+type gzipIndex struct {
+	Size   int64 // decompressed
+	Points []*gzipCheckpoint
+}
+
+
+type gzipCheckpoint struct {
+	In     int64  // offset of the block in the compressed file
+	Out    int64  // offset of its output in the decompressed stream
+	Window []byte // up to 32K of output before Out, deflated
+}
+
+
+// decompress src to w, noting a checkpoint about every span bytes
+func indexGzip(src io.ReaderAt, size int64, w io.Writer, span int64) (*gzipIndex, error) {
+
+	self := &inflater{}
+	self.r = bufio.NewReaderSize(io.NewSectionReader(src, 0, size), 64 * 1024)
+	self.w = w
+	self.hist = make([]byte, 0, inflateWindow + 64 * 1024)
+	self.span = span
+	self.index = &gzipIndex{}
+
+	for member := 0; ; member++ {
+		if 0 < member {
+			// another member or the end
+			self.fill(8)
+			if 0 == self.nbits {
+				break
+			}
+			self.multi = true
+			self.index.Points = nil
+		}
+		err := self.member()
+		if nil != err {
+			return nil, err
+		}
+	}
+
+	self.index.Size = self.out
+	return self.index, nil
+}
+
+
+// decompressed stream from this checkpoint on
+func (self *gzipCheckpoint) open(src io.ReaderAt, size int64) (io.ReadCloser, error) {
+
+	dict, err := io.ReadAll(flate.NewReader(bytes.NewReader(self.Window)))
+	if nil != err {
+		return nil, err
+	}
+	r := bufio.NewReader(io.NewSectionReader(src, self.In, size - self.In))
+	return flate.NewReaderDict(r, dict), nil
+}
+
+
+// Deflate decoder that notes where its blocks start
+//
+// compress/flate keeps block boundaries to itself, so the index is built
+// with this one; reads from a checkpoint use compress/flate again.
+type inflater struct {
+	r     *bufio.Reader
+	in    int64 // bytes taken from r
+	bits  uint32
+	nbits uint
+	w     io.Writer
+	hist  []byte // unwritten output after up to 32K of history
+	done  int    // how much of hist is written
+	out   int64  // total output
+	start int64  // output before this member
+	crc   uint32
+	span  int64
+	index *gzipIndex
+	multi bool
+
+	fixedLit  *huffman
+	fixedDist *huffman
+}
+
+
+func (self *inflater) fill(n uint) error {
+	for self.nbits < n {
+		c, err := self.r.ReadByte()
+		if nil != err {
+			if io.EOF == err {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		self.in++
+		self.bits |= uint32(c) << self.nbits
+		self.nbits += 8
+	}
+	return nil
+}
+
+
+func (self *inflater) getbits(n uint) (int, error) {
+	err := self.fill(n)
+	if nil != err {
+		return 0, err
+	}
+	v := self.bits & (1 << n - 1)
+	self.bits >>= n
+	self.nbits -= n
+	return int(v), nil
+}
+
+
+// drop bits up to the next byte boundary
+func (self *inflater) align() {
+	self.bits >>= self.nbits % 8
+	self.nbits -= self.nbits % 8
+}
+
+
+// one gzip member: header, deflate blocks, trailer
+func (self *inflater) member() error {
+
+	var header [10]int
+	for i := range header {
+		c, err := self.getbits(8)
+		if nil != err {
+			return err
+		}
+		header[i] = c
+	}
+	if 0x1f != header[0] || 0x8b != header[1] || 8 != header[2] {
+		return gzip.ErrHeader
+	}
+
+	flags := header[3]
+	if 0 != flags&4 {
+		// FEXTRA
+		n, err := self.getbits(16)
+		if nil == err {
+			err = self.skip(n)
+		}
+		if nil != err {
+			return err
+		}
+	}
+	for _, flag := range []int{8, 16} {
+		// FNAME, FCOMMENT
+		for 0 != flags&flag {
+			c, err := self.getbits(8)
+			if nil != err {
+				return err
+			}
+			if 0 == c {
+				break
+			}
+		}
+	}
+	if 0 != flags&2 {
+		// FHCRC
+		if err := self.skip(2); nil != err {
+			return err
+		}
+	}
+
+	self.start = self.out
+	self.crc = 0
+	for final := 0; 0 == final; {
+		self.checkpoint()
+
+		var err error
+		final, err = self.getbits(1)
+		if nil != err {
+			return err
+		}
+		kind, err := self.getbits(2)
+		if nil != err {
+			return err
+		}
+		switch kind {
+		case 0:
+			err = self.stored()
+		case 1:
+			err = self.fixed()
+		case 2:
+			err = self.dynamic()
+		default:
+			err = errInflate
+		}
+		if nil != err {
+			return err
+		}
+	}
+	if err := self.flush(); nil != err {
+		return err
+	}
+
+	self.align()
+	crc, err := self.getbits(16)
+	if nil == err {
+		var high int
+		high, err = self.getbits(16)
+		crc |= high << 16
+	}
+	if nil == err {
+		err = self.skip(4)
+	}
+	if nil != err {
+		return err
+	}
+	if uint32(crc) != self.crc {
+		return gzip.ErrChecksum
+	}
+	return nil
+}
+
+
+func (self *inflater) skip(n int) error {
+	for ; 0 < n; n-- {
+		if _, err := self.getbits(8); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+
+// note a checkpoint at the block about to start, if one is due and can be
+func (self *inflater) checkpoint() {
+
+	if self.multi {
+		return
+	}
+	points := self.index.Points
+	if 0 < len(points) && self.out - points[len(points)-1].Out < self.span {
+		return
+	}
+
+	// compress/flate only starts on a byte
+	if 0 != self.nbits % 8 {
+		return
+	}
+
+	window := self.hist
+	if inflateWindow < len(window) {
+		window = window[len(window)-inflateWindow:]
+	}
+	var buff bytes.Buffer
+	fw, _ := flate.NewWriter(&buff, flate.BestSpeed)
+	fw.Write(window)
+	fw.Close()
+
+	self.index.Points = append(points, &gzipCheckpoint{
+		In:     self.in - int64(self.nbits / 8),
+		Out:    self.out,
+		Window: buff.Bytes(),
+	})
+}
+
+
+func (self *inflater) put(c byte) error {
+	if len(self.hist) == cap(self.hist) {
+		if err := self.flush(); nil != err {
+			return err
+		}
+		n := copy(self.hist, self.hist[len(self.hist)-inflateWindow:])
+		self.hist = self.hist[:n]
+		self.done = n
+	}
+	self.hist = append(self.hist, c)
+	self.out++
+	return nil
+}
+
+
+func (self *inflater) flush() error {
+	data := self.hist[self.done:]
+	self.done = len(self.hist)
+	self.crc = crc32.Update(self.crc, crc32.IEEETable, data)
+	_, err := self.w.Write(data)
+	return err
+}
+
+
+func (self *inflater) stored() error {
+
+	self.align()
+	n, err := self.getbits(16)
+	if nil != err {
+		return err
+	}
+	check, err := self.getbits(16)
+	if nil != err {
+		return err
+	}
+	if n != ^check & 0xffff {
+		return errInflate
+	}
+	for ; 0 < n; n-- {
+		c, err := self.getbits(8)
+		if nil == err {
+			err = self.put(byte(c))
+		}
+		if nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+
+func (self *inflater) fixed() error {
+
+	if nil == self.fixedLit {
+		lengths := make([]uint8, 288 + 30)
+		for i := range lengths {
+			switch {
+			case 144 > i:
+				lengths[i] = 8
+			case 256 > i:
+				lengths[i] = 9
+			case 280 > i:
+				lengths[i] = 7
+			case 288 > i:
+				lengths[i] = 8
+			default:
+				lengths[i] = 5
+			}
+		}
+		self.fixedLit, _ = newHuffman(lengths[:288])
+		self.fixedDist, _ = newHuffman(lengths[288:])
+	}
+	return self.codes(self.fixedLit, self.fixedDist)
+}
+
+
+// order of the code length code lengths
+var inflateOrder = [19]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+
+func (self *inflater) dynamic() error {
+
+	nlen, err := self.getbits(5)
+	if nil != err {
+		return err
+	}
+	ndist, err := self.getbits(5)
+	if nil != err {
+		return err
+	}
+	ncode, err := self.getbits(4)
+	if nil != err {
+		return err
+	}
+	nlen += 257
+	ndist += 1
+	ncode += 4
+	if 286 < nlen || 30 < ndist {
+		return errInflate
+	}
+
+	lengths := make([]uint8, 19)
+	for i := 0; ncode > i; i++ {
+		n, err := self.getbits(3)
+		if nil != err {
+			return err
+		}
+		lengths[inflateOrder[i]] = uint8(n)
+	}
+	lencode, err := newHuffman(lengths)
+	if nil != err {
+		return err
+	}
+
+	lengths = make([]uint8, nlen + ndist)
+	for i := 0; len(lengths) > i; {
+		sym, err := self.decode(lencode)
+		if nil != err {
+			return err
+		}
+		if 16 > sym {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+
+		var length uint8
+		var repeat int
+		switch sym {
+		case 16:
+			if 0 == i {
+				return errInflate
+			}
+			length = lengths[i-1]
+			repeat, err = self.getbits(2)
+			repeat += 3
+		case 17:
+			repeat, err = self.getbits(3)
+			repeat += 3
+		default:
+			repeat, err = self.getbits(7)
+			repeat += 11
+		}
+		if nil != err {
+			return err
+		}
+		if len(lengths) < i + repeat {
+			return errInflate
+		}
+		for ; 0 < repeat; repeat-- {
+			lengths[i] = length
+			i++
+		}
+	}
+	if 0 == lengths[256] {
+		return errInflate
+	}
+
+	litcode, err := newHuffman(lengths[:nlen])
+	if nil != err {
+		return err
+	}
+	distcode, err := newHuffman(lengths[nlen:])
+	if nil != err {
+		return err
+	}
+	return self.codes(litcode, distcode)
+}
+
+
+var (
+	inflateLenBase  = [29]int{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	inflateLenExtra = [29]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	inflateDistBase = [30]int{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	inflateDistExtra = [30]uint{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+)
+
+
+// literals and back-references up to the end of the block
+func (self *inflater) codes(litcode *huffman, distcode *huffman) error {
+
+	for {
+		sym, err := self.decode(litcode)
+		if nil != err {
+			return err
+		}
+		if 256 > sym {
+			if err := self.put(byte(sym)); nil != err {
+				return err
+			}
+			continue
+		}
+		if 256 == sym {
+			return nil
+		}
+
+		sym -= 257
+		if 29 <= sym {
+			return errInflate
+		}
+		extra, err := self.getbits(inflateLenExtra[sym])
+		if nil != err {
+			return err
+		}
+		length := inflateLenBase[sym] + extra
+
+		sym, err = self.decode(distcode)
+		if nil != err {
+			return err
+		}
+		if 30 <= sym {
+			return errInflate
+		}
+		extra, err = self.getbits(inflateDistExtra[sym])
+		if nil != err {
+			return err
+		}
+		dist := inflateDistBase[sym] + extra
+		if int64(dist) > self.out - self.start {
+			return errInflate
+		}
+
+		for ; 0 < length; length-- {
+			if err := self.put(self.hist[len(self.hist)-dist]); nil != err {
+				return err
+			}
+		}
+	}
+}
+
+
+// Canonical Huffman code, as in zlib's puff
+//
+// Codes up to huffmanFast bits long are looked up in a table; longer ones
+// are decoded one bit at a time.
+type huffman struct {
+	count  [16]int
+	symbol []int
+	fast   [1 << huffmanFast]uint16 // symbol << 4 | length; 0 if longer
+}
+
+
+const huffmanFast = 9
+
+
+func newHuffman(lengths []uint8) (*huffman, error) {
+
+	self := &huffman{}
+	for _, length := range lengths {
+		self.count[length]++
+	}
+
+	// refuse over-subscribed codes; incomplete ones are fine
+	left := 1
+	for length := 1; 16 > length; length++ {
+		left <<= 1
+		left -= self.count[length]
+		if 0 > left {
+			return nil, errInflate
+		}
+	}
+
+	var offs [16]int
+	for length := 1; 15 > length; length++ {
+		offs[length+1] = offs[length] + self.count[length]
+	}
+	self.symbol = make([]int, len(lengths))
+	for sym, length := range lengths {
+		if 0 != length {
+			self.symbol[offs[length]] = sym
+			offs[length]++
+		}
+	}
+
+	code, index := 0, 0
+	for length := 1; huffmanFast >= length; length++ {
+		for i := 0; self.count[length] > i; i++ {
+			rev := 0
+			for bit := 0; length > bit; bit++ {
+				rev |= (code >> bit & 1) << (length - 1 - bit)
+			}
+			for j := rev; len(self.fast) > j; j += 1 << length {
+				self.fast[j] = uint16(self.symbol[index] << 4 | length)
+			}
+			code++
+			index++
+		}
+		code <<= 1
+	}
+	return self, nil
+}
+
+
+func (self *inflater) decode(h *huffman) (int, error) {
+
+	// near the end there may be fewer bits than a table lookup takes
+	self.fill(huffmanFast)
+	if entry := h.fast[self.bits & (1 << huffmanFast - 1)]; 0 != entry && uint(entry & 15) <= self.nbits {
+		self.bits >>= entry & 15
+		self.nbits -= uint(entry & 15)
+		return int(entry >> 4), nil
+	}
+
+	code, first, index := 0, 0, 0
+	for length := 1; 16 > length; length++ {
+		bit, err := self.getbits(1)
+		if nil != err {
+			return 0, err
+		}
+		code |= bit
+		count := h.count[length]
+		if code - count < first {
+			return h.symbol[index + code - first], nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+	return 0, errInflate
+}
+
@@ -0,0 +1,194 @@
+/*
+ * gzindex_test.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+
+// compressible text with incompressible runs in between
+func testGzipContent(size int) []byte {
+	random := rand.New(rand.NewSource(1))
+	var buff bytes.Buffer
+	for buff.Len() < size {
+		if 0 == random.Intn(4) {
+			noise := make([]byte, random.Intn(64 * 1024))
+			random.Read(noise)
+			buff.Write(noise)
+		} else {
+			fmt.Fprintf(&buff, "line %d of the test content\n", random.Intn(1000))
+		}
+	}
+	return buff.Bytes()[:size]
+}
+
+
+func testGzip(t *testing.T, data []byte, level int) []byte {
+	var buff bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buff, level)
+	if nil != err {
+		t.Fatal(err)
+	}
+	zw.Name = "content.txt"
+	zw.Comment = "test"
+	zw.Extra = []byte("extra")
+	zw.Write(data)
+	zw.Close()
+	return buff.Bytes()
+}
+
+
+func TestGzipIndex(t *testing.T) {
+
+	data := testGzipContent(3 * 1024 * 1024)
+	levels := []int{gzip.NoCompression, gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression, gzip.HuffmanOnly}
+	for _, level := range levels {
+		compressed := testGzip(t, data, level)
+		src := bytes.NewReader(compressed)
+
+		var out bytes.Buffer
+		index, err := indexGzip(src, int64(len(compressed)), &out, 256 * 1024)
+		if nil != err {
+			t.Fatalf("level %d: %s", level, err)
+		}
+		if !bytes.Equal(data, out.Bytes()) || int64(len(data)) != index.Size {
+			t.Fatalf("level %d: decompressed %d bytes, index says %d", level, out.Len(), index.Size)
+		}
+		if 4 > len(index.Points) {
+			t.Errorf("level %d: %d checkpoints", level, len(index.Points))
+		}
+
+		gz, err := newGzipSpool(src, int64(len(compressed)))
+		if nil != err {
+			t.Fatal(err)
+		}
+		gz.index = index
+
+		random := rand.New(rand.NewSource(2))
+		buff := make([]byte, 10000)
+		for i := 0; 50 > i; i++ {
+			ofst := random.Int63n(int64(len(data)))
+			n, err := gz.ReadAt(buff, ofst)
+			end := ofst + int64(n)
+			if !bytes.Equal(data[ofst:end], buff[:n]) {
+				t.Fatalf("level %d: wrong data at %d", level, ofst)
+			}
+			if int64(len(data)) == end && io.EOF != err || int64(len(data)) != end && (nil != err || len(buff) != n) {
+				t.Fatalf("level %d: read at %d got %d, %v", level, ofst, n, err)
+			}
+		}
+
+		// sequential reads carry on without going back to a checkpoint
+		for ofst := int64(0); int64(len(data)) > ofst; ofst += int64(len(buff)) {
+			n, _ := gz.ReadAt(buff, ofst)
+			if !bytes.Equal(data[ofst:ofst+int64(n)], buff[:n]) {
+				t.Fatalf("level %d: wrong data at %d", level, ofst)
+			}
+		}
+		gz.Close()
+	}
+}
+
+
+func TestGzipIndexMembers(t *testing.T) {
+
+	one := testGzipContent(100 * 1024)
+	two := []byte("second member")
+	compressed := append(testGzip(t, one, gzip.DefaultCompression), testGzip(t, two, gzip.BestSpeed)...)
+
+	var out bytes.Buffer
+	index, err := indexGzip(bytes.NewReader(compressed), int64(len(compressed)), &out, 16 * 1024)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(one, two...), out.Bytes()) || 0 != len(index.Points) {
+		t.Errorf("decompressed %d bytes with %d checkpoints", out.Len(), len(index.Points))
+	}
+
+	// damaged trailer
+	compressed = testGzip(t, one, gzip.DefaultCompression)
+	compressed[len(compressed)-8] ^= 1
+	_, err = indexGzip(bytes.NewReader(compressed), int64(len(compressed)), io.Discard, gzipSpan)
+	if !errors.Is(err, gzip.ErrChecksum) {
+		t.Errorf("damaged trailer got %v", err)
+	}
+
+	// cut short
+	compressed = compressed[:len(compressed)/2]
+	_, err = indexGzip(bytes.NewReader(compressed), int64(len(compressed)), io.Discard, gzipSpan)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated file got %v", err)
+	}
+}
+
+
+func TestGzipArchive(t *testing.T) {
+
+	files := map[string][]byte{
+		"dir/big.bin":   testGzipContent(6 * 1024 * 1024),
+		"dir/small.txt": []byte("small file"),
+	}
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	for _, name := range []string{"dir/big.bin", "dir/small.txt"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg})
+		tw.Write(files[name])
+	}
+	tw.Close()
+
+	var compressed bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&compressed, flate.BestSpeed)
+	zw.Write(tarball.Bytes())
+	zw.Close()
+	src := bytes.NewReader(compressed.Bytes())
+	indexFile := filepath.Join(t.TempDir(), "index.json")
+
+	// the second mount comes from the saved index
+	for mount := 0; 2 > mount; mount++ {
+		fs, err := openArchive(src, int64(compressed.Len()), indexFile)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if nil == fs.gz.index || 2 > len(fs.gz.index.Points) {
+			t.Fatalf("mount %d: no checkpoints", mount)
+		}
+
+		for name, want := range files {
+			data, err := readBackendFile(fs, "/" + name)
+			if nil != err || !bytes.Equal(want, data) {
+				t.Errorf("mount %d: %s got %d bytes, %v", mount, name, len(data), err)
+			}
+		}
+
+		fp, _ := fs.Open("/dir/big.bin", os.O_RDONLY)
+		buff := make([]byte, 100)
+		ofst := int64(5 * 1024 * 1024 + 17)
+		n, err := fp.ReadAt(buff, ofst)
+		if nil != err || !bytes.Equal(files["dir/big.bin"][ofst:ofst+int64(n)], buff) {
+			t.Errorf("mount %d: read at %d got %d, %v", mount, ofst, n, err)
+		}
+		fp.Close()
+		fs.Close()
+	}
+}
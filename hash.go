@@ -0,0 +1,78 @@
+/*
+ * hash.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+
+// hash algorithms by their check-file names; each also has a <name>sum tool
+var hashAlgs = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha224": sha256.New224,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+
+func newHash(alg string) (hash.Hash, error) {
+	fn, ok := hashAlgs[alg]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash %q", alg)
+	}
+	return fn(), nil
+}
+
+
+func hashReader(r io.Reader, alg string) ([]byte, error) {
+	h, err := newHash(alg)
+	if nil != err {
+		return nil, err
+	}
+	_, err = io.Copy(h, r)
+	if nil != err {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+
+// hash of a backend file, on the server when the backend can, otherwise
+// by reading it through
+func backendHash(fs Backend, name string, alg string) ([]byte, error) {
+
+	if hasher, ok := fs.(Hasher); ok {
+		sum, err := hasher.Hash(name, alg)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return sum, err
+		}
+	}
+
+	fp, err := fs.Open(name, os.O_RDONLY)
+	if nil != err {
+		return nil, err
+	}
+	defer fp.Close()
+	return hashReader(io.NewSectionReader(fp, 0, 1<<62), alg)
+}
@@ -0,0 +1,506 @@
+/*
+ * httpbackend.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// concurrent HEAD requests for listings without exact sizes
+const httpHeadWorkers = 8
+
+
+// Read-only backend over plain HTTP(S)
+//
+// Directories are autoindex pages (Apache or nginx HTML, or nginx
+// autoindex_format json), or come from a JSON manifest of the whole tree:
+// [{"path": "dir/file", "size": 123, "mtime": "2022-01-02T03:04:05Z"}].
+// Attributes come from HEAD and reads are Range GETs, kept open while
+// reading sequentially.
+type httpBackend struct {
+	base     *url.URL
+	user     string
+	password string
+	client   *http.Client
+	manifest *archiveBackend
+}
+
+
+func newHttpBackend(rawurl string, user string, password string, manifest string) (*httpBackend, error) {
+
+	base, err := url.Parse(rawurl)
+	if nil != err {
+		return nil, err
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+
+	self := &httpBackend{}
+	self.base = base
+	self.user = user
+	self.password = password
+	self.client = &http.Client{}
+
+	if "" != manifest {
+		err = self.loadManifest(manifest)
+		if nil != err {
+			return nil, err
+		}
+	}
+	return self, nil
+}
+
+
+func (self *httpBackend) url(name string) string {
+	u := *self.base
+	u.Path = self.base.Path + path.Clean("/" + name)
+	return u.String()
+}
+
+
+func (self *httpBackend) request(method string, rawurl string, header map[string]string) (*http.Response, error) {
+
+	req, err := http.NewRequest(method, rawurl, nil)
+	if nil != err {
+		return nil, err
+	}
+	if "" != self.user {
+		req.SetBasicAuth(self.user, self.password)
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := self.client.Do(req)
+	if nil != err {
+		return nil, err
+	}
+	if 300 <= resp.StatusCode {
+		resp.Body.Close()
+		err = fmt.Errorf("%s %s: %s", method, rawurl, resp.Status)
+		switch resp.StatusCode {
+		case 404, 410:
+			return nil, fmt.Errorf("%w: %w", err, os.ErrNotExist)
+		case 401, 403:
+			return nil, fmt.Errorf("%w: %w", err, os.ErrPermission)
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+
+type httpManifestEntry struct {
+	Path  string
+	Size  int64
+	Mtime time.Time
+}
+
+
+// the manifest is a URL (relative to the base) or a local file
+func (self *httpBackend) loadManifest(manifest string) error {
+
+	var data []byte
+	var err error
+	if _, serr := os.Stat(manifest); nil == serr {
+		data, err = os.ReadFile(manifest)
+	} else {
+		ref, perr := self.base.Parse(manifest)
+		if nil != perr {
+			return perr
+		}
+		var resp *http.Response
+		resp, err = self.request("GET", ref.String(), nil)
+		if nil == err {
+			data, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+	}
+	if nil != err {
+		return err
+	}
+
+	var entries []httpManifestEntry
+	err = json.Unmarshal(data, &entries)
+	if nil != err {
+		return fmt.Errorf("manifest %s: %w", manifest, err)
+	}
+
+	// same tree bookkeeping as an archive index
+	tree := &archiveBackend{entries: make(map[string]*archiveEntry), children: make(map[string][]string)}
+	tree.add(&archiveEntry{Name: "/", Mode: os.ModeDir | 0755})
+	for _, entry := range entries {
+		name := archiveName(entry.Path)
+		mode := os.FileMode(0644)
+		if strings.HasSuffix(entry.Path, "/") {
+			mode = os.ModeDir | 0755
+		}
+		tree.add(&archiveEntry{Name: name, Mode: mode, Size: entry.Size, Mtime: entry.Mtime.UnixNano()})
+	}
+	self.manifest = tree
+	return nil
+}
+
+
+func (self *httpBackend) Stat(name string) (os.FileInfo, error) {
+
+	if nil != self.manifest {
+		return self.manifest.Stat(name)
+	}
+	if "/" == path.Clean("/" + name) {
+		return &fileInfo{"/", 0, fs.ModeDir | 0755, time.Time{}, ""}, nil
+	}
+
+	resp, err := self.request("HEAD", self.url(name), nil)
+	if errors.Is(err, os.ErrNotExist) {
+		// some servers only answer for directories with the slash
+		resp, err = self.request("HEAD", self.url(name) + "/", nil)
+	}
+	if nil != err {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	// redirected to the slash form: a directory
+	if strings.HasSuffix(resp.Request.URL.Path, "/") {
+		return &fileInfo{path.Base(name), 0, fs.ModeDir | 0755, httpMtime(resp), ""}, nil
+	}
+	info := &fileInfo{path.Base(name), 0, 0644, httpMtime(resp), ""}
+	if 0 <= resp.ContentLength {
+		info.size = resp.ContentLength
+	}
+	return info, nil
+}
+
+
+func httpMtime(resp *http.Response) time.Time {
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return mtime
+}
+
+
+func (self *httpBackend) Lstat(name string) (os.FileInfo, error) {
+	return self.Stat(name)
+}
+
+
+// nginx autoindex_format json
+type httpIndexEntry struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Mtime string `json:"mtime"`
+	Size  int64  `json:"size"`
+}
+
+
+// <a href="name">...</a> followed by an optional date and size on the line
+var httpIndexLine = regexp.MustCompile(`(?i)<a\s+href="([^"?#]+)"[^>]*>.*?</a>([^<\n]*(?:<[^a][^>]*>[^<\n]*)*)`)
+var httpIndexDate = regexp.MustCompile(`(\d{2}-[A-Za-z]{3}-\d{4} \d{2}:\d{2}|\d{4}-\d{2}-\d{2} \d{2}:\d{2})`)
+var httpIndexSize = regexp.MustCompile(`\s(\d+|[\d.]+[KMGT]?|-)\s*$`)
+var httpIndexTag = regexp.MustCompile(`<[^>]*>`)
+
+
+func (self *httpBackend) ReadDir(name string) ([]os.FileInfo, error) {
+
+	if nil != self.manifest {
+		return self.manifest.ReadDir(name)
+	}
+
+	dirurl := strings.TrimSuffix(self.url(name), "/") + "/"
+	resp, err := self.request("GET", dirurl, nil)
+	if nil != err {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if nil != err {
+		return nil, err
+	}
+
+	if strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		var index []httpIndexEntry
+		err = json.Unmarshal(body, &index)
+		if nil != err {
+			return nil, err
+		}
+		infos := make([]os.FileInfo, 0, len(index))
+		for _, entry := range index {
+			info := &fileInfo{name: entry.Name, size: entry.Size, mode: 0644}
+			if "directory" == entry.Type {
+				info.mode = fs.ModeDir | 0755
+			}
+			info.mtime, _ = http.ParseTime(entry.Mtime)
+			infos = append(infos, info)
+		}
+		return infos, nil
+	}
+
+	return self.parseIndex(name, dirurl, string(body))
+}
+
+
+// autoindex HTML; entries are the links to direct children
+func (self *httpBackend) parseIndex(name string, dirurl string, body string) ([]os.FileInfo, error) {
+
+	base, err := url.Parse(dirurl)
+	if nil != err {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var infos []os.FileInfo
+	var unsized []*fileInfo
+	for _, match := range httpIndexLine.FindAllStringSubmatch(body, -1) {
+		ref, err := base.Parse(html.UnescapeString(match[1]))
+		if nil != err || ref.Host != base.Host || !strings.HasPrefix(ref.Path, base.Path) {
+			continue
+		}
+		rest := strings.TrimPrefix(ref.Path, base.Path)
+		child := strings.TrimSuffix(rest, "/")
+		if "" == child || strings.Contains(child, "/") || seen[child] {
+			// parent, self, sorting links or deeper paths
+			continue
+		}
+		seen[child] = true
+
+		info := &fileInfo{name: child, mode: 0644, size: -1}
+		if strings.HasSuffix(rest, "/") {
+			info.mode = fs.ModeDir | 0755
+			info.size = 0
+		}
+
+		tail := strings.TrimSpace(httpIndexTag.ReplaceAllString(match[2], " "))
+		if date := httpIndexDate.FindString(tail); "" != date {
+			for _, layout := range []string{"02-Jan-2006 15:04", "2006-01-02 15:04"} {
+				if mtime, err := time.Parse(layout, date); nil == err {
+					info.mtime = mtime
+				}
+			}
+		}
+		if size := httpIndexSize.FindStringSubmatch(" " + tail); nil != size && !info.IsDir() {
+			// exact byte counts only; "1.2K" needs a HEAD
+			if n, err := strconv.ParseInt(size[1], 10, 64); nil == err {
+				info.size = n
+			}
+		}
+		if 0 > info.size {
+			unsized = append(unsized, info)
+		}
+		infos = append(infos, info)
+	}
+
+	self.headAll(name, unsized)
+	return infos, nil
+}
+
+
+// fill in sizes and mtimes the listing didn't give exactly
+func (self *httpBackend) headAll(dir string, infos []*fileInfo) {
+
+	work := make(chan *fileInfo)
+	var wg sync.WaitGroup
+	for i := 0; i < httpHeadWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for info := range work {
+				info.size = 0
+				resp, err := self.request("HEAD", self.url(path.Join(dir, info.name)), nil)
+				if nil != err {
+					continue
+				}
+				resp.Body.Close()
+				if 0 <= resp.ContentLength {
+					info.size = resp.ContentLength
+				}
+				if mtime := httpMtime(resp); !mtime.IsZero() {
+					info.mtime = mtime
+				}
+			}
+		}()
+	}
+	for _, info := range infos {
+		work <- info
+	}
+	close(work)
+	wg.Wait()
+}
+
+
+func (self *httpBackend) Open(name string, flags int) (File, error) {
+
+	if 0 != flags&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) {
+		return nil, errReadOnly
+	}
+
+	info, err := self.Stat(name)
+	if nil != err {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory: %w", name, os.ErrInvalid)
+	}
+
+	fp := &httpFile{}
+	fp.backend = self
+	fp.url = self.url(name)
+	fp.info = info
+	return fp, nil
+}
+
+
+func (self *httpBackend) Create(name string) (File, error) {
+	return nil, errReadOnly
+}
+
+
+func (self *httpBackend) Remove(name string) error {
+	return errReadOnly
+}
+
+
+func (self *httpBackend) Rename(oldpath string, newpath string) error {
+	return errReadOnly
+}
+
+
+func (self *httpBackend) Mkdir(name string) error {
+	return errReadOnly
+}
+
+
+func (self *httpBackend) Chmod(name string, mode os.FileMode) error {
+	return errReadOnly
+}
+
+
+func (self *httpBackend) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return errReadOnly
+}
+
+
+func (self *httpBackend) Symlink(target string, newpath string) error {
+	return errReadOnly
+}
+
+
+func (self *httpBackend) StatVFS(name string, stat *fuse.Statfs_t) error {
+	return errors.ErrUnsupported
+}
+
+
+func (self *httpBackend) Close() error {
+	self.client.CloseIdleConnections()
+	return nil
+}
+
+
+// Remote file read with Range requests
+type httpFile struct {
+	backend *httpBackend
+	url     string
+	info    os.FileInfo
+	lock    sync.Mutex
+	body    io.ReadCloser
+	pos     int64
+}
+
+
+func (self *httpFile) ReadAt(buff []byte, ofst int64) (int, error) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if ofst >= self.info.Size() {
+		return 0, io.EOF
+	}
+
+	if nil == self.body || self.pos != ofst {
+		if nil != self.body {
+			self.body.Close()
+			self.body = nil
+		}
+
+		// open ended, so sequential reads continue on the same response
+		resp, err := self.backend.request("GET", self.url, map[string]string{
+			"Range": fmt.Sprintf("bytes=%d-", ofst),
+		})
+		if nil != err {
+			return 0, err
+		}
+		if http.StatusPartialContent != resp.StatusCode {
+			// no range support; skip to the offset
+			_, err = io.CopyN(io.Discard, resp.Body, ofst)
+			if nil != err {
+				resp.Body.Close()
+				return 0, err
+			}
+		}
+		self.body = resp.Body
+		self.pos = ofst
+	}
+
+	n, err := io.ReadFull(self.body, buff)
+	self.pos += int64(n)
+	if nil != err {
+		self.body.Close()
+		self.body = nil
+		if io.ErrUnexpectedEOF == err {
+			err = io.EOF
+		}
+	}
+	return n, err
+}
+
+
+func (self *httpFile) WriteAt(buff []byte, ofst int64) (int, error) {
+	return 0, errReadOnly
+}
+
+
+func (self *httpFile) Truncate(size int64) error {
+	return errReadOnly
+}
+
+
+func (self *httpFile) Stat() (os.FileInfo, error) {
+	return self.info, nil
+}
+
+
+func (self *httpFile) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if nil != self.body {
+		self.body.Close()
+		self.body = nil
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+/*
+ * httpbackend_test.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+
+// server counting GETs; files below /files come from dir
+type testHttpServer struct {
+	*httptest.Server
+	dir  string
+	lock sync.Mutex
+	gets int
+}
+
+
+func newTestHttpServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request) bool) *testHttpServer {
+
+	self := &testHttpServer{}
+	self.dir = t.TempDir()
+	files := http.StripPrefix("/files", http.FileServer(http.Dir(self.dir)))
+	self.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "GET" == r.Method {
+			self.lock.Lock()
+			self.gets++
+			self.lock.Unlock()
+		}
+		if nil != handler && handler(w, r) {
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	t.Cleanup(self.Close)
+	return self
+}
+
+
+func (self *testHttpServer) write(t *testing.T, name string, data string) {
+	name = filepath.Join(self.dir, filepath.FromSlash(name))
+	os.MkdirAll(filepath.Dir(name), 0755)
+	if err := os.WriteFile(name, []byte(data), 0644); nil != err {
+		t.Fatal(err)
+	}
+}
+
+
+func (self *testHttpServer) count() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.gets
+}
+
+
+func httpNames(t *testing.T, fs *httpBackend, name string) string {
+	infos, err := fs.ReadDir(name)
+	if nil != err {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		kind := "f"
+		if info.IsDir() {
+			kind = "d"
+		}
+		names = append(names, fmt.Sprintf("%s:%s:%d", info.Name(), kind, info.Size()))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+
+// Go's own directory pages: links only, sizes by HEAD
+func TestHttpFileServer(t *testing.T) {
+
+	server := newTestHttpServer(t, nil)
+	server.write(t, "a.txt", "hello")
+	server.write(t, "with space.txt", "12345678")
+	server.write(t, "sub/b.txt", "b")
+	fs, err := newHttpBackend(server.URL + "/files/", "", "", "")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if names := httpNames(t, fs, "/"); "a.txt:f:5,sub:d:0,with space.txt:f:8" != names {
+		t.Errorf("listing got %s", names)
+	}
+	if names := httpNames(t, fs, "/sub"); "b.txt:f:1" != names {
+		t.Errorf("listing got %s", names)
+	}
+
+	info, err := fs.Stat("/with space.txt")
+	if nil != err || 8 != info.Size() || info.IsDir() || info.ModTime().IsZero() {
+		t.Errorf("stat got %v, %v", info, err)
+	}
+	info, err = fs.Stat("/sub")
+	if nil != err || !info.IsDir() {
+		t.Errorf("stat of directory got %v, %v", info, err)
+	}
+	if _, err = fs.Stat("/missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stat of missing file got %v", err)
+	}
+	if _, err = fs.Open("/a.txt", os.O_RDWR); !errors.Is(err, errReadOnly) {
+		t.Errorf("open for writing got %v", err)
+	}
+	if err = fs.Remove("/a.txt"); !errors.Is(err, errReadOnly) {
+		t.Errorf("remove got %v", err)
+	}
+}
+
+
+func TestHttpRead(t *testing.T) {
+
+	ranges := true
+	server := newTestHttpServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if !ranges {
+			r.Header.Del("Range")
+		}
+		return false
+	})
+	content := strings.Repeat("0123456789", 10000)
+	server.write(t, "big.txt", content)
+	fs, _ := newHttpBackend(server.URL + "/files", "", "", "")
+
+	for _, ranges = range []bool{true, false} {
+		fp, err := fs.Open("/big.txt", os.O_RDONLY)
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		gets := server.count()
+		buff := make([]byte, 1000)
+		for ofst := int64(5000); 10000 > ofst; ofst += int64(len(buff)) {
+			n, err := fp.ReadAt(buff, ofst)
+			if nil != err || content[ofst:ofst+int64(n)] != string(buff[:n]) {
+				t.Fatalf("ranges=%v: read at %d got %d, %v", ranges, ofst, n, err)
+			}
+		}
+		if 1 != server.count() - gets {
+			t.Errorf("ranges=%v: %d GETs for sequential reads", ranges, server.count() - gets)
+		}
+
+		n, err := fp.ReadAt(buff, 17)
+		if nil != err || content[17:17+n] != string(buff[:n]) {
+			t.Errorf("ranges=%v: read back got %d, %v", ranges, n, err)
+		}
+		n, err = fp.ReadAt(buff, int64(len(content)) - 10)
+		if io.EOF != err || content[len(content)-10:] != string(buff[:n]) {
+			t.Errorf("ranges=%v: read at the end got %d, %v", ranges, n, err)
+		}
+		if _, err = fp.ReadAt(buff, int64(len(content))); io.EOF != err {
+			t.Errorf("ranges=%v: read past the end got %v", ranges, err)
+		}
+		fp.Close()
+	}
+}
+
+
+func TestHttpAutoindex(t *testing.T) {
+
+	mtime := time.Date(2022, 1, 31, 10, 15, 0, 0, time.UTC)
+	server := newTestHttpServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		switch r.URL.Path {
+		case "/nginx/":
+			// nginx autoindex: exact sizes
+			fmt.Fprint(w, `<html><body><h1>Index of /nginx/</h1><hr><pre><a href="../">../</a>
+<a href="sub/">sub/</a>                                               31-Jan-2022 10:15       -
+<a href="a%20b.txt">a b.txt</a>                                        31-Jan-2022 10:15      42
+<a href="?C=N;O=D">Name</a>
+<a href="http://elsewhere/x">x</a>
+</pre><hr></body></html>`)
+		case "/apache/":
+			// Apache: rounded sizes need a HEAD
+			fmt.Fprint(w, `<table><tr><td><a href="/apache/">Parent Directory</a></td></tr>
+<tr><td><a href="big.iso">big.iso</a></td><td align="right">2022-01-31 10:15  </td><td align="right">1.2K</td></tr>
+</table>`)
+		case "/apache/big.iso":
+			w.Header().Set("Content-Length", "1234")
+			w.Header().Set("Last-Modified", mtime.Format(http.TimeFormat))
+		case "/json/":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `[{"name":"d","type":"directory","mtime":"Mon, 31 Jan 2022 10:15:00 GMT"},
+{"name":"f","type":"file","mtime":"Mon, 31 Jan 2022 10:15:00 GMT","size":7}]`)
+		case "/chunked/file":
+			// HEAD without a length
+			w.Header().Set("Transfer-Encoding", "chunked")
+		default:
+			return false
+		}
+		return true
+	})
+
+	for dir, want := range map[string]string{
+		"nginx":  "a b.txt:f:42,sub:d:0",
+		"apache": "big.iso:f:1234",
+		"json":   "d:d:0,f:f:7",
+	} {
+		fs, _ := newHttpBackend(server.URL + "/" + dir, "", "", "")
+		if names := httpNames(t, fs, "/"); want != names {
+			t.Errorf("%s: listing got %s, want %s", dir, names, want)
+		}
+		infos, _ := fs.ReadDir("/")
+		for _, info := range infos {
+			if !mtime.Equal(info.ModTime()) {
+				t.Errorf("%s: %s modified %v", dir, info.Name(), info.ModTime())
+			}
+		}
+	}
+
+	fs, _ := newHttpBackend(server.URL + "/chunked", "", "", "")
+	info, err := fs.Stat("/file")
+	if nil != err || 0 != info.Size() {
+		t.Errorf("stat without a length got %v, %v", info, err)
+	}
+}
+
+
+func TestHttpManifest(t *testing.T) {
+
+	server := newTestHttpServer(t, nil)
+	server.write(t, "dir/a.txt", "hello")
+	manifest := filepath.Join(t.TempDir(), "manifest.json")
+	os.WriteFile(manifest, []byte(`[{"path": "dir/", "mtime": "2022-01-02T03:04:05Z"},
+{"path": "dir/a.txt", "size": 5, "mtime": "2022-01-02T03:04:05Z"}]`), 0644)
+
+	fs, err := newHttpBackend(server.URL + "/files", "", "", manifest)
+	if nil != err {
+		t.Fatal(err)
+	}
+	gets := server.count()
+	if names := httpNames(t, fs, "/dir"); "a.txt:f:5" != names {
+		t.Errorf("listing got %s", names)
+	}
+	info, err := fs.Stat("/dir/a.txt")
+	if nil != err || 5 != info.Size() || 2022 != info.ModTime().Year() {
+		t.Errorf("stat got %v, %v", info, err)
+	}
+	if server.count() != gets {
+		t.Error("listing went to the server")
+	}
+	if data, err := readBackendFile(fs, "/dir/a.txt"); nil != err || "hello" != string(data) {
+		t.Errorf("read got %q, %v", data, err)
+	}
+}
@@ -0,0 +1,324 @@
+/*
+ * localbackend.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+var errInjected = errors.New("injected fault")
+
+
+// Backend over a local directory
+//
+// For loopback mounts and for exercising the FUSE adapters without a
+// server. latency is added to every operation, bandwidth (bytes per
+// second, 0 for unlimited) throttles reads and writes, and errRate is the
+// fraction of operations that fail with EIO.
+type localBackend struct {
+	root      string
+	latency   time.Duration
+	bandwidth int64
+	errRate   float64
+}
+
+
+func newLocalBackend(root string) (*localBackend, error) {
+
+	root, err := filepath.Abs(root)
+	if nil != err {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if nil != err {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "mount", Path: root, Err: errors.New("not a directory")}
+	}
+
+	self := &localBackend{}
+	self.root = root
+	return self, nil
+}
+
+
+// local name of a path; cleaning keeps it inside root
+func (self *localBackend) local(name string) string {
+	return filepath.Join(self.root, filepath.FromSlash(path.Clean("/" + name)))
+}
+
+
+// simulated network: delay and maybe fail an operation
+func (self *localBackend) inject() error {
+	if 0 < self.latency {
+		time.Sleep(self.latency)
+	}
+	if 0 < self.errRate && rand.Float64() < self.errRate {
+		return errInjected
+	}
+	return nil
+}
+
+
+func (self *localBackend) throttle(n int) {
+	if 0 < self.bandwidth {
+		time.Sleep(time.Duration(int64(n) * int64(time.Second) / self.bandwidth))
+	}
+}
+
+
+func (self *localBackend) Stat(name string) (os.FileInfo, error) {
+	if err := self.inject(); nil != err {
+		return nil, err
+	}
+	return os.Stat(self.local(name))
+}
+
+
+func (self *localBackend) Lstat(name string) (os.FileInfo, error) {
+	if err := self.inject(); nil != err {
+		return nil, err
+	}
+	return os.Lstat(self.local(name))
+}
+
+
+func (self *localBackend) ReadDir(name string) ([]os.FileInfo, error) {
+
+	if err := self.inject(); nil != err {
+		return nil, err
+	}
+	entries, err := os.ReadDir(self.local(name))
+	if nil != err {
+		return nil, err
+	}
+
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if nil != err {
+			// removed while listing
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+
+func (self *localBackend) Open(name string, flags int) (File, error) {
+
+	if err := self.inject(); nil != err {
+		return nil, err
+	}
+	fp, err := os.OpenFile(self.local(name), flags, 0644)
+	if nil != err {
+		return nil, err
+	}
+	return &localFile{fp, self}, nil
+}
+
+
+func (self *localBackend) Create(name string) (File, error) {
+	return self.Open(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+
+func (self *localBackend) Remove(name string) error {
+	if err := self.inject(); nil != err {
+		return err
+	}
+	return os.Remove(self.local(name))
+}
+
+
+func (self *localBackend) Rename(oldpath string, newpath string) error {
+	if err := self.inject(); nil != err {
+		return err
+	}
+	return os.Rename(self.local(oldpath), self.local(newpath))
+}
+
+
+func (self *localBackend) Mkdir(name string) error {
+	if err := self.inject(); nil != err {
+		return err
+	}
+	return os.Mkdir(self.local(name), 0755)
+}
+
+
+func (self *localBackend) Chmod(name string, mode os.FileMode) error {
+	if err := self.inject(); nil != err {
+		return err
+	}
+	return os.Chmod(self.local(name), mode)
+}
+
+
+func (self *localBackend) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := self.inject(); nil != err {
+		return err
+	}
+	return os.Chtimes(self.local(name), atime, mtime)
+}
+
+
+func (self *localBackend) Symlink(target string, newpath string) error {
+	if err := self.inject(); nil != err {
+		return err
+	}
+	return os.Symlink(target, self.local(newpath))
+}
+
+
+func (self *localBackend) Readlink(name string) (string, error) {
+	if err := self.inject(); nil != err {
+		return "", err
+	}
+	return os.Readlink(self.local(name))
+}
+
+
+func (self *localBackend) StatVFS(name string, stat *fuse.Statfs_t) error {
+	if err := self.inject(); nil != err {
+		return err
+	}
+	return localStatfs(self.local(name), stat)
+}
+
+
+// run cmd with a shell in the root directory
+func (self *localBackend) Exec(cmd string) (io.ReadCloser, error) {
+
+	if err := self.inject(); nil != err {
+		return nil, err
+	}
+
+	command := exec.Command("sh", "-c", cmd)
+	command.Dir = self.root
+	out, err := command.StdoutPipe()
+	if nil != err {
+		return nil, err
+	}
+	err = command.Start()
+	if nil != err {
+		return nil, err
+	}
+	return &localExecOutput{out, command}, nil
+}
+
+
+// the "server" copies without sending the content, so no throttling
+func (self *localBackend) Copy(oldpath string, newpath string) error {
+
+	if err := self.inject(); nil != err {
+		return err
+	}
+	src, err := os.Open(self.local(oldpath))
+	if nil != err {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if nil != err {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return errors.ErrUnsupported
+	}
+	// also catches links to the same file
+	if dinfo, err := os.Stat(self.local(newpath)); nil == err && os.SameFile(info, dinfo) {
+		return &os.PathError{Op: "copy", Path: oldpath, Err: errSameFile}
+	}
+
+	dst, err := os.OpenFile(self.local(newpath), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if nil != err {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); nil == err {
+		err = cerr
+	}
+	return err
+}
+
+
+// the "server" hashes without sending the content, so no throttling
+func (self *localBackend) Hash(name string, alg string) ([]byte, error) {
+
+	if err := self.inject(); nil != err {
+		return nil, err
+	}
+	fp, err := os.Open(self.local(name))
+	if nil != err {
+		return nil, err
+	}
+	defer fp.Close()
+	return hashReader(fp, alg)
+}
+
+
+func (self *localBackend) Close() error {
+	return nil
+}
+
+
+// Open local file
+type localFile struct {
+	*os.File
+	backend *localBackend
+}
+
+
+func (self *localFile) ReadAt(buff []byte, ofst int64) (int, error) {
+	if err := self.backend.inject(); nil != err {
+		return 0, err
+	}
+	n, err := self.File.ReadAt(buff, ofst)
+	self.backend.throttle(n)
+	return n, err
+}
+
+
+func (self *localFile) WriteAt(buff []byte, ofst int64) (int, error) {
+	if err := self.backend.inject(); nil != err {
+		return 0, err
+	}
+	self.backend.throttle(len(buff))
+	return self.File.WriteAt(buff, ofst)
+}
+
+
+// stdout of a local command
+type localExecOutput struct {
+	io.ReadCloser
+	command *exec.Cmd
+}
+
+
+func (self *localExecOutput) Close() error {
+	self.ReadCloser.Close()
+	return self.command.Wait()
+}
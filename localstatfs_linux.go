@@ -0,0 +1,42 @@
+//go:build linux
+
+/*
+ * localstatfs_linux.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"syscall"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+func localStatfs(name string, stat *fuse.Statfs_t) error {
+
+	st := syscall.Statfs_t{}
+	err := syscall.Statfs(name, &st)
+	if nil != err {
+		return err
+	}
+
+	stat.Bsize = uint64(st.Bsize)
+	stat.Frsize = uint64(st.Frsize)
+	stat.Blocks = st.Blocks
+	stat.Bfree = st.Bfree
+	stat.Bavail = st.Bavail
+	stat.Files = st.Files
+	stat.Ffree = st.Ffree
+	stat.Favail = st.Ffree
+	stat.Namemax = uint64(st.Namelen)
+	return nil
+}
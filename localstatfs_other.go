@@ -0,0 +1,26 @@
+//go:build !linux
+
+/*
+ * localstatfs_other.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"errors"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+func localStatfs(name string, stat *fuse.Statfs_t) error {
+	return errors.ErrUnsupported
+}
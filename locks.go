@@ -0,0 +1,37 @@
+//go:build !memfs && !sftpfs
+
+/*
+ * locks.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"errors"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// Advisory locks
+//
+// cgofuse 1.6 has its lock hook commented out, so fcntl and flock locks
+// stay in the kernel and only work within one mount. What other mounts
+// see is -lock-on-open: a file open for writing holds the server lock
+// until it is closed.
+
+
+func lockErrc(err error) int {
+	if errors.Is(err, errLocked) {
+		return -fuse.EAGAIN
+	}
+	return fuseErrc(err)
+}
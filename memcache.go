@@ -0,0 +1,68 @@
+//go:build memfs
+
+/*
+ * memcache.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+
+// Memory budget of Memfs
+//
+// Loaded file content is charged to the budget and kept in LRU order.
+// Past the budget, the least recently used content the server already has
+// is dropped and fetched again on the next access; files with unsynced
+// changes are never dropped, so they may take the total over the budget.
+
+
+// count the content of node and make it the most recently used
+func (self *Memfs) touch(node *node_t) {
+	self.used += int64(cap(node.data)) - node.charged
+	node.charged = int64(cap(node.data))
+	if nil == node.elem {
+		node.elem = self.lru.PushFront(node)
+	} else {
+		self.lru.MoveToFront(node.elem)
+	}
+	self.evict(node, 0)
+}
+
+
+// drop content until extra more bytes fit; keep is being used
+func (self *Memfs) evict(keep *node_t, extra int64) {
+
+	if 0 == self.budget {
+		return
+	}
+	for elem := self.lru.Back(); nil != elem && self.used + extra > self.budget; {
+		node := elem.Value.(*node_t)
+		elem = elem.Prev()
+
+		// only the server copy could bring these back
+		if node == keep || 0 != node.dirty || node.lost || "" == node.origin || 0 == node.stat.Nlink {
+			continue
+		}
+		self.unload(node)
+	}
+}
+
+
+func (self *Memfs) unload(node *node_t) {
+	if nil == node.elem {
+		return
+	}
+	self.used -= node.charged
+	self.lru.Remove(node.elem)
+	node.elem = nil
+	node.charged = 0
+	node.data = nil
+	node.loaded = false
+}
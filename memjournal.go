@@ -0,0 +1,237 @@
+//go:build memfs
+
+/*
+ * memjournal.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+
+// Memfs operations on local disk, so a crash doesn't lose them
+//
+//	dir/journal     one JSON memOp per line, fsync'd before it is queued
+//	dir/done        sequence number of the last operation off the journal
+//	dir/data/<seq>  content of upload <seq> as of its last fsync or close
+//
+// The journal is cut back to nothing whenever the syncer catches up;
+// sequence numbers keep counting from the done file.
+type memJournal struct {
+	dir  string
+	lock sync.Mutex
+	log  *os.File
+	seq  uint64
+	done uint64
+}
+
+
+func openMemJournal(dir string) (*memJournal, error) {
+
+	err := os.MkdirAll(filepath.Join(dir, "data"), 0700)
+	if nil != err {
+		return nil, err
+	}
+
+	self := &memJournal{}
+	self.dir = dir
+	self.log, err = os.OpenFile(filepath.Join(dir, "journal"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if nil != err {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "done"))
+	if nil == err {
+		self.done, _ = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	}
+	self.seq = self.done
+	ops, err := self.Pending()
+	if nil != err {
+		self.log.Close()
+		return nil, err
+	}
+	if 0 != len(ops) {
+		self.seq = ops[len(ops) - 1].Seq
+	}
+	return self, nil
+}
+
+
+// operations written but not done, oldest first
+func (self *memJournal) Pending() ([]*memOp, error) {
+
+	fp, err := os.Open(filepath.Join(self.dir, "journal"))
+	if nil != err {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var ops []*memOp
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(nil, 1024 * 1024)
+	for scanner.Scan() {
+		op := &memOp{}
+		if err := json.Unmarshal(scanner.Bytes(), op); nil != err {
+			// torn last line of a crash
+			fmt.Printf("journal: skipping %q: %s\n", scanner.Text(), err)
+			continue
+		}
+		if op.Seq > self.done {
+			ops = append(ops, op)
+		}
+	}
+	return ops, scanner.Err()
+}
+
+
+func (self *memJournal) Append(op *memOp) error {
+
+	defer self.synchronize()()
+
+	self.seq++
+	op.Seq = self.seq
+	data, err := json.Marshal(op)
+	if nil != err {
+		return err
+	}
+	_, err = self.log.Write(append(data, '\n'))
+	if nil == err {
+		err = self.log.Sync()
+	}
+	return err
+}
+
+
+func (self *memJournal) data(op *memOp) string {
+	return filepath.Join(self.dir, "data", strconv.FormatUint(op.Seq, 10))
+}
+
+
+// keep the content for upload op
+func (self *memJournal) Save(op *memOp, data []byte) error {
+	name := self.data(op)
+	err := writeSynced(name + ".tmp", data)
+	if nil != err {
+		return err
+	}
+	return os.Rename(name + ".tmp", name)
+}
+
+
+// content saved for upload op, if any
+func (self *memJournal) Load(op *memOp) ([]byte, error) {
+	return os.ReadFile(self.data(op))
+}
+
+
+func (self *memJournal) Done(op *memOp) {
+
+	defer self.synchronize()()
+
+	self.done = op.Seq
+	err := writeSynced(filepath.Join(self.dir, "done"), []byte(strconv.FormatUint(op.Seq, 10)))
+	if nil != err {
+		fmt.Printf("journal: %s\n", err)
+	}
+	os.Remove(self.data(op))
+}
+
+
+// everything is done: start the journal over
+func (self *memJournal) Reset() {
+
+	defer self.synchronize()()
+
+	err := self.log.Truncate(0)
+	if nil == err {
+		err = self.log.Sync()
+	}
+	if nil != err {
+		fmt.Printf("journal: %s\n", err)
+	}
+}
+
+
+// forget the pending operations
+func (self *memJournal) Discard() error {
+
+	ops, err := self.Pending()
+	if nil != err {
+		return err
+	}
+	for _, op := range ops {
+		self.Done(op)
+	}
+	self.Reset()
+	return nil
+}
+
+
+// send what an earlier session left behind; stops at the first operation
+// the server can't take right now
+func (self *memJournal) Replay(fs Backend) error {
+
+	ops, err := self.Pending()
+	if nil != err {
+		return err
+	}
+
+	for _, op := range ops {
+		var data []byte
+		if "upload" == op.Op {
+			data, err = self.Load(op)
+			if os.IsNotExist(err) {
+				fmt.Printf("replay %s: content was never saved; skipped\n", op)
+				self.Done(op)
+				continue
+			}
+			if nil != err {
+				return err
+			}
+		}
+
+		err = sendOp(fs, op, data)
+		if nil != err && transientErr(err) {
+			return fmt.Errorf("replay %s: %w", op, err)
+		}
+		if nil != err {
+			fmt.Printf("replay %s: %s; dropped\n", op, err)
+		} else {
+			fmt.Printf("replayed %s\n", op)
+		}
+		self.Done(op)
+	}
+
+	self.Reset()
+	return nil
+}
+
+
+func (self *memJournal) Close() error {
+	return self.log.Close()
+}
+
+
+func (self *memJournal) synchronize() func() {
+	self.lock.Lock()
+	return func() {
+		self.lock.Unlock()
+	}
+}
@@ -0,0 +1,338 @@
+//go:build memfs
+
+/*
+ * memsync.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+
+// retry backoff of the syncer
+const (
+	memRetryMin = time.Second
+	memRetryMax = time.Minute
+)
+
+
+// xattr of the root with the number of operations not synced yet
+const memPendingXattr = "user.memfs.pending"
+
+
+// how long unmounting waits for the server when the journal is on disk
+const memCloseWait = 30 * time.Second
+
+
+// Change to the in-memory tree that the server hasn't seen yet
+//
+// Uploads don't carry data: the content is taken from the node when the
+// operation reaches the server, so later writes ride along.
+type memOp struct {
+	Seq    uint64
+	Op     string      // mkdir, upload, remove, rename, chmod, chtimes or symlink
+	Path   string
+	Target string      `json:",omitempty"` // rename destination or symlink target
+	Mode   os.FileMode `json:",omitempty"`
+	Atime  time.Time
+	Mtime  time.Time
+	node   *node_t
+}
+
+
+func (self *memOp) String() string {
+	if "" != self.Target {
+		return self.Op + " " + self.Path + " " + self.Target
+	}
+	return self.Op + " " + self.Path
+}
+
+
+// Ordered journal of memOps, replayed to the server one at a time
+//
+// An operation that fails because the server is unreachable is retried
+// until it goes through; nothing behind it is sent before then. One the
+// server rejects for good is logged and dropped. With a journal, every
+// operation is on disk before it is queued.
+type memSyncer struct {
+	memfs   *Memfs
+	journal *memJournal
+	lock    sync.Mutex
+	cond   *sync.Cond
+	ops    []*memOp
+	queued uint64 // operations ever pushed
+	synced uint64 // operations done with
+	closed bool
+}
+
+
+func newMemSyncer(memfs *Memfs) *memSyncer {
+	self := &memSyncer{}
+	self.memfs = memfs
+	self.cond = sync.NewCond(&self.lock)
+	go self.run()
+	return self
+}
+
+
+func (self *memSyncer) Push(op *memOp) {
+	self.lock.Lock()
+	if nil != self.journal {
+		if err := self.journal.Append(op); nil != err {
+			fmt.Printf("journal %s: %s\n", op, err)
+		}
+	}
+	self.ops = append(self.ops, op)
+	self.queued++
+	self.cond.Broadcast()
+	self.lock.Unlock()
+}
+
+
+// operations not on the server yet
+func (self *memSyncer) Pending() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.ops)
+}
+
+
+// wait until everything pushed so far is done
+func (self *memSyncer) Wait() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for target := self.queued; self.synced < target && !self.closed; {
+		self.cond.Wait()
+	}
+}
+
+
+// drain the journal and stop; a journal on disk can be left for next time
+func (self *memSyncer) Close() {
+	if n := self.Pending(); 0 != n {
+		fmt.Printf("waiting for %d pending operations\n", n)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		self.Wait()
+		close(drained)
+	}()
+	var timeout <-chan time.Time
+	if nil != self.journal {
+		timeout = time.After(memCloseWait)
+	}
+	select {
+	case <-drained:
+	case <-timeout:
+		fmt.Printf("%d operations left in %s for the next start\n", self.Pending(), self.journal.dir)
+	}
+
+	self.lock.Lock()
+	self.closed = true
+	self.cond.Broadcast()
+	self.lock.Unlock()
+}
+
+
+func (self *memSyncer) run() {
+
+	delay := memRetryMin
+	for {
+		self.lock.Lock()
+		for 0 == len(self.ops) && !self.closed {
+			self.cond.Wait()
+		}
+		if 0 == len(self.ops) {
+			self.lock.Unlock()
+			return
+		}
+		op := self.ops[0]
+		self.lock.Unlock()
+
+		err := self.memfs.apply(op)
+		if nil != err && transientErr(err) {
+			fmt.Printf("sync %s: %s; %d pending, retrying in %s\n", op, err, self.Pending(), delay)
+			time.Sleep(delay)
+			delay *= 2
+			if delay > memRetryMax {
+				delay = memRetryMax
+			}
+			continue
+		}
+		if nil != err {
+			fmt.Printf("sync %s: %s; dropped\n", op, err)
+		}
+		delay = memRetryMin
+		self.memfs.applied(op, err)
+
+		self.lock.Lock()
+		self.ops = self.ops[1:]
+		self.synced++
+		if nil != self.journal {
+			self.journal.Done(op)
+		}
+		if 0 == len(self.ops) {
+			fmt.Println("all changes synced")
+			if nil != self.journal {
+				self.journal.Reset()
+			}
+		}
+		self.cond.Broadcast()
+		self.lock.Unlock()
+	}
+}
+
+
+// send one operation to the server
+func (self *Memfs) apply(op *memOp) error {
+
+	switch op.Op {
+	case "upload":
+		data, ok := self.snapshot(op.node)
+		if !ok {
+			return nil
+		}
+		if journal := self.syncer.journal; nil != journal {
+			if err := journal.Save(op, data); nil != err {
+				fmt.Printf("journal %s: %s\n", op, err)
+			}
+		}
+		err := sendOp(self.fs, op, data)
+		if nil == err {
+			self.lock.Lock()
+			op.node.origin = op.Path
+			op.node.lost = false
+			self.lock.Unlock()
+		}
+		return err
+
+	case "rename":
+		// nothing may be fetched from the old place once it is gone
+		defer self.synchronize()()
+		err := sendOp(self.fs, op, nil)
+		if nil == err {
+			self.moved(op.node, op.Path, op.Target)
+		}
+		return err
+	}
+	return sendOp(self.fs, op, nil)
+}
+
+
+// op is off the journal, sent or dropped with err
+func (self *Memfs) applied(op *memOp, err error) {
+	if "upload" == op.Op {
+		self.lock.Lock()
+		op.node.dirty--
+		if nil != err {
+			// the server never got it; keep it in memory
+			op.node.lost = true
+		}
+		self.lock.Unlock()
+	}
+}
+
+
+// current content of a file; false once it has been removed
+func (self *Memfs) snapshot(node *node_t) ([]byte, bool) {
+	defer self.synchronize()()
+	node.queued = false
+	if 0 == node.stat.Nlink {
+		return nil, false
+	}
+	data := make([]byte, node.stat.Size)
+	copy(data, node.data)
+	return data, true
+}
+
+
+// data is the content for uploads
+func sendOp(fs Backend, op *memOp, data []byte) error {
+
+	switch op.Op {
+	case "mkdir":
+		err := fs.Mkdir(op.Path)
+		if errors.Is(err, os.ErrExist) {
+			return nil
+		}
+		return err
+
+	case "upload":
+		fp, err := fs.Open(op.Path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if nil != err {
+			return err
+		}
+		if 0 != len(data) {
+			_, err = fp.WriteAt(data, 0)
+		}
+		if cerr := fp.Close(); nil == err {
+			err = cerr
+		}
+		return err
+
+	case "remove":
+		err := fs.Remove(op.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+
+	case "rename":
+		return fs.Rename(op.Path, op.Target)
+
+	case "chmod":
+		return fs.Chmod(op.Path, op.Mode)
+
+	case "chtimes":
+		return fs.Chtimes(op.Path, op.Atime, op.Mtime)
+
+	case "symlink":
+		return fs.Symlink(op.Target, op.Path)
+	}
+	return fmt.Errorf("unknown operation %q", op.Op)
+}
+
+
+// the server renamed oldpath: follow it with the origins below node
+func (self *Memfs) moved(node *node_t, oldpath string, newpath string) {
+	if node.origin == oldpath {
+		node.origin = newpath
+	} else if strings.HasPrefix(node.origin, oldpath + "/") {
+		node.origin = newpath + node.origin[len(oldpath):]
+	}
+	for _, chld := range node.chld {
+		self.moved(chld, oldpath, newpath)
+	}
+}
+
+
+// errors of a connection that went away; whatever else the server says
+// won't change by asking again
+func transientErr(err error) bool {
+	var neterr net.Error
+	return errors.Is(err, errOffline) ||
+		errors.Is(err, sftp.ErrSSHFxConnectionLost) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &neterr)
+}
@@ -0,0 +1,478 @@
+/*
+ * multibackend.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// how long a failed host is left alone before dialling it again
+const multiRetry = 10 * time.Second
+
+
+// One server of a multiBackend
+type multiHost struct {
+	name    string
+	spec    string
+	lock    sync.Mutex
+	fs      Backend
+	busy    int           // operations and open files using fs
+	used    time.Time
+	failed  time.Time
+	err     error         // why the last dial failed
+	dialing chan struct{} // closed when the dial in progress ends
+}
+
+
+// Several backends as the top level directories of one tree
+//
+// Hosts are dialled on first use and closed again after sitting idle; a
+// host that can't be reached only fails the operations below its own
+// directory.
+type multiBackend struct {
+	hosts map[string]*multiHost
+	names []string
+	idle  time.Duration
+	stop  chan struct{}
+}
+
+
+func newMultiBackend(specs map[string]string, idle time.Duration) *multiBackend {
+	self := &multiBackend{}
+	self.hosts = make(map[string]*multiHost)
+	self.idle = idle
+	self.stop = make(chan struct{})
+	for name, spec := range specs {
+		self.hosts[name] = &multiHost{name: name, spec: spec}
+		self.names = append(self.names, name)
+	}
+	sort.Strings(self.names)
+
+	if 0 < idle {
+		go self.reap()
+	}
+	return self
+}
+
+
+// read "name backend-url" lines; # starts a comment
+func loadHosts(file string) (map[string]string, error) {
+
+	fp, err := os.Open(file)
+	if nil != err {
+		return nil, err
+	}
+	defer fp.Close()
+
+	specs := make(map[string]string)
+	scanner := bufio.NewScanner(fp)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if "" == line || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if 2 != len(fields) || strings.Contains(fields[0], "/") {
+			return nil, fmt.Errorf("%s:%d: expected \"name url\"", file, n)
+		}
+		if _, ok := specs[fields[0]]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate host %s", file, n, fields[0])
+		}
+		specs[fields[0]] = fields[1]
+	}
+	return specs, scanner.Err()
+}
+
+
+// split /host/rest into the host and its own path
+func (self *multiBackend) split(name string) (*multiHost, string, error) {
+	name = path.Clean("/" + name)
+	first, rest, _ := strings.Cut(name[1:], "/")
+	host, ok := self.hosts[first]
+	if !ok {
+		return nil, "", os.ErrNotExist
+	}
+	return host, "/" + rest, nil
+}
+
+
+// backend URL of the host name is under, without its password
+func (self *multiBackend) hostSpec(name string) (string, bool) {
+	host, _, err := self.split(name)
+	if nil != err {
+		return "", false
+	}
+	return redactSpec(host.spec), true
+}
+
+
+// dial if needed and hold the connection open
+//
+// The dial happens outside the lock so a slow server doesn't hold up
+// release and the reaper; one caller dials and the others wait for it.
+func (self *multiHost) acquire() (Backend, error) {
+
+	self.lock.Lock()
+	for nil == self.fs {
+		if nil != self.err && time.Since(self.failed) < multiRetry {
+			self.lock.Unlock()
+			return nil, self.err
+		}
+		if nil != self.dialing {
+			dialing := self.dialing
+			self.lock.Unlock()
+			<-dialing
+			self.lock.Lock()
+			continue
+		}
+
+		dialing := make(chan struct{})
+		self.dialing = dialing
+		self.lock.Unlock()
+		fs, err := openBackend(self.spec)
+		self.lock.Lock()
+		self.dialing = nil
+		close(dialing)
+		if nil != err {
+			fmt.Printf("%s: %s\n", self.name, err)
+			self.err = fmt.Errorf("%s: %w", self.name, err)
+			self.failed = time.Now()
+			self.lock.Unlock()
+			return nil, self.err
+		}
+		self.fs = fs
+		self.err = nil
+	}
+	fs := self.fs
+	self.busy++
+	self.lock.Unlock()
+	return fs, nil
+}
+
+
+func (self *multiHost) release() {
+	self.lock.Lock()
+	self.busy--
+	self.used = time.Now()
+	self.lock.Unlock()
+}
+
+
+// run fn against the backend of the host under name
+func (self *multiBackend) with(name string, fn func(fs Backend, rest string) error) error {
+	host, rest, err := self.split(name)
+	if nil != err {
+		return err
+	}
+	fs, err := host.acquire()
+	if nil != err {
+		return err
+	}
+	defer host.release()
+	return fn(fs, rest)
+}
+
+
+// close connections nobody used for a while
+func (self *multiBackend) reap() {
+
+	tick := self.idle / 2
+	if tick > 30 * time.Second {
+		tick = 30 * time.Second
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, host := range self.hosts {
+			host.lock.Lock()
+			if nil != host.fs && 0 == host.busy && time.Since(host.used) > self.idle {
+				host.fs.Close()
+				host.fs = nil
+			}
+			host.lock.Unlock()
+		}
+	}
+}
+
+
+func (self *multiBackend) hostInfo(name string) os.FileInfo {
+	return &fileInfo{name: name, mode: os.ModeDir | 0755}
+}
+
+
+func (self *multiBackend) Stat(name string) (os.FileInfo, error) {
+	return self.Lstat(name)
+}
+
+
+func (self *multiBackend) Lstat(name string) (os.FileInfo, error) {
+
+	name = path.Clean("/" + name)
+	if "/" == name {
+		return self.hostInfo("/"), nil
+	}
+	// listing the root mustn't dial every host
+	if host, ok := self.hosts[name[1:]]; ok {
+		return self.hostInfo(host.name), nil
+	}
+
+	var info os.FileInfo
+	err := self.with(name, func(fs Backend, rest string) (err error) {
+		info, err = fs.Lstat(rest)
+		return
+	})
+	return info, err
+}
+
+
+func (self *multiBackend) ReadDir(name string) ([]os.FileInfo, error) {
+
+	if "/" == path.Clean("/" + name) {
+		infos := make([]os.FileInfo, 0, len(self.names))
+		for _, name := range self.names {
+			infos = append(infos, self.hostInfo(name))
+		}
+		return infos, nil
+	}
+
+	var infos []os.FileInfo
+	err := self.with(name, func(fs Backend, rest string) (err error) {
+		infos, err = fs.ReadDir(rest)
+		return
+	})
+	return infos, err
+}
+
+
+func (self *multiBackend) Open(name string, flags int) (File, error) {
+
+	host, rest, err := self.split(name)
+	if nil != err {
+		return nil, err
+	}
+	fs, err := host.acquire()
+	if nil != err {
+		return nil, err
+	}
+
+	fp, err := fs.Open(rest, flags)
+	if nil != err {
+		host.release()
+		return nil, err
+	}
+	// the connection stays in use until the file is closed
+	return &multiFile{File: fp, host: host}, nil
+}
+
+
+func (self *multiBackend) Create(name string) (File, error) {
+	return self.Open(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+
+// the top level is fixed
+func (self *multiBackend) top(name string) error {
+	name = path.Clean("/" + name)
+	if "/" == name || !strings.Contains(name[1:], "/") {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+
+func (self *multiBackend) Remove(name string) error {
+	if err := self.top(name); nil != err {
+		return err
+	}
+	return self.with(name, func(fs Backend, rest string) error {
+		return fs.Remove(rest)
+	})
+}
+
+
+func (self *multiBackend) Rename(oldpath string, newpath string) error {
+
+	if err := self.top(oldpath); nil != err {
+		return err
+	}
+	if err := self.top(newpath); nil != err {
+		return err
+	}
+	host, _, err := self.split(oldpath)
+	if nil != err {
+		return err
+	}
+	other, newrest, err := self.split(newpath)
+	if nil != err {
+		return err
+	}
+	if other != host {
+		return errCrossDevice
+	}
+
+	return self.with(oldpath, func(fs Backend, rest string) error {
+		return fs.Rename(rest, newrest)
+	})
+}
+
+
+func (self *multiBackend) Copy(oldpath string, newpath string) error {
+
+	if err := self.top(newpath); nil != err {
+		return err
+	}
+	host, _, err := self.split(oldpath)
+	if nil != err {
+		return err
+	}
+	other, newrest, err := self.split(newpath)
+	if nil != err {
+		return err
+	}
+	if other != host {
+		return errCrossDevice
+	}
+
+	return self.with(oldpath, func(fs Backend, rest string) error {
+		copier, ok := fs.(Copier)
+		if !ok {
+			return errors.ErrUnsupported
+		}
+		return copier.Copy(rest, newrest)
+	})
+}
+
+
+func (self *multiBackend) Mkdir(name string) error {
+	if err := self.top(name); nil != err {
+		return err
+	}
+	return self.with(name, func(fs Backend, rest string) error {
+		return fs.Mkdir(rest)
+	})
+}
+
+
+func (self *multiBackend) Chmod(name string, mode os.FileMode) error {
+	if err := self.top(name); nil != err {
+		return err
+	}
+	return self.with(name, func(fs Backend, rest string) error {
+		return fs.Chmod(rest, mode)
+	})
+}
+
+
+func (self *multiBackend) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := self.top(name); nil != err {
+		return err
+	}
+	return self.with(name, func(fs Backend, rest string) error {
+		return fs.Chtimes(rest, atime, mtime)
+	})
+}
+
+
+func (self *multiBackend) Symlink(target string, newpath string) error {
+	if err := self.top(newpath); nil != err {
+		return err
+	}
+	return self.with(newpath, func(fs Backend, rest string) error {
+		return fs.Symlink(target, rest)
+	})
+}
+
+
+func (self *multiBackend) Readlink(name string) (string, error) {
+	var target string
+	err := self.with(name, func(fs Backend, rest string) (err error) {
+		readlinker, ok := fs.(Readlinker)
+		if !ok {
+			return errors.ErrUnsupported
+		}
+		target, err = readlinker.Readlink(rest)
+		return
+	})
+	return target, err
+}
+
+
+func (self *multiBackend) StatVFS(name string, stat *fuse.Statfs_t) error {
+
+	if "/" != path.Clean("/" + name) {
+		return self.with(name, func(fs Backend, rest string) error {
+			return fs.StatVFS(rest, stat)
+		})
+	}
+
+	// nothing sensible to add up across servers
+	stat.Bsize = 4096
+	stat.Frsize = 4096
+	stat.Namemax = 255
+	return nil
+}
+
+
+func (self *multiBackend) Close() error {
+	close(self.stop)
+	for _, host := range self.hosts {
+		host.lock.Lock()
+		if nil != host.fs {
+			host.fs.Close()
+			host.fs = nil
+		}
+		host.lock.Unlock()
+	}
+	return nil
+}
+
+
+// File that keeps its host connected
+type multiFile struct {
+	File
+	host *multiHost
+	once sync.Once
+}
+
+
+func (self *multiFile) Sync() error {
+	if syncer, ok := self.File.(Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+
+func (self *multiFile) Close() error {
+	err := self.File.Close()
+	self.once.Do(self.host.release)
+	return err
+}
@@ -0,0 +1,236 @@
+/*
+ * offline.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+
+// File written while offline
+//
+// The full new content is kept in a local spool file. Base size and mtime
+// are the remote attributes the write started from; on replay a remote
+// file that no longer matches them is a conflict.
+type journalRecord struct {
+	Path      string
+	New       bool
+	BaseSize  int64
+	BaseMtime int64
+}
+
+
+// Local journal of offline writes, replayed on reconnect
+type offlineJournal struct {
+	dir  string
+	lock sync.Mutex
+}
+
+
+func openOfflineJournal(dir string) (*offlineJournal, error) {
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	self := &offlineJournal{}
+	self.dir = dir
+	return self, nil
+}
+
+
+func (self *offlineJournal) name(path string) string {
+	return filepath.Join(self.dir, cacheKey("", path))
+}
+
+
+// pending record for path, if any
+func (self *offlineJournal) Find(path string) (*journalRecord, bool) {
+
+	data, err := os.ReadFile(self.name(path) + ".json")
+	if nil != err {
+		return nil, false
+	}
+
+	rec := &journalRecord{}
+	if nil != json.Unmarshal(data, rec) {
+		return nil, false
+	}
+	return rec, true
+}
+
+
+// start (or continue) journaling path; returns the spool file
+func (self *offlineJournal) Begin(rec *journalRecord, trunc bool) (*os.File, error) {
+
+	defer self.synchronize()()
+
+	flags := os.O_RDWR | os.O_CREATE
+	if trunc {
+		flags |= os.O_TRUNC
+	}
+	spool, err := os.OpenFile(self.name(rec.Path)+".data", flags, 0600)
+	if nil != err {
+		return nil, err
+	}
+
+	// the first record for a path keeps its original base
+	if _, found := self.Find(rec.Path); !found {
+		data, _ := json.Marshal(rec)
+		err = writeSynced(self.name(rec.Path)+".json", data)
+		if nil != err {
+			spool.Close()
+			return nil, err
+		}
+	}
+	return spool, nil
+}
+
+
+func (self *offlineJournal) Records() []*journalRecord {
+
+	defer self.synchronize()()
+
+	var recs []*journalRecord
+	entries, _ := os.ReadDir(self.dir)
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(self.dir, entry.Name()))
+		if nil != err {
+			continue
+		}
+		rec := &journalRecord{}
+		if nil == json.Unmarshal(data, rec) {
+			recs = append(recs, rec)
+		}
+	}
+	return recs
+}
+
+
+func (self *offlineJournal) Done(rec *journalRecord) {
+	defer self.synchronize()()
+	os.Remove(self.name(rec.Path) + ".json")
+	os.Remove(self.name(rec.Path) + ".data")
+}
+
+
+// upload journaled files; conflicting ones are saved beside the original
+func (self *offlineJournal) Replay(fs Backend) (replayed []string) {
+
+	for _, rec := range self.Records() {
+
+		target := rec.Path
+		if conflict, reason := rec.conflicts(fs); conflict {
+			target = conflictName(rec.Path)
+			fmt.Printf("[conflict] %s: %s; saving offline changes as %s\n", rec.Path, reason, target)
+		}
+
+		err := self.upload(fs, rec, target)
+		if nil != err {
+			// keep the record for the next reconnect
+			fmt.Printf("replay %s: %s\n", rec.Path, err)
+			continue
+		}
+
+		fmt.Printf("replayed %s\n", target)
+		self.Done(rec)
+		replayed = append(replayed, rec.Path)
+	}
+	return
+}
+
+
+func (self *journalRecord) conflicts(fs Backend) (bool, string) {
+
+	info, err := fs.Stat(self.Path)
+	if self.New {
+		if nil == err {
+			return true, "created remotely"
+		}
+		return false, ""
+	}
+
+	if nil != err {
+		return true, "deleted remotely"
+	}
+	if info.Size() != self.BaseSize || info.ModTime().Unix() != self.BaseMtime {
+		return true, "modified remotely"
+	}
+	return false, ""
+}
+
+
+func (self *offlineJournal) upload(fs Backend, rec *journalRecord, target string) error {
+
+	spool, err := os.Open(self.name(rec.Path) + ".data")
+	if nil != err {
+		return err
+	}
+	defer spool.Close()
+
+	fp, err := fs.Open(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if nil != err {
+		return err
+	}
+
+	_, err = io.Copy(io.NewOffsetWriter(fp, 0), spool)
+	if cerr := fp.Close(); nil == err {
+		err = cerr
+	}
+	return err
+}
+
+
+// name.conflict-<host>-<time>
+func conflictName(path string) string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s.conflict-%s-%s", path, hostname, time.Now().Format("20060102-150405"))
+}
+
+
+// write a small file and make it durable before returning
+func writeSynced(name string, data []byte) error {
+
+	fp, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if nil != err {
+		return err
+	}
+
+	_, err = fp.Write(data)
+	if nil == err {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); nil == err {
+		err = cerr
+	}
+	return err
+}
+
+
+func (self *offlineJournal) synchronize() func() {
+	self.lock.Lock()
+	return func() {
+		self.lock.Unlock()
+	}
+}
@@ -0,0 +1,230 @@
+/*
+ * remote.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+
+const (
+	keepaliveInterval = 15 * time.Second
+	keepaliveTimeout  = 10 * time.Second
+	reconnectMax      = 30 * time.Second
+)
+
+
+var errOffline = errors.New("remote is offline")
+
+
+// SSH connection that reconnects in the background
+//
+// While the connection is down Client returns errOffline immediately
+// instead of blocking, so callers can fall back to cached data.
+type Remote struct {
+	addr   string
+	config *ssh.ClientConfig
+	lock   sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+	closed bool
+
+	// called after the connection has been re-established
+	onReconnect func()
+}
+
+
+func NewRemote(addr string, config *ssh.ClientConfig) *Remote {
+	self := &Remote{}
+	self.addr = addr
+	self.config = config
+	return self
+}
+
+
+func (self *Remote) Connect() error {
+
+	conn, err := ssh.Dial("tcp", self.addr, self.config)
+	if err != nil {
+		return err
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		conn.Close()
+		return errOffline
+	}
+	self.conn = conn
+	self.client = client
+	self.lock.Unlock()
+
+	go self.watch(conn)
+	return nil
+}
+
+
+func (self *Remote) Client() (*sftp.Client, error) {
+	defer self.synchronize()()
+	if nil == self.client {
+		return nil, errOffline
+	}
+	return self.client, nil
+}
+
+
+func (self *Remote) Conn() (*ssh.Client, error) {
+	defer self.synchronize()()
+	if nil == self.conn {
+		return nil, errOffline
+	}
+	return self.conn, nil
+}
+
+
+func (self *Remote) Online() bool {
+	defer self.synchronize()()
+	return nil != self.client
+}
+
+
+// the sftp client only closes its channel; the connection goes as well,
+// which ends its watch
+func (self *Remote) Close() {
+	self.lock.Lock()
+	self.closed = true
+	client := self.client
+	conn := self.conn
+	self.lock.Unlock()
+
+	if nil != client {
+		client.Close()
+	}
+	if nil != conn {
+		conn.Close()
+	}
+}
+
+
+func (self *Remote) OnReconnect(fn func()) {
+	defer self.synchronize()()
+	self.onReconnect = fn
+}
+
+
+// retry until connected; backs off up to reconnectMax
+func (self *Remote) Reconnect() {
+
+	delay := time.Second
+	for {
+		self.lock.Lock()
+		closed := self.closed
+		self.lock.Unlock()
+		if closed {
+			return
+		}
+
+		err := self.Connect()
+		if nil == err {
+			break
+		}
+		fmt.Printf("reconnect %s: %s\n", self.addr, err)
+
+		time.Sleep(delay)
+		if delay *= 2; delay > reconnectMax {
+			delay = reconnectMax
+		}
+	}
+
+	fmt.Printf("reconnected to %s\n", self.addr)
+	self.lock.Lock()
+	fn := self.onReconnect
+	self.lock.Unlock()
+	if nil != fn {
+		fn()
+	}
+}
+
+
+// keepalive a connection and go offline when it drops or stops answering
+func (self *Remote) watch(conn *ssh.Client) {
+
+	done := make(chan struct{})
+	go func() {
+		conn.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(keepaliveInterval)
+loop:
+	for {
+		select {
+		case <-done:
+			break loop
+		case <-ticker.C:
+			if !keepalive(conn) {
+				conn.Close()
+			}
+		}
+	}
+	ticker.Stop()
+
+	self.lock.Lock()
+	if self.conn == conn {
+		self.conn = nil
+		self.client = nil
+	}
+	closed := self.closed
+	self.lock.Unlock()
+
+	if !closed {
+		fmt.Printf("connection to %s lost\n", self.addr)
+		self.Reconnect()
+	}
+}
+
+
+func keepalive(conn *ssh.Client) bool {
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+		reply <- err
+	}()
+
+	select {
+	case err := <-reply:
+		return nil == err
+	case <-time.After(keepaliveTimeout):
+		return false
+	}
+}
+
+
+func (self *Remote) synchronize() func() {
+	self.lock.Lock()
+	return func() {
+		self.lock.Unlock()
+	}
+}
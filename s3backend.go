@@ -0,0 +1,377 @@
+/*
+ * s3backend.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// multipart upload part size
+const s3PartSize = 16 * 1024 * 1024
+
+
+// Backend over an S3-compatible bucket
+//
+// Directories are emulated with "/" delimited key prefixes; Mkdir stores an
+// empty "dir/" marker object so empty directories survive. Reads are ranged
+// GETs. Writes go to a local spool file (seeded with the object when it
+// isn't truncated) which is uploaded, multipart when large, on Sync and
+// Close. Rename is copy plus delete and so is not atomic; renaming a
+// directory copies every object below it.
+type s3Backend struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+
+func newS3Backend(endpoint string, access string, secret string, secure bool, region string, bucket string, prefix string) (*s3Backend, error) {
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(access, secret, ""),
+		Secure: secure,
+		Region: region,
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	exists, err := client.BucketExists(context.Background(), bucket)
+	if nil != err {
+		return nil, s3Error(err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("bucket %s: %w", bucket, os.ErrNotExist)
+	}
+
+	self := &s3Backend{}
+	self.client = client
+	self.bucket = bucket
+	self.prefix = strings.Trim(prefix, "/")
+	if "" != self.prefix {
+		self.prefix += "/"
+	}
+	return self, nil
+}
+
+
+// object key of a path
+func (self *s3Backend) key(name string) string {
+	return self.prefix + strings.TrimPrefix(path.Clean(name), "/")
+}
+
+
+// key prefix of the entries of a directory
+func (self *s3Backend) dirKey(name string) string {
+	key := self.key(name)
+	if "/" == path.Clean(name) {
+		return self.prefix
+	}
+	return key + "/"
+}
+
+
+func s3Error(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchBucket":
+		return fmt.Errorf("%s: %w", err, os.ErrNotExist)
+	case "AccessDenied":
+		return fmt.Errorf("%s: %w", err, os.ErrPermission)
+	case "NotImplemented":
+		return fmt.Errorf("%s: %w", err, errors.ErrUnsupported)
+	}
+	return err
+}
+
+
+func (self *s3Backend) Stat(name string) (os.FileInfo, error) {
+
+	// stops the listing when we return early
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if "/" == path.Clean(name) {
+		return &fileInfo{"/", 0, fs.ModeDir | 0755, time.Time{}, ""}, nil
+	}
+
+	obj, err := self.client.StatObject(ctx, self.bucket, self.key(name), minio.StatObjectOptions{})
+	if nil == err {
+		return &fileInfo{path.Base(name), obj.Size, 0644, obj.LastModified, ""}, nil
+	}
+	if !errors.Is(s3Error(err), os.ErrNotExist) {
+		return nil, s3Error(err)
+	}
+
+	// a directory is any prefix with something below it
+	for obj := range self.client.ListObjects(ctx, self.bucket, minio.ListObjectsOptions{Prefix: self.dirKey(name), MaxKeys: 1}) {
+		if nil != obj.Err {
+			return nil, s3Error(obj.Err)
+		}
+		return &fileInfo{path.Base(name), 0, fs.ModeDir | 0755, obj.LastModified, ""}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+
+func (self *s3Backend) Lstat(name string) (os.FileInfo, error) {
+	return self.Stat(name)
+}
+
+
+func (self *s3Backend) ReadDir(name string) ([]os.FileInfo, error) {
+
+	prefix := self.dirKey(name)
+
+	var infos []os.FileInfo
+	for obj := range self.client.ListObjects(context.Background(), self.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if nil != obj.Err {
+			return nil, s3Error(obj.Err)
+		}
+
+		rest := strings.TrimPrefix(obj.Key, prefix)
+		switch {
+		case "" == rest:
+			// the directory's own marker
+		case strings.HasSuffix(rest, "/"):
+			infos = append(infos, &fileInfo{strings.TrimSuffix(rest, "/"), 0, fs.ModeDir | 0755, obj.LastModified, ""})
+		default:
+			infos = append(infos, &fileInfo{rest, obj.Size, 0644, obj.LastModified, ""})
+		}
+	}
+
+	if nil == infos && "/" != path.Clean(name) {
+		// nothing below it: the directory exists only if it has a marker
+		if _, err := self.Stat(name); nil != err {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+
+func (self *s3Backend) Open(name string, flags int) (File, error) {
+
+	fp := self.file(self.key(name), path.Base(name))
+
+	info, err := self.Stat(name)
+	switch {
+	case nil == err && info.IsDir():
+		return nil, fmt.Errorf("%s is a directory: %w", name, os.ErrInvalid)
+	case nil == err && 0 != flags&os.O_CREATE && 0 != flags&os.O_EXCL:
+		return nil, os.ErrExist
+	case nil == err:
+		fp.size = info.Size()
+		fp.mtime = info.ModTime()
+	case !errors.Is(err, os.ErrNotExist) || 0 == flags&os.O_CREATE:
+		return nil, err
+	}
+
+	if 0 != flags&(os.O_WRONLY|os.O_RDWR) && (nil != err || 0 != flags&os.O_TRUNC) {
+		err = fp.Truncate(0)
+		if nil == err {
+			err = fp.Sync()
+		}
+		if nil != err {
+			fp.Close()
+			return nil, err
+		}
+	}
+	return fp, nil
+}
+
+
+// object content behind a spool; reads are ranged GETs
+func (self *s3Backend) file(key string, name string) *spoolFile {
+
+	ctx := context.Background()
+
+	fp := &spoolFile{}
+	fp.name = name
+	fp.read = func(buff []byte, ofst int64) error {
+		opts := minio.GetObjectOptions{}
+		opts.SetRange(ofst, ofst + int64(len(buff)) - 1)
+		obj, err := self.client.GetObject(ctx, self.bucket, key, opts)
+		if nil != err {
+			return s3Error(err)
+		}
+		defer obj.Close()
+		_, err = io.ReadFull(obj, buff)
+		return s3Error(err)
+	}
+	fp.fetch = func(w io.Writer) error {
+		obj, err := self.client.GetObject(ctx, self.bucket, key, minio.GetObjectOptions{})
+		if nil != err {
+			return s3Error(err)
+		}
+		defer obj.Close()
+		_, err = io.Copy(w, obj)
+		return s3Error(err)
+	}
+	fp.upload = func(r io.Reader, size int64) (time.Time, error) {
+		// multipart above the part size
+		info, err := self.client.PutObject(ctx, self.bucket, key, r, size, minio.PutObjectOptions{PartSize: s3PartSize})
+		return info.LastModified, s3Error(err)
+	}
+	return fp
+}
+
+
+func (self *s3Backend) Create(name string) (File, error) {
+	return self.Open(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+
+func (self *s3Backend) Remove(name string) error {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	info, err := self.Stat(name)
+	if nil != err {
+		return err
+	}
+	if !info.IsDir() {
+		return s3Error(self.client.RemoveObject(ctx, self.bucket, self.key(name), minio.RemoveObjectOptions{}))
+	}
+
+	prefix := self.dirKey(name)
+	for obj := range self.client.ListObjects(ctx, self.bucket, minio.ListObjectsOptions{Prefix: prefix, MaxKeys: 2}) {
+		if nil != obj.Err {
+			return s3Error(obj.Err)
+		}
+		if prefix != obj.Key {
+			return fmt.Errorf("%s: directory not empty: %w", name, os.ErrExist)
+		}
+	}
+	return s3Error(self.client.RemoveObject(ctx, self.bucket, prefix, minio.RemoveObjectOptions{}))
+}
+
+
+func (self *s3Backend) Rename(oldpath string, newpath string) error {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	info, err := self.Stat(oldpath)
+	if nil != err {
+		return err
+	}
+	if !info.IsDir() {
+		return self.move(ctx, self.key(oldpath), self.key(newpath))
+	}
+
+	oldprefix := self.dirKey(oldpath)
+	newprefix := self.dirKey(newpath)
+	for obj := range self.client.ListObjects(ctx, self.bucket, minio.ListObjectsOptions{Prefix: oldprefix, Recursive: true}) {
+		if nil != obj.Err {
+			return s3Error(obj.Err)
+		}
+		err = self.move(ctx, obj.Key, newprefix + strings.TrimPrefix(obj.Key, oldprefix))
+		if nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+
+// server side copy then delete
+func (self *s3Backend) move(ctx context.Context, src string, dst string) error {
+
+	err := self.copy(ctx, src, dst)
+	if nil != err {
+		return err
+	}
+	return s3Error(self.client.RemoveObject(ctx, self.bucket, src, minio.RemoveObjectOptions{}))
+}
+
+
+// composed, so objects over 5 GiB work
+func (self *s3Backend) copy(ctx context.Context, src string, dst string) error {
+	_, err := self.client.ComposeObject(ctx,
+		minio.CopyDestOptions{Bucket: self.bucket, Object: dst},
+		minio.CopySrcOptions{Bucket: self.bucket, Object: src})
+	return s3Error(err)
+}
+
+
+// server side copy of a file
+func (self *s3Backend) Copy(oldpath string, newpath string) error {
+
+	info, err := self.Stat(oldpath)
+	if nil != err {
+		return err
+	}
+	if info.IsDir() {
+		return errors.ErrUnsupported
+	}
+	return self.copy(context.Background(), self.key(oldpath), self.key(newpath))
+}
+
+
+func (self *s3Backend) Mkdir(name string) error {
+
+	if _, err := self.Stat(name); nil == err {
+		return os.ErrExist
+	}
+	_, err := self.client.PutObject(context.Background(), self.bucket, self.dirKey(name), strings.NewReader(""), 0, minio.PutObjectOptions{})
+	return s3Error(err)
+}
+
+
+func (self *s3Backend) Chmod(name string, mode os.FileMode) error {
+	return errors.ErrUnsupported
+}
+
+
+func (self *s3Backend) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	// LastModified is set by the server on upload
+	return errors.ErrUnsupported
+}
+
+
+func (self *s3Backend) Symlink(target string, newpath string) error {
+	return errors.ErrUnsupported
+}
+
+
+// buckets have no capacity; report a large, mostly free volume
+func (self *s3Backend) StatVFS(name string, stat *fuse.Statfs_t) error {
+	stat.Bsize = 4096
+	stat.Frsize = 4096
+	stat.Blocks = 1 << 40 / 4096
+	stat.Bfree = stat.Blocks
+	stat.Bavail = stat.Blocks
+	stat.Files = 1 << 32
+	stat.Ffree = stat.Files
+	stat.Favail = stat.Files
+	stat.Namemax = 1024
+	return nil
+}
+
+
+func (self *s3Backend) Close() error {
+	return nil
+}
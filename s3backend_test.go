@@ -0,0 +1,532 @@
+/*
+ * s3backend_test.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// the part of the S3 API minio-go uses, for one bucket, counting
+// requests by kind
+type testS3Server struct {
+	*httptest.Server
+	bucket   string
+	lock     sync.Mutex
+	objects  map[string][]byte
+	mtimes   map[string]time.Time
+	uploads  map[string]map[int][]byte
+	requests map[string]int
+}
+
+
+type s3ListResult struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Name           string
+	Prefix         string
+	Delimiter      string
+	KeyCount       int
+	MaxKeys        int
+	IsTruncated    bool
+	Contents       []s3ListObject
+	CommonPrefixes []s3ListPrefix
+}
+
+
+type s3ListObject struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+}
+
+
+type s3ListPrefix struct {
+	Prefix string
+}
+
+
+func newTestS3Server(t *testing.T) *testS3Server {
+	self := &testS3Server{}
+	self.bucket = "bucket"
+	self.objects = make(map[string][]byte)
+	self.mtimes = make(map[string]time.Time)
+	self.uploads = make(map[string]map[int][]byte)
+	self.requests = make(map[string]int)
+	self.Server = httptest.NewServer(http.HandlerFunc(self.serve))
+	t.Cleanup(self.Close)
+	return self
+}
+
+
+func (self *testS3Server) backend(t *testing.T, prefix string) *s3Backend {
+	u, _ := url.Parse(self.URL)
+	fs, err := newS3Backend(u.Host, "access", "secret", false, "us-east-1", self.bucket, prefix)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+
+func (self *testS3Server) count(kind string) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.requests[kind]
+}
+
+
+func (self *testS3Server) keys() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var keys []string
+	for key := range self.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+
+func s3ETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+
+// request body without the aws-chunked framing of streaming signatures
+func s3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	var data []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if nil != err {
+			return nil, err
+		}
+		size, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if nil != err {
+			return nil, err
+		}
+		if 0 == n {
+			return data, nil
+		}
+		chunk := make([]byte, n + 2)
+		if _, err = io.ReadFull(br, chunk); nil != err {
+			return nil, err
+		}
+		data = append(data, chunk[:n]...)
+	}
+}
+
+
+func (self *testS3Server) serve(w http.ResponseWriter, r *http.Request) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != self.bucket {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+
+	var kind string
+	switch {
+	case "" == key && "HEAD" == r.Method:
+		kind = "bucket"
+	case "" == key && "GET" == r.Method:
+		kind = "list"
+	case "PUT" == r.Method && "" != r.Header.Get("X-Amz-Copy-Source"):
+		// whole, or a part of a multipart copy
+		kind = "copy"
+	case "POST" == r.Method && query.Has("uploads"):
+		kind = "create-multipart"
+	case "PUT" == r.Method && query.Has("uploadId"):
+		kind = "part"
+	case "POST" == r.Method && query.Has("uploadId"):
+		kind = "complete-multipart"
+	case "GET" == r.Method && "" != r.Header.Get("Range"):
+		kind = "ranged-get"
+	default:
+		kind = r.Method
+	}
+	self.requests[kind]++
+
+	switch kind {
+	case "bucket":
+
+	case "list":
+		prefix := query.Get("prefix")
+		delimiter := query.Get("delimiter")
+		result := &s3ListResult{Name: bucket, Prefix: prefix, Delimiter: delimiter, MaxKeys: 1000}
+		seen := make(map[string]bool)
+		var keys []string
+		for key := range self.objects {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			if i := strings.Index(key[len(prefix):], delimiter); "" != delimiter && -1 != i {
+				common := key[:len(prefix) + i + len(delimiter)]
+				if !seen[common] {
+					seen[common] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, s3ListPrefix{common})
+				}
+				continue
+			}
+			result.Contents = append(result.Contents, s3ListObject{key,
+				self.mtimes[key].UTC().Format("2006-01-02T15:04:05.000Z"),
+				s3ETag(self.objects[key]), int64(len(self.objects[key]))})
+		}
+		result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(result)
+
+	case "HEAD", "GET", "ranged-get":
+		data, ok := self.objects[key]
+		if !ok {
+			if "HEAD" == kind {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "<Error><Code>NoSuchKey</Code><Key>%s</Key></Error>", key)
+			return
+		}
+		w.Header().Set("ETag", s3ETag(data))
+		w.Header().Set("Last-Modified", self.mtimes[key].UTC().Format(http.TimeFormat))
+		// ServeContent answers the Range header with 206 and Content-Range
+		http.ServeContent(w, r, "", self.mtimes[key], bytes.NewReader(data))
+
+	case "PUT":
+		data, err := s3Body(r)
+		if nil != err {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		self.objects[key] = data
+		self.mtimes[key] = time.Now()
+		w.Header().Set("ETag", s3ETag(data))
+
+	case "copy":
+		src, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		_, src, _ = strings.Cut(strings.TrimPrefix(src, "/"), "/")
+		data, ok := self.objects[src]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "<Error><Code>NoSuchKey</Code><Key>%s</Key></Error>", src)
+			return
+		}
+		mtime := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+		w.Header().Set("Content-Type", "application/xml")
+		if parts, ok := self.uploads[query.Get("uploadId")]; ok {
+			var start, end int
+			fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end)
+			number, _ := strconv.Atoi(query.Get("partNumber"))
+			parts[number] = data[start:end + 1]
+			fmt.Fprintf(w, "<CopyPartResult><ETag>%s</ETag><LastModified>%s</LastModified></CopyPartResult>",
+				s3ETag(parts[number]), mtime)
+			return
+		}
+		self.objects[key] = data
+		self.mtimes[key] = time.Now()
+		fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag><LastModified>%s</LastModified></CopyObjectResult>",
+			s3ETag(data), mtime)
+
+	case "DELETE":
+		delete(self.objects, key)
+		delete(self.mtimes, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	case "create-multipart":
+		id := strconv.Itoa(self.requests[kind])
+		self.uploads[id] = make(map[int][]byte)
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>",
+			bucket, key, id)
+
+	case "part":
+		parts, ok := self.uploads[query.Get("uploadId")]
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		data, err := s3Body(r)
+		if !ok || nil != err {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		parts[number] = data
+		w.Header().Set("ETag", s3ETag(data))
+
+	case "complete-multipart":
+		parts, ok := self.uploads[query.Get("uploadId")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var data []byte
+		for number := 1; number <= len(parts); number++ {
+			data = append(data, parts[number]...)
+		}
+		delete(self.uploads, query.Get("uploadId"))
+		self.objects[key] = data
+		self.mtimes[key] = time.Now()
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>",
+			bucket, key, s3ETag(data))
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+
+func TestS3Dirs(t *testing.T) {
+
+	server := newTestS3Server(t)
+	fs := server.backend(t, "prefix")
+
+	err := fs.Mkdir("/dir")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if err = fs.Mkdir("/dir"); !errors.Is(err, os.ErrExist) {
+		t.Errorf("second mkdir got %v", err)
+	}
+	writeDav(t, fs, "/dir/file.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, "hello", 0)
+	// no markers: the directories exist because of the object below them
+	writeDav(t, fs, "/a/b/c.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, "deep", 0)
+
+	if keys := strings.Join(server.keys(), ","); "prefix/a/b/c.txt,prefix/dir/,prefix/dir/file.txt" != keys {
+		t.Errorf("objects %s", keys)
+	}
+
+	for _, name := range []string{"/dir", "/a", "/a/b"} {
+		info, err := fs.Stat(name)
+		if nil != err || !info.IsDir() {
+			t.Errorf("stat of %s got %v, %v", name, info, err)
+		}
+	}
+	info, err := fs.Stat("/dir/file.txt")
+	if nil != err || info.IsDir() || 5 != info.Size() {
+		t.Errorf("stat of file got %v, %v", info, err)
+	}
+	if _, err = fs.Stat("/missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stat of missing got %v", err)
+	}
+	if _, err = fs.Open("/dir", os.O_RDONLY); nil == err {
+		t.Error("opened a directory")
+	}
+
+	listing := func(name string) string {
+		infos, err := fs.ReadDir(name)
+		if nil != err {
+			return err.Error()
+		}
+		var names []string
+		for _, info := range infos {
+			if info.IsDir() {
+				names = append(names, info.Name() + "/")
+			} else {
+				names = append(names, info.Name())
+			}
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+	if got := listing("/"); "a/,dir/" != got {
+		t.Errorf("root listing got %s", got)
+	}
+	if got := listing("/dir"); "file.txt" != got {
+		t.Errorf("dir listing got %s", got)
+	}
+	if _, err = fs.ReadDir("/missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("listing of missing got %v", err)
+	}
+
+	if err = fs.Remove("/dir"); !errors.Is(err, os.ErrExist) {
+		t.Errorf("remove of full directory got %v", err)
+	}
+	for _, name := range []string{"/dir/file.txt", "/dir"} {
+		if err = fs.Remove(name); nil != err {
+			t.Errorf("remove %s: %s", name, err)
+		}
+	}
+	if _, err = fs.Stat("/dir"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stat after remove got %v", err)
+	}
+}
+
+
+func TestS3Read(t *testing.T) {
+
+	server := newTestS3Server(t)
+	fs := server.backend(t, "")
+	content := strings.Repeat("0123456789", 1000)
+	writeDav(t, fs, "/file.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, content, 0)
+
+	fp, err := fs.Open("/file.txt", os.O_RDONLY)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	buff := make([]byte, 16)
+	n, err := fp.ReadAt(buff, 1234)
+	if nil != err || 16 != n || content[1234:1250] != string(buff) {
+		t.Errorf("read got %q, %v", buff[:n], err)
+	}
+	n, err = fp.ReadAt(buff, int64(len(content)) - 5)
+	if io.EOF != err || 5 != n || content[len(content)-5:] != string(buff[:n]) {
+		t.Errorf("read at the end got %q, %v", buff[:n], err)
+	}
+	if 2 != server.count("ranged-get") || 0 != server.count("GET") {
+		t.Errorf("%d ranged and %d full GETs for two reads", server.count("ranged-get"), server.count("GET"))
+	}
+
+	// changing the middle fetches the object once and puts it back whole
+	writeDav(t, fs, "/file.txt", os.O_RDWR, "abc", 10)
+	if data, err := readBackendFile(fs, "/file.txt"); nil != err || "0123456789abc3456789" != string(data[:20]) || len(content) != len(data) {
+		t.Errorf("got %q, %v", data[:20], err)
+	}
+}
+
+
+func TestS3Multipart(t *testing.T) {
+
+	server := newTestS3Server(t)
+	fs := server.backend(t, "")
+
+	content := make([]byte, s3PartSize + 4096)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	fp, err := fs.Open("/big", os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if nil != err {
+		t.Fatal(err)
+	}
+	// buffered in pieces; nothing goes up before the close
+	for ofst := 0; ofst < len(content); ofst += 1 << 20 {
+		end := min(ofst + 1 << 20, len(content))
+		if _, err = fp.WriteAt(content[ofst:end], int64(ofst)); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if 0 != server.count("create-multipart") {
+		t.Error("upload started before the close")
+	}
+	err = fp.Close()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if 1 != server.count("create-multipart") || 2 != server.count("part") || 1 != server.count("complete-multipart") {
+		t.Errorf("%d uploads, %d parts, %d completions", server.count("create-multipart"), server.count("part"), server.count("complete-multipart"))
+	}
+	data, err := readBackendFile(fs, "/big")
+	if nil != err || !bytes.Equal(content, data) {
+		t.Errorf("read back %d bytes, %v", len(data), err)
+	}
+}
+
+
+func TestS3Rename(t *testing.T) {
+
+	server := newTestS3Server(t)
+	fs := server.backend(t, "")
+	writeDav(t, fs, "/file.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, "one", 0)
+	err := fs.Mkdir("/dir")
+	if nil != err {
+		t.Fatal(err)
+	}
+	writeDav(t, fs, "/dir/a", os.O_RDWR|os.O_CREATE|os.O_TRUNC, "a", 0)
+	writeDav(t, fs, "/dir/sub/b", os.O_RDWR|os.O_CREATE|os.O_TRUNC, "b", 0)
+
+	err = fs.Rename("/file.txt", "/moved.txt")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != server.count("copy") || 1 != server.count("DELETE") {
+		t.Errorf("file rename took %d copies, %d deletes", server.count("copy"), server.count("DELETE"))
+	}
+	if data, err := readBackendFile(fs, "/moved.txt"); nil != err || "one" != string(data) {
+		t.Errorf("got %q, %v", data, err)
+	}
+	if _, err = fs.Stat("/file.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("old name got %v", err)
+	}
+
+	// every object below the directory, marker included
+	err = fs.Rename("/dir", "/new")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if keys := strings.Join(server.keys(), ","); "moved.txt,new/,new/a,new/sub/b" != keys {
+		t.Errorf("objects %s", keys)
+	}
+	if 4 != server.count("copy") || 4 != server.count("DELETE") {
+		t.Errorf("renames took %d copies, %d deletes", server.count("copy"), server.count("DELETE"))
+	}
+	if data, err := readBackendFile(fs, "/new/sub/b"); nil != err || "b" != string(data) {
+		t.Errorf("got %q, %v", data, err)
+	}
+
+	if err = fs.Rename("/missing", "/other"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("rename of missing got %v", err)
+	}
+}
+
+
+func TestS3StatVFS(t *testing.T) {
+
+	server := newTestS3Server(t)
+	fs := server.backend(t, "")
+
+	stat := &fuse.Statfs_t{}
+	err := fs.StatVFS("/", stat)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 4096 != stat.Bsize || 4096 != stat.Frsize || 1 << 40 / 4096 != stat.Blocks ||
+		stat.Blocks != stat.Bfree || stat.Blocks != stat.Bavail ||
+		1 << 32 != stat.Files || stat.Files != stat.Ffree || 1024 != stat.Namemax {
+		t.Errorf("statfs got %+v", stat)
+	}
+}
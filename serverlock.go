@@ -0,0 +1,399 @@
+/*
+ * serverlock.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+
+// suffix of the lock file next to a locked file
+const serverLockSuffix = ".sshfs-lock"
+
+
+var errLocked = errors.New("locked by someone else")
+
+
+// Locks other mounts can see, held as long as the lease is renewed
+//
+// A backend with its own locks (Locker) gets asked directly. Otherwise
+// the lock is a file ".name.sshfs-lock" created exclusively next to the
+// file, holding its owner and when the lease runs out in Unix milliseconds;
+// a lock whose lease ran out belongs to a mount that went away and is
+// broken. Leases are renewed at a third of their length. Lock files can't
+// be shared, so shared locks are taken exclusively there; clocks are
+// assumed to agree to well within a lease.
+//
+// Acquire and Release are counted per path; the lock goes when the last
+// holder in this mount lets go.
+type serverLocks struct {
+	fs    Backend
+	lease time.Duration
+	id    string
+	ops   sync.Mutex // one Acquire, Release or Rename at a time
+	lock  sync.Mutex
+	held  map[string]*serverLock
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+
+type serverLock struct {
+	exclusive bool
+	count     int
+}
+
+
+func newServerLocks(fs Backend, lease time.Duration) *serverLocks {
+
+	host, _ := os.Hostname()
+	nonce := make([]byte, 4)
+	rand.Read(nonce)
+
+	self := &serverLocks{}
+	self.fs = fs
+	self.lease = lease
+	self.id = fmt.Sprintf("%s:%d:%s", host, os.Getpid(), hex.EncodeToString(nonce))
+	self.held = make(map[string]*serverLock)
+	self.stop = make(chan struct{})
+	self.done = make(chan struct{})
+	go self.renew()
+	return self
+}
+
+
+func serverLockName(name string) string {
+	return path.Join(path.Dir(name), "." + path.Base(name) + serverLockSuffix)
+}
+
+
+func isServerLockName(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, serverLockSuffix)
+}
+
+
+func (self *serverLocks) Acquire(name string, exclusive bool) error {
+
+	self.ops.Lock()
+	defer self.ops.Unlock()
+
+	_, locker := self.fs.(Locker)
+	self.lock.Lock()
+	held, found := self.held[name]
+	self.lock.Unlock()
+	if found && (held.exclusive || !exclusive || !locker) {
+		self.lock.Lock()
+		held.count++
+		self.lock.Unlock()
+		return nil
+	}
+
+	// new, or shared turning exclusive
+	err := self.take(name, exclusive)
+	if nil != err {
+		return err
+	}
+	self.lock.Lock()
+	if !found {
+		held = &serverLock{}
+		self.held[name] = held
+	}
+	held.exclusive = exclusive
+	held.count++
+	self.lock.Unlock()
+	return nil
+}
+
+
+func (self *serverLocks) take(name string, exclusive bool) error {
+
+	if locker, ok := self.fs.(Locker); ok {
+		err := locker.Lock(name, exclusive)
+		if errors.Is(err, os.ErrPermission) {
+			// 423 Locked and friends
+			return fmt.Errorf("%s: %w", name, errLocked)
+		}
+		return err
+	}
+
+	lockName := serverLockName(name)
+	for attempt := 0; attempt < 2; attempt++ {
+		fp, err := self.fs.Open(lockName, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+		if nil == err {
+			_, err = fp.WriteAt(self.content(), 0)
+			if cerr := fp.Close(); nil == err {
+				err = cerr
+			}
+			if nil != err {
+				self.fs.Remove(lockName)
+			}
+			return err
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return err
+		}
+
+		owner, expires, err := self.read(lockName)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if nil != err {
+			return err
+		}
+		if owner != self.id && time.Now().Before(expires) {
+			return fmt.Errorf("%s: held by %s until %s: %w", name, owner, expires.Format(time.RFC3339), errLocked)
+		}
+		// ours from before, or stale
+		err = self.breakLock(lockName, owner, expires)
+		if nil != err {
+			return err
+		}
+	}
+	return fmt.Errorf("%s: %w", name, errLocked)
+}
+
+
+// remove a stale lock; removing it in place could remove the lock another
+// mount breaking it just took, so it is renamed aside first and removed
+// only if it is still the one we looked at
+func (self *serverLocks) breakLock(lockName string, owner string, expires time.Time) error {
+
+	nonce := make([]byte, 4)
+	rand.Read(nonce)
+	broken := strings.TrimSuffix(lockName, serverLockSuffix) + "." + hex.EncodeToString(nonce) + serverLockSuffix
+
+	err := self.fs.Rename(lockName, broken)
+	if errors.Is(err, os.ErrNotExist) {
+		// someone else broke it first
+		return nil
+	}
+	if nil != err {
+		return err
+	}
+
+	movedOwner, movedExpires, err := self.read(broken)
+	if nil == err && (movedOwner != owner || !movedExpires.Equal(expires)) {
+		// taken or renewed since we looked; give it back
+		if err = self.fs.Rename(broken, lockName); nil != err {
+			return err
+		}
+		return fmt.Errorf("%s: held by %s until %s: %w", lockName, movedOwner, movedExpires.Format(time.RFC3339), errLocked)
+	}
+
+	fmt.Printf("breaking lock %s of %s\n", lockName, owner)
+	err = self.fs.Remove(broken)
+	if nil != err && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+
+func (self *serverLocks) content() []byte {
+	expires := time.Now().Add(self.lease).UnixMilli()
+	return []byte(self.id + " " + strconv.FormatInt(expires, 10) + "\n")
+}
+
+
+func (self *serverLocks) read(lockName string) (string, time.Time, error) {
+
+	data, err := readBackendFile(self.fs, lockName)
+	if nil != err {
+		return "", time.Time{}, err
+	}
+	fields := strings.Fields(string(data))
+	if 2 != len(fields) {
+		// half written; give its owner a lease to finish
+		info, err := self.fs.Stat(lockName)
+		if nil != err {
+			return "", time.Time{}, err
+		}
+		return "?", info.ModTime().Add(self.lease), nil
+	}
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if nil != err {
+		return "", time.Time{}, fmt.Errorf("%s: %w", lockName, err)
+	}
+	return fields[0], time.UnixMilli(expires), nil
+}
+
+
+func (self *serverLocks) Release(name string) {
+
+	self.ops.Lock()
+	defer self.ops.Unlock()
+
+	self.lock.Lock()
+	held, found := self.held[name]
+	if found {
+		held.count--
+	}
+	last := found && 0 == held.count
+	if last {
+		delete(self.held, name)
+	}
+	self.lock.Unlock()
+	if !last {
+		return
+	}
+	self.drop(name)
+}
+
+
+func (self *serverLocks) drop(name string) {
+
+	if locker, ok := self.fs.(Locker); ok {
+		if err := locker.Unlock(name); nil != err {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	lockName := serverLockName(name)
+	owner, _, err := self.read(lockName)
+	if nil == err && owner != self.id {
+		// broken and taken over while we weren't renewing
+		fmt.Printf("lock %s went to %s\n", lockName, owner)
+		return
+	}
+	err = self.fs.Remove(lockName)
+	if nil != err && !errors.Is(err, os.ErrNotExist) {
+		fmt.Println(err)
+	}
+}
+
+
+// the locked file moved; its lock moves along
+func (self *serverLocks) Rename(oldpath string, newpath string) {
+
+	self.ops.Lock()
+	defer self.ops.Unlock()
+
+	self.lock.Lock()
+	held, found := self.held[oldpath]
+	delete(self.held, oldpath)
+	self.lock.Unlock()
+	if !found {
+		return
+	}
+
+	self.drop(oldpath)
+	if err := self.take(newpath, held.exclusive); nil != err {
+		fmt.Println(err)
+		return
+	}
+	self.lock.Lock()
+	self.held[newpath] = held
+	self.lock.Unlock()
+}
+
+
+func (self *serverLocks) renew() {
+
+	defer close(self.done)
+
+	ticker := time.NewTicker(self.lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-ticker.C:
+		}
+
+		self.lock.Lock()
+		var names []string
+		for name := range self.held {
+			names = append(names, name)
+		}
+		self.lock.Unlock()
+
+		for _, name := range names {
+			if err := self.refresh(name); nil != err {
+				fmt.Printf("renewing lock of %s: %s\n", name, err)
+			}
+		}
+	}
+}
+
+
+func (self *serverLocks) refresh(name string) error {
+
+	self.ops.Lock()
+	defer self.ops.Unlock()
+
+	self.lock.Lock()
+	held, found := self.held[name]
+	self.lock.Unlock()
+	if !found {
+		// released meanwhile
+		return nil
+	}
+
+	if locker, ok := self.fs.(Locker); ok {
+		return locker.Lock(name, held.exclusive)
+	}
+
+	lockName := serverLockName(name)
+	owner, _, err := self.read(lockName)
+	if errors.Is(err, os.ErrNotExist) {
+		// someone removed it; take it again if nobody else has
+		return self.take(name, held.exclusive)
+	}
+	if nil != err {
+		return err
+	}
+	if owner != self.id {
+		return fmt.Errorf("taken over by %s", owner)
+	}
+
+	// same length every time, so no truncating that readers could catch
+	fp, err := self.fs.Open(lockName, os.O_WRONLY)
+	if nil != err {
+		return err
+	}
+	_, err = fp.WriteAt(self.content(), 0)
+	if cerr := fp.Close(); nil == err {
+		err = cerr
+	}
+	return err
+}
+
+
+// release everything, as unmounting does
+func (self *serverLocks) Close() {
+
+	close(self.stop)
+	<-self.done
+
+	self.lock.Lock()
+	var names []string
+	for name := range self.held {
+		names = append(names, name)
+	}
+	self.held = make(map[string]*serverLock)
+	self.lock.Unlock()
+
+	for _, name := range names {
+		self.drop(name)
+	}
+}
@@ -1,3 +1,5 @@
+//go:build sftpfs
+
 /*
  * hellofs.go
  *
@@ -20,7 +22,6 @@ import (
 	//"log"
 
 
-	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -30,7 +31,7 @@ import (
 
 type Sftpfs struct {
 	fuse.FileSystemBase
-	client *sftp.Client
+	fs Backend
 }
 
 
@@ -54,7 +55,7 @@ func (self *Sftpfs) Getattr(path string, stat *fuse.Stat_t, fh uint64) (errc int
 		return 0	
 	} else {
 	
-		info, err := self.client.Stat(path)
+		info, err := self.fs.Stat(path)
 		if err != nil {
 			fmt.Println(err)
 			return -fuse.ENOENT
@@ -96,7 +97,7 @@ func (self *Sftpfs) Readdir(path string, fill func(name string, stat *fuse.Stat_
 	fill("..", nil, 0)
 	
 	// update nodes
-	entries, err := self.client.ReadDir(path)
+	entries, err := self.fs.ReadDir(path)
 	if err != nil {
 		fmt.Println(err)
 	} else {
@@ -122,17 +123,13 @@ func main() {
 		//Ciphers: []string{"3des-cbc", "aes256-cbc", "aes192-cbc", "aes128-cbc"},
 	}
 	
-	conn, err := ssh.Dial("tcp", addr, config)
+	remote := NewRemote(addr, config)
+	err := remote.Connect()
 	if err != nil {
 		panic("Failed to dial: " + err.Error())
 	}
-	
-	client, err := sftp.NewClient(conn)
-	if err != nil {
-		panic("Failed to create client: " + err.Error())
-	}
 
-	sftpfs.client = client
+	sftpfs.fs = newSftpBackend(remote)
 
 
 	host := fuse.NewFileSystemHost(sftpfs)
@@ -144,5 +141,5 @@ func main() {
 	
 	
 	// done
-	client.Close()
+	sftpfs.fs.Close()
 }
\ No newline at end of file
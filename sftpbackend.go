@@ -0,0 +1,373 @@
+/*
+ * sftpbackend.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/winfsp/cgofuse/fuse"
+	"golang.org/x/crypto/ssh"
+)
+
+
+// Backend over SFTP
+type sftpBackend struct {
+	remote  *Remote
+	rawLock sync.Mutex
+	raw     *sftpRaw
+}
+
+
+func newSftpBackend(remote *Remote) *sftpBackend {
+	self := &sftpBackend{}
+	self.remote = remote
+	return self
+}
+
+
+func (self *sftpBackend) Stat(path string) (os.FileInfo, error) {
+	client, err := self.remote.Client()
+	if nil != err {
+		return nil, err
+	}
+	return client.Stat(path)
+}
+
+
+func (self *sftpBackend) Lstat(path string) (os.FileInfo, error) {
+	client, err := self.remote.Client()
+	if nil != err {
+		return nil, err
+	}
+	return client.Lstat(path)
+}
+
+
+func (self *sftpBackend) ReadDir(path string) ([]os.FileInfo, error) {
+	client, err := self.remote.Client()
+	if nil != err {
+		return nil, err
+	}
+	return client.ReadDir(path)
+}
+
+
+func (self *sftpBackend) Open(path string, flags int) (File, error) {
+	client, err := self.remote.Client()
+	if nil != err {
+		return nil, err
+	}
+	fp, err := client.OpenFile(path, flags)
+	if nil != err {
+		return nil, err
+	}
+	return &sftpFile{fp, client}, nil
+}
+
+
+func (self *sftpBackend) Create(path string) (File, error) {
+	return self.Open(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+
+func (self *sftpBackend) Remove(path string) error {
+	client, err := self.remote.Client()
+	if nil != err {
+		return err
+	}
+	return client.Remove(path)
+}
+
+
+func (self *sftpBackend) Rename(oldpath string, newpath string) error {
+	client, err := self.remote.Client()
+	if nil != err {
+		return err
+	}
+
+	// plain SFTP rename refuses to replace an existing file
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(oldpath, newpath)
+	}
+	return client.Rename(oldpath, newpath)
+}
+
+
+func (self *sftpBackend) Mkdir(path string) error {
+	client, err := self.remote.Client()
+	if nil != err {
+		return err
+	}
+	return client.Mkdir(path)
+}
+
+
+func (self *sftpBackend) Chmod(path string, mode os.FileMode) error {
+	client, err := self.remote.Client()
+	if nil != err {
+		return err
+	}
+	return client.Chmod(path, mode)
+}
+
+
+func (self *sftpBackend) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	client, err := self.remote.Client()
+	if nil != err {
+		return err
+	}
+	return client.Chtimes(path, atime, mtime)
+}
+
+
+func (self *sftpBackend) Symlink(target string, newpath string) error {
+	client, err := self.remote.Client()
+	if nil != err {
+		return err
+	}
+	return client.Symlink(target, newpath)
+}
+
+
+func (self *sftpBackend) Readlink(path string) (string, error) {
+	client, err := self.remote.Client()
+	if nil != err {
+		return "", err
+	}
+	return client.ReadLink(path)
+}
+
+
+func (self *sftpBackend) StatVFS(path string, stat *fuse.Statfs_t) error {
+	client, err := self.remote.Client()
+	if nil != err {
+		return err
+	}
+
+	if _, ok := client.HasExtension("statvfs@openssh.com"); !ok {
+		return errors.ErrUnsupported
+	}
+	info, err := client.StatVFS(path)
+	if nil != err {
+		return err
+	}
+
+	stat.Bsize = info.Bsize
+	stat.Frsize = info.Frsize
+	stat.Blocks = info.Blocks
+	stat.Bfree  = info.Bfree
+	stat.Bavail = info.Bavail
+	stat.Files  = info.Files
+	stat.Ffree  = info.Ffree
+	stat.Favail = info.Favail
+	stat.Namemax = info.Namemax
+	return nil
+}
+
+
+func (self *sftpBackend) Exec(cmd string) (io.ReadCloser, error) {
+
+	conn, err := self.remote.Conn()
+	if nil != err {
+		return nil, err
+	}
+
+	session, err := conn.NewSession()
+	if nil != err {
+		return nil, err
+	}
+
+	out, err := session.StdoutPipe()
+	if nil == err {
+		err = session.Start(cmd)
+	}
+	if nil != err {
+		session.Close()
+		return nil, err
+	}
+	return &execOutputReader{out, session, false}, nil
+}
+
+
+// raw session on the current connection
+func (self *sftpBackend) rawSession() (*sftpRaw, error) {
+
+	conn, err := self.remote.Conn()
+	if nil != err {
+		return nil, err
+	}
+
+	self.rawLock.Lock()
+	defer self.rawLock.Unlock()
+	if nil != self.raw && self.raw.conn == conn && !self.raw.Broken() {
+		return self.raw, nil
+	}
+	if nil != self.raw {
+		self.raw.Close()
+	}
+	self.raw, err = newSftpRaw(conn)
+	return self.raw, err
+}
+
+
+func (self *sftpBackend) RealPath(path string) (string, error) {
+	client, err := self.remote.Client()
+	if nil != err {
+		return "", err
+	}
+	return client.RealPath(path)
+}
+
+
+func (self *sftpBackend) Owner(path string) (string, error) {
+	raw, err := self.rawSession()
+	if nil != err {
+		return "", err
+	}
+	longname, err := raw.Longname(path)
+	if nil != err {
+		return "", err
+	}
+	owner, ok := longnameOwner(longname)
+	if !ok {
+		return "", fmt.Errorf("%s: no owner in %q", path, longname)
+	}
+	return owner, nil
+}
+
+
+// check-file-name or md5-hash if the server has them, else <alg>sum
+func (self *sftpBackend) Hash(path string, alg string) ([]byte, error) {
+
+	if _, ok := hashAlgs[alg]; !ok {
+		return nil, errors.ErrUnsupported
+	}
+
+	if raw, err := self.rawSession(); nil == err {
+		used, sum, err := raw.CheckFile(path, alg)
+		if nil == err && used == alg {
+			return sum, nil
+		}
+		if nil != err && !errors.Is(err, errors.ErrUnsupported) {
+			return nil, err
+		}
+		if "md5" == alg {
+			sum, err = raw.Md5Hash(path)
+			if !errors.Is(err, errors.ErrUnsupported) {
+				return sum, err
+			}
+		}
+	}
+
+	out, err := execOutput(self, alg + "sum -b -- " + shellQuote(path))
+	if nil != err {
+		return nil, fmt.Errorf("%ssum %s: %w", alg, path, err)
+	}
+	fields := strings.Fields(string(out))
+	if 0 == len(fields) {
+		return nil, fmt.Errorf("%ssum %s: no output", alg, path)
+	}
+	// names with odd characters get a backslash in front of the hash
+	return hex.DecodeString(strings.TrimPrefix(fields[0], "\\"))
+}
+
+
+// copy-data if the server has it, else cp on the server
+func (self *sftpBackend) Copy(oldpath string, newpath string) error {
+
+	if raw, err := self.rawSession(); nil == err {
+		err = raw.CopyData(oldpath, newpath)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+	}
+
+	src, dst := shellQuote(oldpath), shellQuote(newpath)
+	_, err := execOutput(self, fmt.Sprintf("cp --reflink=auto -- %s %s 2>/dev/null || cp -- %s %s", src, dst, src, dst))
+	if nil != err {
+		return fmt.Errorf("cp %s %s: %w", oldpath, newpath, err)
+	}
+	return nil
+}
+
+
+func (self *sftpBackend) Online() bool {
+	return self.remote.Online()
+}
+
+
+func (self *sftpBackend) OnReconnect(fn func()) {
+	self.remote.OnReconnect(fn)
+}
+
+
+func (self *sftpBackend) Close() error {
+	self.rawLock.Lock()
+	if nil != self.raw {
+		self.raw.Close()
+	}
+	self.rawLock.Unlock()
+	self.remote.Close()
+	return nil
+}
+
+
+// Open SFTP file
+type sftpFile struct {
+	*sftp.File
+	client *sftp.Client
+}
+
+
+func (self *sftpFile) Sync() error {
+	if _, ok := self.client.HasExtension("fsync@openssh.com"); !ok {
+		return errors.ErrUnsupported
+	}
+	return self.File.Sync()
+}
+
+
+// stdout of a remote command
+type execOutputReader struct {
+	io.Reader
+	session *ssh.Session
+	eof     bool
+}
+
+
+func (self *execOutputReader) Read(p []byte) (int, error) {
+	n, err := self.Reader.Read(p)
+	if io.EOF == err {
+		self.eof = true
+	}
+	return n, err
+}
+
+
+// exit status once the output is consumed; otherwise stop the command
+func (self *execOutputReader) Close() error {
+	if !self.eof {
+		return self.session.Close()
+	}
+	err := self.session.Wait()
+	self.session.Close()
+	return err
+}
@@ -0,0 +1,475 @@
+/*
+ * sftpraw.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+
+// SFTP v3 packet types and status codes
+const (
+	sshFxpInit          = 1
+	sshFxpVersion       = 2
+	sshFxpOpen          = 3
+	sshFxpClose         = 4
+	sshFxpStat          = 17
+	sshFxpOpendir       = 11
+	sshFxpReaddir       = 12
+	sshFxpStatus        = 101
+	sshFxpHandle        = 102
+	sshFxpName          = 104
+	sshFxpAttrs         = 105
+	sshFxpExtended      = 200
+	sshFxpExtendedReply = 201
+
+	sshFxOk               = 0
+	sshFxEOF              = 1
+	sshFxNoSuchFile       = 2
+	sshFxPermissionDenied = 3
+	sshFxOpUnsupported    = 8
+
+	sshFxfRead  = 0x01
+	sshFxfWrite = 0x02
+	sshFxfCreat = 0x08
+	sshFxfTrunc = 0x10
+
+	sshFileXferAttrPermissions = 0x04
+)
+
+
+// Second SFTP session on a connection, for what pkg/sftp doesn't expose:
+// ls long names and extension requests. One request at a time.
+type sftpRaw struct {
+	conn    *ssh.Client
+	session *ssh.Session
+	lock    sync.Mutex
+	in      io.WriteCloser
+	out     io.Reader
+	id      uint32
+	exts    map[string]string
+	broken  bool
+}
+
+
+func newSftpRaw(conn *ssh.Client) (*sftpRaw, error) {
+
+	session, err := conn.NewSession()
+	if nil != err {
+		return nil, err
+	}
+
+	self := &sftpRaw{}
+	self.conn = conn
+	self.session = session
+	self.exts = make(map[string]string)
+	self.in, err = session.StdinPipe()
+	if nil == err {
+		self.out, err = session.StdoutPipe()
+	}
+	if nil == err {
+		err = session.RequestSubsystem("sftp")
+	}
+	if nil == err {
+		err = self.send(sshFxpInit, binary.BigEndian.AppendUint32(nil, 3))
+	}
+	if nil != err {
+		session.Close()
+		return nil, err
+	}
+
+	typ, data, err := self.recv()
+	if nil == err && sshFxpVersion != typ {
+		err = fmt.Errorf("sftp: unexpected packet %d instead of version", typ)
+	}
+	if nil != err {
+		session.Close()
+		return nil, err
+	}
+	r := &sftpReader{data: data}
+	r.uint32()
+	for 0 != len(r.data) && nil == r.err {
+		name, value := r.string(), r.string()
+		self.exts[name] = value
+	}
+	return self, nil
+}
+
+
+func (self *sftpRaw) HasExtension(name string) bool {
+	_, ok := self.exts[name]
+	return ok
+}
+
+
+func (self *sftpRaw) send(typ byte, data []byte) error {
+	pkt := make([]byte, 5, 5 + len(data))
+	binary.BigEndian.PutUint32(pkt, uint32(1 + len(data)))
+	pkt[4] = typ
+	_, err := self.in.Write(append(pkt, data...))
+	return err
+}
+
+
+func (self *sftpRaw) recv() (byte, []byte, error) {
+	var head [5]byte
+	_, err := io.ReadFull(self.out, head[:])
+	if nil != err {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(head[:])
+	if size < 1 || size > 1 << 24 {
+		return 0, nil, fmt.Errorf("sftp: bad packet length %d", size)
+	}
+	data := make([]byte, size - 1)
+	_, err = io.ReadFull(self.out, data)
+	return head[4], data, err
+}
+
+
+// send a request and wait for its answer, without the request id
+func (self *sftpRaw) request(typ byte, args ...interface{}) (byte, []byte, error) {
+
+	defer self.synchronize()()
+
+	if self.broken {
+		return 0, nil, errOffline
+	}
+	self.id++
+	data := binary.BigEndian.AppendUint32(nil, self.id)
+	data = sftpAppend(data, args...)
+
+	err := self.send(typ, data)
+	if nil == err {
+		typ, data, err = self.recv()
+	}
+	if nil == err && (len(data) < 4 || self.id != binary.BigEndian.Uint32(data)) {
+		err = errors.New("sftp: reply out of order")
+	}
+	if nil != err {
+		self.broken = true
+		self.session.Close()
+		return 0, nil, err
+	}
+	return typ, data[4:], nil
+}
+
+
+// reply that has to be a status; nil for SSH_FX_OK
+func (self *sftpRaw) status(typ byte, data []byte, name string) error {
+	if sshFxpStatus != typ {
+		return fmt.Errorf("sftp %s: unexpected packet %d", name, typ)
+	}
+	r := &sftpReader{data: data}
+	code, msg := r.uint32(), r.string()
+	switch code {
+	case sshFxOk:
+		return nil
+	case sshFxEOF:
+		return io.EOF
+	case sshFxNoSuchFile:
+		return &os.PathError{Op: "sftp", Path: name, Err: os.ErrNotExist}
+	case sshFxPermissionDenied:
+		return &os.PathError{Op: "sftp", Path: name, Err: os.ErrPermission}
+	case sshFxOpUnsupported:
+		return &os.PathError{Op: "sftp", Path: name, Err: errors.ErrUnsupported}
+	}
+	return fmt.Errorf("sftp %s: %s (status %d)", name, msg, code)
+}
+
+
+func (self *sftpRaw) handle(typ byte, data []byte, name string) (string, error) {
+	if sshFxpHandle != typ {
+		return "", self.status(typ, data, name)
+	}
+	r := &sftpReader{data: data}
+	return r.string(), r.err
+}
+
+
+func (self *sftpRaw) closeHandle(handle string) error {
+	typ, data, err := self.request(sshFxpClose, handle)
+	if nil != err {
+		return err
+	}
+	return self.status(typ, data, "close")
+}
+
+
+// "ls -l" line the server gives for name
+func (self *sftpRaw) Longname(name string) (string, error) {
+
+	name = path.Clean(name)
+	if "/" == name {
+		return "", errors.ErrUnsupported
+	}
+	dir, base := path.Dir(name), path.Base(name)
+	typ, data, err := self.request(sshFxpOpendir, dir)
+	if nil != err {
+		return "", err
+	}
+	handle, err := self.handle(typ, data, dir)
+	if nil != err {
+		return "", err
+	}
+	defer self.closeHandle(handle)
+
+	for {
+		typ, data, err = self.request(sshFxpReaddir, handle)
+		if nil != err {
+			return "", err
+		}
+		if sshFxpName != typ {
+			err = self.status(typ, data, dir)
+			if io.EOF == err {
+				return "", &os.PathError{Op: "longname", Path: name, Err: os.ErrNotExist}
+			}
+			return "", err
+		}
+
+		r := &sftpReader{data: data}
+		for count := r.uint32(); 0 < count && nil == r.err; count-- {
+			entry, longname := r.string(), r.string()
+			r.permissions()
+			if base == entry {
+				return longname, nil
+			}
+		}
+		if nil != r.err {
+			return "", r.err
+		}
+	}
+}
+
+
+// hash of a whole file with the check-file-name extension; algs is a
+// comma separated preference list such as "sha256,sha1,md5"
+func (self *sftpRaw) CheckFile(name string, algs string) (string, []byte, error) {
+
+	if !self.HasExtension("check-file") && !self.HasExtension("check-file-name") {
+		return "", nil, errors.ErrUnsupported
+	}
+	typ, data, err := self.request(sshFxpExtended, "check-file-name", name, algs, uint64(0), uint64(0), uint32(0))
+	if nil != err {
+		return "", nil, err
+	}
+	if sshFxpExtendedReply != typ {
+		return "", nil, self.status(typ, data, name)
+	}
+
+	r := &sftpReader{data: data}
+	r.string()
+	alg := r.string()
+	if nil != r.err {
+		return "", nil, r.err
+	}
+	return alg, r.data, nil
+}
+
+
+// md5 of a whole file with the md5-hash extension
+func (self *sftpRaw) Md5Hash(name string) ([]byte, error) {
+
+	if !self.HasExtension("md5-hash") {
+		return nil, errors.ErrUnsupported
+	}
+	typ, data, err := self.request(sshFxpExtended, "md5-hash", name, uint64(0), uint64(0), "")
+	if nil != err {
+		return nil, err
+	}
+	if sshFxpExtendedReply != typ {
+		return nil, self.status(typ, data, name)
+	}
+
+	r := &sftpReader{data: data}
+	r.string()
+	sum := r.string()
+	if nil != r.err {
+		return nil, r.err
+	}
+	return []byte(sum), nil
+}
+
+
+// copy a file within the server with copy-data@openssh.com; a new file
+// gets the permissions of the old one
+func (self *sftpRaw) CopyData(oldpath string, newpath string) error {
+
+	if !self.HasExtension("copy-data") && !self.HasExtension("copy-data@openssh.com") {
+		return errors.ErrUnsupported
+	}
+	if path.Clean(oldpath) == path.Clean(newpath) {
+		return fmt.Errorf("copy-data %s: %w", oldpath, errSameFile)
+	}
+
+	typ, data, err := self.request(sshFxpStat, oldpath)
+	if nil != err {
+		return err
+	}
+	if sshFxpAttrs != typ {
+		return self.status(typ, data, oldpath)
+	}
+	r := &sftpReader{data: data}
+	perm := r.permissions()
+	if nil != r.err {
+		return r.err
+	}
+
+	typ, data, err = self.request(sshFxpOpen, oldpath, uint32(sshFxfRead), uint32(0))
+	if nil != err {
+		return err
+	}
+	src, err := self.handle(typ, data, oldpath)
+	if nil != err {
+		return err
+	}
+	defer self.closeHandle(src)
+
+	typ, data, err = self.request(sshFxpOpen, newpath, uint32(sshFxfWrite|sshFxfCreat|sshFxfTrunc),
+		uint32(sshFileXferAttrPermissions), perm & 07777)
+	if nil != err {
+		return err
+	}
+	dst, err := self.handle(typ, data, newpath)
+	if nil != err {
+		return err
+	}
+
+	typ, data, err = self.request(sshFxpExtended, "copy-data", src, uint64(0), uint64(0), dst, uint64(0))
+	if nil == err {
+		err = self.status(typ, data, newpath)
+	}
+	if cerr := self.closeHandle(dst); nil == err {
+		err = cerr
+	}
+	return err
+}
+
+
+// the session died and a new one is needed
+func (self *sftpRaw) Broken() bool {
+	defer self.synchronize()()
+	return self.broken
+}
+
+
+func (self *sftpRaw) Close() error {
+	return self.session.Close()
+}
+
+
+func (self *sftpRaw) synchronize() func() {
+	self.lock.Lock()
+	return func() {
+		self.lock.Unlock()
+	}
+}
+
+
+// marshal strings, byte slices and fixed size integers the SFTP way
+func sftpAppend(data []byte, args ...interface{}) []byte {
+	be := binary.BigEndian
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			data = be.AppendUint32(data, uint32(len(v)))
+			data = append(data, v...)
+		case []byte:
+			data = be.AppendUint32(data, uint32(len(v)))
+			data = append(data, v...)
+		case uint32:
+			data = be.AppendUint32(data, v)
+		case uint64:
+			data = be.AppendUint64(data, v)
+		default:
+			panic(fmt.Sprintf("sftpAppend: %T", arg))
+		}
+	}
+	return data
+}
+
+
+// Packet payload being taken apart; the first error sticks
+type sftpReader struct {
+	data []byte
+	err  error
+}
+
+
+func (self *sftpReader) take(n int) []byte {
+	if nil != self.err || n < 0 || len(self.data) < n {
+		self.err = errors.New("sftp: short packet")
+		return nil
+	}
+	b := self.data[:n]
+	self.data = self.data[n:]
+	return b
+}
+
+
+func (self *sftpReader) uint32() uint32 {
+	b := self.take(4)
+	if nil == b {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+
+func (self *sftpReader) string() string {
+	return string(self.take(int(self.uint32())))
+}
+
+
+// file attributes, of which only the permissions are kept
+func (self *sftpReader) permissions() (perm uint32) {
+	flags := self.uint32()
+	if 0 != flags & 0x1 {
+		self.take(8)
+	}
+	if 0 != flags & 0x2 {
+		self.take(8)
+	}
+	if 0 != flags & sshFileXferAttrPermissions {
+		perm = self.uint32()
+	}
+	if 0 != flags & 0x8 {
+		self.take(8)
+	}
+	if 0 != flags & 0x80000000 {
+		for count := self.uint32(); 0 < count && nil == self.err; count-- {
+			self.string()
+			self.string()
+		}
+	}
+	return
+}
+
+
+// owner column of an ls -l line
+func longnameOwner(longname string) (string, bool) {
+	fields := strings.Fields(longname)
+	if len(fields) < 3 {
+		return "", false
+	}
+	return fields[2], true
+}
@@ -0,0 +1,190 @@
+/*
+ * spoolfile.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+
+// Open file of a backend that can only replace content as a whole
+//
+// Reads go to the remote until the first change. Changes are made to a
+// local spool file, seeded with the remote content unless it is truncated
+// first, and uploaded on Sync and Close.
+type spoolFile struct {
+	name  string
+	lock  sync.Mutex
+	size  int64
+	mtime time.Time
+	spool *os.File
+	dirty bool
+
+	// fill buff from ofst; the range is within size
+	read   func(buff []byte, ofst int64) error
+	fetch  func(w io.Writer) error
+	upload func(r io.Reader, size int64) (time.Time, error)
+}
+
+
+func (self *spoolFile) ReadAt(buff []byte, ofst int64) (int, error) {
+
+	defer self.synchronize()()
+
+	if nil != self.spool {
+		return self.spool.ReadAt(buff, ofst)
+	}
+	if ofst >= self.size {
+		return 0, io.EOF
+	}
+
+	n := len(buff)
+	if int64(n) > self.size - ofst {
+		n = int(self.size - ofst)
+	}
+	if 0 == n {
+		return 0, nil
+	}
+
+	err := self.read(buff[:n], ofst)
+	if nil != err {
+		return 0, err
+	}
+	if n < len(buff) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+
+func (self *spoolFile) WriteAt(buff []byte, ofst int64) (int, error) {
+
+	defer self.synchronize()()
+
+	err := self.seed(true)
+	if nil != err {
+		return 0, err
+	}
+	self.dirty = true
+	return self.spool.WriteAt(buff, ofst)
+}
+
+
+func (self *spoolFile) Truncate(size int64) error {
+
+	defer self.synchronize()()
+
+	// nothing worth downloading survives a truncate to zero
+	err := self.seed(0 != size)
+	if nil != err {
+		return err
+	}
+	self.dirty = true
+	return self.spool.Truncate(size)
+}
+
+
+// create the spool before the first change
+func (self *spoolFile) seed(content bool) error {
+
+	if nil != self.spool {
+		return nil
+	}
+
+	spool, err := os.CreateTemp("", "sshfs-spool-")
+	if nil != err {
+		return err
+	}
+	os.Remove(spool.Name())
+
+	if content && 0 < self.size {
+		err = self.fetch(spool)
+		if nil != err {
+			spool.Close()
+			return err
+		}
+	}
+
+	self.spool = spool
+	return nil
+}
+
+
+func (self *spoolFile) Sync() error {
+	defer self.synchronize()()
+	return self.flush()
+}
+
+
+// upload the spool if it changed
+func (self *spoolFile) flush() error {
+
+	if !self.dirty {
+		return nil
+	}
+
+	info, err := self.spool.Stat()
+	if nil != err {
+		return err
+	}
+
+	mtime, err := self.upload(io.NewSectionReader(self.spool, 0, info.Size()), info.Size())
+	if nil != err {
+		return err
+	}
+
+	self.dirty = false
+	self.size = info.Size()
+	self.mtime = mtime
+	if self.mtime.IsZero() {
+		self.mtime = time.Now()
+	}
+	return nil
+}
+
+
+func (self *spoolFile) Stat() (os.FileInfo, error) {
+
+	defer self.synchronize()()
+
+	err := self.flush()
+	if nil != err {
+		return nil, err
+	}
+	return &fileInfo{self.name, self.size, 0644, self.mtime, ""}, nil
+}
+
+
+func (self *spoolFile) Close() error {
+
+	defer self.synchronize()()
+
+	if nil == self.spool {
+		return nil
+	}
+	err := self.flush()
+	self.spool.Close()
+	self.spool = nil
+	return err
+}
+
+
+func (self *spoolFile) synchronize() func() {
+	self.lock.Lock()
+	return func() {
+		self.lock.Unlock()
+	}
+}
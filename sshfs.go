@@ -1,3 +1,5 @@
+//go:build memfs
+
 /*
  * memfs.go
  *
@@ -13,8 +15,11 @@
 package main
 
 import (
+	"container/list"
+	"flag"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -25,7 +30,6 @@ import (
 	//"log"
 	//"bytes"
 	
-	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	//"syscall"
 	"io"
@@ -72,8 +76,15 @@ type node_t struct {
 	chld    map[string]*node_t
 	data    []byte
 	opencnt int
-	fp *sftp.File
-	reader io.Reader
+	origin  string // where the content is on the server, "" if nowhere yet
+	loaded  bool   // data holds the content
+	listed  bool   // chld holds the entries
+	queued  bool   // an upload is waiting and will pick up new writes
+	dirty   int    // uploads not finished yet
+	pending *memOp // the waiting upload
+	lost    bool   // an upload was dropped: data is the only copy
+	charged int64  // bytes of data counted against the budget
+	elem    *list.Element
 }
 
 func newNode(dev uint64, ino uint64, mode uint32, uid uint32, gid uint32) *node_t {
@@ -96,7 +107,14 @@ func newNode(dev uint64, ino uint64, mode uint32, uid uint32, gid uint32) *node_
 		nil,
 		nil,
 		0,
+		"",
+		false,
+		false,
+		false,
+		0,
 		nil,
+		false,
+		0,
 		nil}
 	if fuse.S_IFDIR == self.stat.Mode&fuse.S_IFMT {
 		self.chld = map[string]*node_t{}
@@ -106,11 +124,16 @@ func newNode(dev uint64, ino uint64, mode uint32, uid uint32, gid uint32) *node_
 
 type Memfs struct {
 	fuse.FileSystemBase
-	client *sftp.Client
+	fs      Backend
 	lock    sync.Mutex
 	ino     uint64
 	root    *node_t
 	openmap map[uint64]*node_t
+	syncer  *memSyncer
+	budget  int64      // bytes of file content to keep, 0 for no limit
+	used    int64
+	lru     *list.List // loaded files, most recently used first
+	fetches uint64     // times the lock was let go to ask the server
 }
 
 func (self *Memfs) Mknod(path string, mode uint32, dev uint64) (errc int) {
@@ -119,77 +142,110 @@ func (self *Memfs) Mknod(path string, mode uint32, dev uint64) (errc int) {
 
 	defer trace(path, mode, dev)(&errc)
 	defer self.synchronize()()
-	return self.makeNode(path, mode, dev, nil)
+	errc = self.makeNode(path, mode, dev, nil)
+	if 0 == errc && fuse.S_IFREG == mode&fuse.S_IFMT {
+		_, _, node := self.lookupNode(path, nil)
+		self.upload(path, node)
+		self.syncer.Push(&memOp{Op: "chmod", Path: path, Mode: os.FileMode(mode & 0777)})
+	}
+	return
 }
 
 func (self *Memfs) Mkdir(path string, mode uint32) (errc int) {
 
 	fmt.Printf("Mkdir => %s\n", path)
-	
-	err := self.client.Mkdir(path)
-	if err != nil {
-		fmt.Println(err)
-	}	
-
 
 	defer trace(path, mode)(&errc)
 	defer self.synchronize()()
 	
-	return self.makeNode(path, fuse.S_IFDIR|(mode&07777), 0, nil)
+	errc = self.makeNode(path, fuse.S_IFDIR|(mode&07777), 0, nil)
+	if 0 == errc {
+		self.syncer.Push(&memOp{Op: "mkdir", Path: path})
+		self.syncer.Push(&memOp{Op: "chmod", Path: path, Mode: os.FileMode(mode & 0777)})
+	}
+	return
 }
 
 func (self *Memfs) Unlink(path string) (errc int) {
-
-	err := self.client.Remove(path)
-	if err != nil {
-		fmt.Println(err)
-	}
-
 	defer trace(path)(&errc)
 	defer self.synchronize()()
-	return self.removeNode(path, false)
+	errc = self.removeNode(path, false)
+	if 0 == errc {
+		self.syncer.Push(&memOp{Op: "remove", Path: path})
+	}
+	return
 }
 
 func (self *Memfs) Rmdir(path string) (errc int) {
-
-	err := self.client.RemoveDirectory(path)
-	if err != nil {
-		fmt.Println(err)
-	}
-
-
 	defer trace(path)(&errc)
 	defer self.synchronize()()
-	return self.removeNode(path, true)
+	errc = self.removeNode(path, true)
+	if 0 == errc {
+		self.syncer.Push(&memOp{Op: "remove", Path: path})
+	}
+	return
 }
 
+// hard links have no counterpart on the server: it gets a copy
 func (self *Memfs) Link(oldpath string, newpath string) (errc int) {
 	defer trace(oldpath, newpath)(&errc)
 	defer self.synchronize()()
-	_, _, oldnode := self.lookupNode(oldpath, nil)
-	if nil == oldnode {
-		return -fuse.ENOENT
+	var oldnode, newprnt, newnode *node_t
+	var newname string
+	for {
+		fetches := self.fetches
+		_, _, oldnode = self.lookupNode(oldpath, nil)
+		if nil == oldnode {
+			return -fuse.ENOENT
+		}
+		if errc = self.loadNode(oldnode); 0 != errc {
+			return
+		}
+		newprnt, newname, newnode = self.lookupNode(newpath, nil)
+		if fetches == self.fetches {
+			break
+		}
 	}
-	newprnt, newname, newnode := self.lookupNode(newpath, nil)
 	if nil == newprnt {
 		return -fuse.ENOENT
 	}
 	if nil != newnode {
 		return -fuse.EEXIST
 	}
+	if fuse.S_IFDIR == oldnode.stat.Mode&fuse.S_IFMT {
+		return -fuse.EPERM
+	}
 	oldnode.stat.Nlink++
 	newprnt.chld[newname] = oldnode
 	tmsp := fuse.Now()
 	oldnode.stat.Ctim = tmsp
 	newprnt.stat.Ctim = tmsp
 	newprnt.stat.Mtim = tmsp
+
+	if fuse.S_IFLNK == oldnode.stat.Mode&fuse.S_IFMT {
+		self.syncer.Push(&memOp{Op: "symlink", Path: newpath, Target: string(oldnode.data)})
+		return 0
+	}
+	op := &memOp{Op: "upload", Path: newpath, node: oldnode}
+	oldnode.dirty++
+	self.syncer.Push(op)
+	if nil != self.syncer.journal {
+		err := self.syncer.journal.Save(op, oldnode.data[:oldnode.stat.Size])
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
 	return 0
 }
 
 func (self *Memfs) Symlink(target string, newpath string) (errc int) {
 	defer trace(target, newpath)(&errc)
 	defer self.synchronize()()
-	return self.makeNode(newpath, fuse.S_IFLNK|00777, 0, []byte(target))
+	errc = self.makeNode(newpath, fuse.S_IFLNK|00777, 0, []byte(target))
+	if 0 == errc {
+		self.syncer.Push(&memOp{Op: "symlink", Path: newpath, Target: target})
+	}
+	return
 }
 
 func (self *Memfs) Readlink(path string) (errc int, target string) {
@@ -211,13 +267,28 @@ func (self *Memfs) Rename(oldpath string, newpath string) (errc int) {
 
 	defer trace(oldpath, newpath)(&errc)
 	defer self.synchronize()()
-	oldprnt, oldname, oldnode := self.lookupNode(oldpath, nil)
-	if nil == oldnode {
-		return -fuse.ENOENT
-	}
-	newprnt, newname, newnode := self.lookupNode(newpath, oldnode)
-	if nil == newprnt {
-		return -fuse.ENOENT
+	var oldprnt, oldnode, newprnt, newnode *node_t
+	var oldname, newname string
+	// again if the lock was let go in between
+	for {
+		fetches := self.fetches
+		oldprnt, oldname, oldnode = self.lookupNode(oldpath, nil)
+		if nil == oldnode {
+			return -fuse.ENOENT
+		}
+		newprnt, newname, newnode = self.lookupNode(newpath, oldnode)
+		if nil == newprnt {
+			return -fuse.ENOENT
+		}
+		if nil != newnode {
+			// listed for removeNode
+			if errc = self.listNode(newnode); 0 != errc {
+				return
+			}
+		}
+		if fetches == self.fetches {
+			break
+		}
 	}
 	if "" == newname {
 		// guard against directory loop creation
@@ -231,9 +302,12 @@ func (self *Memfs) Rename(oldpath string, newpath string) (errc int) {
 		if 0 != errc {
 			return errc
 		}
+		// not every server renames over an existing entry
+		self.syncer.Push(&memOp{Op: "remove", Path: newpath})
 	}
 	delete(oldprnt.chld, oldname)
 	newprnt.chld[newname] = oldnode
+	self.syncer.Push(&memOp{Op: "rename", Path: oldpath, Target: newpath, node: oldnode})
 	return 0
 }
 
@@ -249,9 +323,11 @@ func (self *Memfs) Chmod(path string, mode uint32) (errc int) {
 	}
 	node.stat.Mode = (node.stat.Mode & fuse.S_IFMT) | mode&07777
 	node.stat.Ctim = fuse.Now()
+	self.syncer.Push(&memOp{Op: "chmod", Path: path, Mode: os.FileMode(mode & 0777)})
 	return 0
 }
 
+// owners stay in memory; the server account owns everything
 func (self *Memfs) Chown(path string, uid uint32, gid uint32) (errc int) {
 	defer trace(path, uid, gid)(&errc)
 	defer self.synchronize()()
@@ -284,6 +360,7 @@ func (self *Memfs) Utimens(path string, tmsp []fuse.Timespec) (errc int) {
 	}
 	node.stat.Atim = tmsp[0]
 	node.stat.Mtim = tmsp[1]
+	self.syncer.Push(&memOp{Op: "chtimes", Path: path, Atime: tmsp[0].Time(), Mtime: tmsp[1].Time()})
 	return 0
 }
 
@@ -293,21 +370,20 @@ func (self *Memfs) Open(path string, flags int) (errc int, fh uint64) {
 
 	defer trace(path, flags)(&errc, &fh)
 	defer self.synchronize()()
-	
-	//fmt.Printf("Opening dest file: [%q] \n", path)
-	//fp, err := self.client.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
-   // if err != nil {
-    //    fmt.Printf("error: %s; OpenFile()\n", err)
-    //}	
-	
-	//_, _, node := self.lookupNode(path, nil)
-	////if node != nil {
-	//	r := strings.NewReader("")
-	//	node.fp = fp
-	//	node.reader = r
-	//}	
 
-	return self.openNode(path, false)
+	errc, fh = self.openNode(path, false)
+	if 0 != errc || 0 == flags&fuse.O_TRUNC || !writeFlags(flags) {
+		return
+	}
+
+	// no need to fetch what is thrown away
+	node := self.openmap[fh]
+	node.data = nil
+	node.stat.Size = 0
+	node.loaded = true
+	self.upload(path, node)
+	self.touch(node)
+	return
 }
 
 
@@ -338,11 +414,16 @@ func (self *Memfs) Truncate(path string, size int64, fh uint64) (errc int) {
 	if nil == node {
 		return -fuse.ENOENT
 	}
+	if errc = self.loadNode(node); 0 != errc {
+		return
+	}
 	node.data = resize(node.data, size, true)
 	node.stat.Size = size
 	tmsp := fuse.Now()
 	node.stat.Ctim = tmsp
 	node.stat.Mtim = tmsp
+	self.upload(path, node)
+	self.touch(node)
 	return 0
 }
 
@@ -356,8 +437,9 @@ func (self *Memfs) Read(path string, buff []byte, ofst int64, fh uint64) (n int)
 	if nil == node {
 		return -fuse.ENOENT
 	}
-	
-
+	if errc := self.loadNode(node); 0 != errc {
+		return errc
+	}
 	endofst := ofst + int64(len(buff))
 	if endofst > node.stat.Size {
 		endofst = node.stat.Size
@@ -365,27 +447,7 @@ func (self *Memfs) Read(path string, buff []byte, ofst int64, fh uint64) (n int)
 	if endofst < ofst {
 		return 0
 	}
-	
-	fmt.Printf("offset %d\n", ofst)
-	fmt.Printf("offset %d\n", endofst)
-	fmt.Printf("buffer size %d\n", len(buff))
-
-
-    f, err := self.client.OpenFile(path, (os.O_RDONLY))
-    if err != nil {
-		fmt.Println(err)
-    }
-    //defer f.Close()
-
-
-	data := make([]byte, len(buff))
-	n, err = f.ReadAt(data, int64(ofst))
-	if err != nil && (err != io.EOF || n == 0) {
-		fmt.Println(err)
-	}
-	
-
-	copy(buff, data)
+	n = copy(buff, node.data[ofst:endofst])
 	node.stat.Atim = fuse.Now()
 	return
 }
@@ -397,47 +459,47 @@ func (self *Memfs) Write(path string, buff []byte, ofst int64, fh uint64) (n int
 	if nil == node {
 		return -fuse.ENOENT
 	}
+	if errc := self.loadNode(node); 0 != errc {
+		return errc
+	}
 	endofst := ofst + int64(len(buff))
 	if endofst > node.stat.Size {
 		node.data = resize(node.data, endofst, true)
 		node.stat.Size = endofst
 	}
-
-	_, _, node_t := self.lookupNode(path, nil)
-	if node_t != nil {
-
-		fmt.Printf("got node => %+v\n", node_t.fp)
-		tmp := make([]byte, len(buff))
-		copy(tmp, buff)
-		_, err := node_t.fp.WriteAt(tmp, ofst)
-		if err != nil {
-			fmt.Println(err)
-		}		
-	}
-
-	//func (f *File) WriteAt(b []byte, off int64) (written int, err error)	
-	
-
-	
-	//r := bytes.NewReader(buff)
-	//err := self.client.WriteAt(tmp, r)
-	//if err != nil {
-	//	fmt.Println(err)
-	//}
-	
 	n = copy(node.data[ofst:endofst], buff)
-	
-	
 	tmsp := fuse.Now()
 	node.stat.Ctim = tmsp
 	node.stat.Mtim = tmsp
+	self.upload(path, node)
+	self.touch(node)
 	return
 }
 
+// fsync returns once the data is in the journal or, without one, on the
+// server
+func (self *Memfs) Fsync(path string, datasync bool, fh uint64) (errc int) {
+	defer trace(path, datasync, fh)(&errc)
+	if nil != self.syncer.journal {
+		defer self.synchronize()()
+		node := self.getNode(path, fh)
+		if nil == node {
+			return -fuse.ENOENT
+		}
+		return self.save(node)
+	}
+	self.syncer.Wait()
+	return 0
+}
+
 func (self *Memfs) Release(path string, fh uint64) (errc int) {
 	defer trace(path, fh)(&errc)
 	defer self.synchronize()()
-	return self.closeNode(fh)
+	errc = self.save(self.openmap[fh])
+	if e := self.closeNode(fh); 0 == errc {
+		errc = e
+	}
+	return
 }
 
 func (self *Memfs) Opendir(path string) (errc int, fh uint64) {
@@ -452,33 +514,12 @@ func (self *Memfs) Readdir(path string,
 	fh uint64) (errc int) {
 	
 	
-	// update nodes
-	entries, err := self.client.ReadDir(path)
-	if err != nil {
-		fmt.Println(err)
-	} else {
-		for _, entry := range entries {
-
-			npath := ""
-			if path == "/" {
-				npath = path + entry.Name()
-			} else {
-				npath = path + "/" + entry.Name()
-			}
-			
-			if entry.IsDir() == false {
-				self.makeFileNode(npath, fuse.S_IFREG|0777, 0, nil, int64(entry.Size()))
-			} else {
-				self.makeNode(npath, fuse.S_IFDIR|0777, 0, nil)						
-			}
-		}
-	}
-	
-	
-	
 	defer trace(path, fill, ofst, fh)(&errc)
 	defer self.synchronize()()
 	node := self.openmap[fh]
+	if errc = self.listNode(node); 0 != errc {
+		return
+	}
 	fill(".", &node.stat, 0)
 	fill("..", nil, 0)
 	for name, chld := range node.chld {
@@ -539,6 +580,9 @@ func (self *Memfs) Getxattr(path string, name string) (errc int, xatr []byte) {
 	if "com.apple.ResourceFork" == name {
 		return -fuse.ENOTSUP, nil
 	}
+	if "/" == path && memPendingXattr == name {
+		return 0, []byte(strconv.Itoa(self.syncer.Pending()))
+	}
 	xatr, ok := node.xatr[name]
 	if !ok {
 		return -fuse.ENOATTR, nil
@@ -570,6 +614,9 @@ func (self *Memfs) Listxattr(path string, fill func(name string) bool) (errc int
 	if nil == node {
 		return -fuse.ENOENT
 	}
+	if "/" == path && !fill(memPendingXattr) {
+		return -fuse.ERANGE
+	}
 	for name := range node.xatr {
 		if !fill(name) {
 			return -fuse.ERANGE
@@ -613,7 +660,19 @@ func (self *Memfs) Setchgtime(path string, tmsp fuse.Timespec) (errc int) {
 	return 0
 }
 
+// start over when the lock was let go to list a directory; a directory
+// that can't be listed is as good as missing
 func (self *Memfs) lookupNode(path string, ancestor *node_t) (prnt *node_t, name string, node *node_t) {
+	for {
+		fetches := self.fetches
+		prnt, name, node = self.walkNode(path, ancestor)
+		if nil == prnt || fetches == self.fetches {
+			return
+		}
+	}
+}
+
+func (self *Memfs) walkNode(path string, ancestor *node_t) (prnt *node_t, name string, node *node_t) {
 	prnt = self.root
 	name = ""
 	node = self.root
@@ -626,6 +685,9 @@ func (self *Memfs) lookupNode(path string, ancestor *node_t) (prnt *node_t, name
 			if node == nil {
 				return
 			}
+			if 0 != self.listNode(node) {
+				return nil, "", nil
+			}
 			node = node.chld[c]
 			if nil != ancestor && node == ancestor {
 				name = "" // special case loop condition
@@ -647,6 +709,8 @@ func (self *Memfs) makeNode(path string, mode uint32, dev uint64, data []byte) i
 	self.ino++
 	uid, gid, _ := fuse.Getcontext()
 	node = newNode(dev, self.ino, mode, uid, gid)
+	node.loaded = true
+	node.listed = true
 	if nil != data {
 		node.data = make([]byte, len(data))
 		node.stat.Size = int64(len(data))
@@ -660,43 +724,185 @@ func (self *Memfs) makeNode(path string, mode uint32, dev uint64, data []byte) i
 
 
 
-func (self *Memfs) makeFileNode(path string, mode uint32, dev uint64, data []byte, size int64) int {
-	prnt, name, node := self.lookupNode(path, nil)
-	if nil == prnt {
-		return -fuse.ENOENT
+// node for an entry the server listed
+func (self *Memfs) remoteNode(info os.FileInfo, origin string, target string) *node_t {
+	perm := uint32(info.Mode().Perm())
+	if 0 == perm {
+		perm = 0777
 	}
-	if nil != node {
-		return -fuse.EEXIST
+	mode := fuse.S_IFREG | perm
+	if info.IsDir() {
+		mode = fuse.S_IFDIR | perm
+	} else if 0 != info.Mode()&os.ModeSymlink {
+		mode = fuse.S_IFLNK | 0777
 	}
+
 	self.ino++
 	uid, gid, _ := fuse.Getcontext()
-	node = newNode(dev, self.ino, mode, uid, gid)
-	if size > 0 {
-		node.stat.Size = size
+	node := newNode(0, self.ino, mode, uid, gid)
+	node.origin = origin
+	node.stat.Size = info.Size()
+	if !info.ModTime().IsZero() {
+		node.stat.Mtim = fuse.NewTimespec(info.ModTime())
+		node.stat.Ctim = node.stat.Mtim
 	}
-	prnt.chld[name] = node
-	prnt.stat.Ctim = node.stat.Ctim
-	prnt.stat.Mtim = node.stat.Ctim
+
+	if fuse.S_IFLNK == mode&fuse.S_IFMT {
+		node.data = []byte(target)
+		node.stat.Size = int64(len(node.data))
+		node.loaded = true
+	}
+	return node
+}
+
+// fill in a directory from the server, once
+//
+// The server is asked without the lock, so a slow one only holds up whoever
+// needs this directory; nodes found before may be gone when it returns.
+func (self *Memfs) listNode(dir *node_t) int {
+	for nil != dir.chld && !dir.listed {
+		origin := dir.origin
+		self.fetches++
+		self.lock.Unlock()
+		entries, targets, err := self.readDir(origin)
+		self.lock.Lock()
+		if err != nil {
+			fmt.Println(err)
+			return fuseErrc(err)
+		}
+		if dir.listed || dir.origin != origin {
+			continue
+		}
+		for _, entry := range entries {
+			if _, ok := dir.chld[entry.Name()]; !ok {
+				dir.chld[entry.Name()] = self.remoteNode(entry, strings.TrimSuffix(origin, "/")+"/"+entry.Name(), targets[entry.Name()])
+			}
+		}
+		dir.listed = true
+	}
+	return 0
+}
+
+// entries of a directory on the server and the targets of its symlinks
+func (self *Memfs) readDir(origin string) ([]os.FileInfo, map[string]string, error) {
+	entries, err := self.fs.ReadDir(origin)
+	if err != nil {
+		return nil, nil, err
+	}
+	targets := map[string]string{}
+	readlinker, ok := self.fs.(Readlinker)
+	for _, entry := range entries {
+		if !ok || 0 == entry.Mode()&os.ModeSymlink {
+			continue
+		}
+		target, err := readlinker.Readlink(strings.TrimSuffix(origin, "/")+"/"+entry.Name())
+		if err != nil {
+			fmt.Println(err)
+		}
+		targets[entry.Name()] = target
+	}
+	return entries, targets, nil
+}
+
+// fetch the content of a file from the server, once; without the lock,
+// as for listNode
+func (self *Memfs) loadNode(node *node_t) int {
+	if fuse.S_IFREG != node.stat.Mode&fuse.S_IFMT {
+		return 0
+	}
+	for !node.loaded {
+		self.evict(node, node.stat.Size)
+		origin := node.origin
+		size := node.stat.Size
+		self.fetches++
+		self.lock.Unlock()
+		data, err := self.readFile(origin, size)
+		self.lock.Lock()
+		if err != nil {
+			fmt.Println(err)
+			return fuseErrc(err)
+		}
+		if node.loaded || node.origin != origin {
+			continue
+		}
+		node.data = data
+		node.stat.Size = int64(len(data))
+		node.loaded = true
+	}
+	self.touch(node)
 	return 0
 }
 
+func (self *Memfs) readFile(origin string, size int64) ([]byte, error) {
+	fp, err := self.fs.Open(origin, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
 
+	data := resize(nil, size, true)
+	n, err := fp.ReadAt(data, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data[:n], nil
+}
 
-func (self *Memfs) removeNode(path string, dir bool) int {
-	prnt, name, node := self.lookupNode(path, nil)
-	if nil == node {
-		return -fuse.ENOENT
+// queue an upload of node unless one is waiting already
+func (self *Memfs) upload(path string, node *node_t) {
+	if node.queued {
+		return
 	}
-	if !dir && fuse.S_IFDIR == node.stat.Mode&fuse.S_IFMT {
-		return -fuse.EISDIR
+	node.queued = true
+	node.dirty++
+	node.pending = &memOp{Op: "upload", Path: path, node: node}
+	self.syncer.Push(node.pending)
+}
+
+// put the content of a file waiting for upload in the journal
+func (self *Memfs) save(node *node_t) int {
+	if nil == self.syncer.journal || !node.queued {
+		return 0
 	}
-	if dir && fuse.S_IFDIR != node.stat.Mode&fuse.S_IFMT {
-		return -fuse.ENOTDIR
+	err := self.syncer.journal.Save(node.pending, node.data[:node.stat.Size])
+	if err != nil {
+		fmt.Println(err)
+		return -fuse.EIO
+	}
+	return 0
+}
+
+
+
+func (self *Memfs) removeNode(path string, dir bool) int {
+	var prnt, node *node_t
+	var name string
+	for {
+		fetches := self.fetches
+		prnt, name, node = self.lookupNode(path, nil)
+		if nil == node {
+			return -fuse.ENOENT
+		}
+		if !dir && fuse.S_IFDIR == node.stat.Mode&fuse.S_IFMT {
+			return -fuse.EISDIR
+		}
+		if dir && fuse.S_IFDIR != node.stat.Mode&fuse.S_IFMT {
+			return -fuse.ENOTDIR
+		}
+		if errc := self.listNode(node); 0 != errc {
+			return errc
+		}
+		if fetches == self.fetches {
+			break
+		}
 	}
 	if 0 < len(node.chld) {
 		return -fuse.ENOTEMPTY
 	}
 	node.stat.Nlink--
+	if 0 == node.stat.Nlink && 0 == node.opencnt {
+		self.unload(node)
+	}
 	delete(prnt.chld, name)
 	tmsp := fuse.Now()
 	node.stat.Ctim = tmsp
@@ -730,6 +936,9 @@ func (self *Memfs) closeNode(fh uint64) int {
 	node.opencnt--
 	if 0 == node.opencnt {
 		delete(self.openmap, node.stat.Ino)
+		if 0 == node.stat.Nlink {
+			self.unload(node)
+		}
 	}
 	return 0
 }
@@ -755,7 +964,10 @@ func NewMemfs() *Memfs {
 	defer self.synchronize()()
 	self.ino++
 	self.root = newNode(0, self.ino, fuse.S_IFDIR|00777, 0, 0)
+	self.root.origin = "/"
 	self.openmap = map[uint64]*node_t{}
+	self.lru = list.New()
+	self.syncer = newMemSyncer(&self)
 	return &self
 }
 
@@ -793,7 +1005,12 @@ var _ fuse.FileSystemSetchgtime = (*Memfs)(nil)
 
 func main() {
 
-
+	budget := flag.Int64("mem-budget", 1024, "MiB of file content kept in memory (0 for no limit); unsynced changes always stay")
+	spoolDir := flag.String("spool-dir", "", "keep unsynced changes in this directory across crashes (in memory only if empty)")
+	discard := flag.Bool("discard-journal", false, "drop the changes an earlier session left in -spool-dir instead of sending them")
+	var mountOpts mountOptions
+	flag.Var(&mountOpts, "o", "FUSE mount option, may be repeated (anything after -- goes to FUSE as well)")
+	flag.Parse()
 
 	addr := "127.0.0.1:22"
 	config := &ssh.ClientConfig{
@@ -805,31 +1022,54 @@ func main() {
 		//Ciphers: []string{"3des-cbc", "aes256-cbc", "aes192-cbc", "aes128-cbc"},
 	}
 	
-	conn, err := ssh.Dial("tcp", addr, config)
+	remote := NewRemote(addr, config)
+	err := remote.Connect()
 	if err != nil {
 		panic("Failed to dial: " + err.Error())
 	}
-	
-	client, err := sftp.NewClient(conn)
-	if err != nil {
-		panic("Failed to create client: " + err.Error())
-	}
-	
-	
-	cwd, err := client.Getwd()
-	println("Current working directory:", cwd)
 
 
 	memfs := NewMemfs()
-	memfs.client = client
+	memfs.fs = newSftpBackend(remote)
+	memfs.budget = *budget * 1024 * 1024
+
+	if "" != *spoolDir {
+		journal, err := openMemJournal(*spoolDir)
+		if err != nil {
+			panic("Failed to open journal: " + err.Error())
+		}
+
+		// the tree is built from the server, so it has to catch up first
+		ops, err := journal.Pending()
+		if err != nil {
+			panic("Failed to read journal: " + err.Error())
+		}
+		if 0 != len(ops) {
+			fmt.Printf("%d changes from an earlier session were not synced:\n", len(ops))
+			for _, op := range ops {
+				fmt.Printf("  %s\n", op)
+			}
+			if *discard {
+				err = journal.Discard()
+			} else {
+				err = journal.Replay(memfs.fs)
+			}
+			if err != nil {
+				panic("Failed to recover journal: " + err.Error())
+			}
+		}
+		memfs.syncer.journal = journal
+		defer journal.Close()
+	}
 	host := fuse.NewFileSystemHost(memfs)
 	host.SetCapReaddirPlus(true)
-	host.Mount("", append([]string{
+	host.Mount("", mountOpts.Args([]string{
 		"-o", "ExactFileSystemName=NTFS",
 		"-o", fmt.Sprintf("volname=%s", "Nice"),
-	}, os.Args[1:]...))
+	}, flag.Args()))
 	
 	
 	// done
-	client.Close()
+	memfs.syncer.Close()
+	memfs.fs.Close()
 }
@@ -1,3 +1,5 @@
+//go:build !memfs && !sftpfs
+
 /*
  * sshfs.go
  *
@@ -15,14 +17,21 @@ package main
 import (
 	"os"
 	"fmt"
+	"errors"
+	"flag"
+	"net"
+	"crypto/tls"
 	
-	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"	
 	
 	"github.com/winfsp/cgofuse/fuse"
 	
 	"io"
 	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 
@@ -33,15 +42,63 @@ type Node struct {
 	Path  string
 	IsDir bool
 	Size  int
-	fp *sftp.File
-	mknod *sftp.File
+	Mtime time.Time
+	Mode  os.FileMode // 0 if the backend didn't say
+	Pending bool      // made by Mknod, not on the server until uploaded
+}
+
+
+// Open file
+type Handle struct {
+	node *Node
+	fp   File
+	fplock sync.Mutex // a conflict rename swaps fp while others read
+	wbuf *writeBuffer
+	cent *cacheEntry
+	spool *os.File
+
+	// conflict detection
+	target string
+	base   fileBase
+	trunc  bool
+
+	// holds the server lock for -lock-on-open
+	slocked bool
+
+	// -atomic-upload temp file, renamed over target on release
+	temp      string
+	mode      os.FileMode
+	dirty     bool // written or truncated since open
+	discarded bool // target unlinked or replaced since open
+
+	// -versions: the old content is still to be kept before the first write
+	cow     bool
+	cowLock sync.Mutex
 }
 
 
 type Sshfs struct {
 	fuse.FileSystemBase
-	client *sftp.Client
+	fs      Backend
+	lock    sync.Mutex
 	nodes map[string]*Node
+	handles map[uint64]*Handle
+	nexth   uint64
+	cache   *DiskCache
+	host    string
+	journal *offlineJournal
+	offline bool
+	watcher *changeWatcher
+	fshost  *fuse.FileSystemHost
+	conflict string
+	xattrs  xattrStore
+	hashes  map[string]*vxattrHash
+	cacheVerify bool
+	slocks  *serverLocks
+	lockOnOpen bool
+	atomic  bool
+	trash   *trashBin
+	versions *versionStore
 }
 
 
@@ -51,21 +108,184 @@ func (self *Sshfs) Open(path string, flags int) (errc int, fh uint64) {
 
 	fmt.Printf("Open() %s\n", path)
 
-	if _, found := self.nodes[path]; found {
-	
-		//OpenFile(path string, f int) (*File, error)
-	
-		fp, err := self.client.Open(path)
-		if err != nil {
+	node, found := self.lookup(path)
+	if !found {
+		return -fuse.ENOENT, ^uint64(0)
+	}
+	if self.readOnly(path) && writeFlags(flags) {
+		return -fuse.EROFS, ^uint64(0)
+	}
+
+	// truncation waits for the conflict check
+	oflags := osFlags(flags)
+	if conflictOff != self.conflict {
+		oflags &^= os.O_TRUNC
+	}
+
+	// before anything is truncated; there is no lock to take offline
+	slocked := false
+	if self.lockOnOpen && writeFlags(flags) {
+		err := self.slocks.Acquire(path, true)
+		if err != nil && errOffline != err {
 			fmt.Println(err)
-			return -fuse.ENOENT, ^uint64(0)
+			return lockErrc(err), ^uint64(0)
+		}
+		slocked = nil == err
+	}
+	unlock := func() {
+		if slocked {
+			self.slocks.Release(path)
+		}
+	}
+
+	handle := new(Handle)
+	handle.node = node
+	handle.slocked = slocked
+
+	if nil != self.versions && writeFlags(flags) && !node.Pending {
+		handle.cow = true
+		if 0 != flags&fuse.O_TRUNC {
+			err := self.preserve(handle, path)
+			if err != nil && errOffline != err {
+				fmt.Println(err)
+				unlock()
+				return fuseErrc(err), ^uint64(0)
+			}
 		}
-		self.nodes[path].fp = fp
+	}
 
-		return 0, 0
-		
+	var err error
+	if self.atomic && writeFlags(flags) {
+		// the conflict check moves to the rename
+		err = self.openAtomic(handle, path, 0 != flags&fuse.O_TRUNC)
 	} else {
-		return -fuse.ENOENT, ^uint64(0)
+		handle.fp, err = self.fs.Open(path, oflags)
+	}
+	if errOffline == err {
+		unlock()
+		return self.openOffline(path, node, flags)
+	}
+	if err != nil {
+		fmt.Println(err)
+		unlock()
+		return fuseErrc(err), ^uint64(0)
+	}
+
+	if writeFlags(flags) {
+		handle.wbuf = newWriteBuffer(handle.fp)
+		if "" == handle.temp {
+			handle.trunc = 0 != flags&fuse.O_TRUNC && 0 == oflags&os.O_TRUNC
+			if err := self.guard(handle, path); err != nil {
+				fmt.Println(err)
+				handle.fp.Close()
+				unlock()
+				return fuseErrc(err), ^uint64(0)
+			}
+		}
+	} else if nil != self.cache {
+		// validate cached content against the remote size and mtime
+		info, err := handle.fp.Stat()
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			handle.cent = self.cache.Entry(self.host, path, info.Size(), info.ModTime(), "")
+			if self.cacheVerify {
+				self.verifyCache(path, handle.cent)
+			}
+		}
+	}
+	if 0 != flags&fuse.O_TRUNC {
+		node.Size = 0
+	}
+
+	return 0, self.newHandle(handle)
+}
+
+
+// serve reads from the cache and journal writes while disconnected
+func (self *Sshfs) openOffline(path string, node *Node, flags int) (errc int, fh uint64) {
+
+	if !self.offline {
+		return -fuse.EIO, ^uint64(0)
+	}
+
+	handle := new(Handle)
+	handle.node = node
+	handle.cent = self.cache.Entry(self.host, path, int64(node.Size), node.Mtime, "")
+
+	if writeFlags(flags) {
+		if nil == self.journal {
+			return -fuse.EIO, ^uint64(0)
+		}
+
+		rec, found := self.journal.Find(path)
+		trunc := 0 != flags&fuse.O_TRUNC
+		if !found {
+			rec = &journalRecord{path, node.Pending, int64(node.Size), node.Mtime.Unix()}
+		}
+
+		spool, err := self.journal.Begin(rec, trunc)
+		if err != nil {
+			fmt.Println(err)
+			return -fuse.EIO, ^uint64(0)
+		}
+
+		// a new journal entry starts from the cached remote content
+		if !found && !trunc {
+			buff := make([]byte, node.Size)
+			_, err = handle.cent.ReadAt(buff, 0, offlineFetch)
+			if nil == err || io.EOF == err {
+				_, err = spool.WriteAt(buff, 0)
+			}
+			if nil != err && io.EOF != err {
+				fmt.Printf("offline write %s: content not cached\n", path)
+				spool.Close()
+				self.journal.Done(rec)
+				return -fuse.EIO, ^uint64(0)
+			}
+		}
+		if trunc {
+			node.Size = 0
+		}
+
+		handle.cent = nil
+		handle.spool = spool
+	}
+
+	return 0, self.newHandle(handle)
+}
+
+
+func offlineFetch(buff []byte, ofst int64) (int, error) {
+	return 0, errOffline
+}
+
+
+func (self *Sshfs) newHandle(handle *Handle) uint64 {
+	defer self.synchronize()()
+	self.nexth++
+	self.handles[self.nexth] = handle
+	return self.nexth
+}
+
+
+func (self *Sshfs) getHandle(fh uint64) *Handle {
+	defer self.synchronize()()
+	return self.handles[fh]
+}
+
+
+func (self *Sshfs) lookup(path string) (*Node, bool) {
+	defer self.synchronize()()
+	node, found := self.nodes[path]
+	return node, found
+}
+
+
+func (self *Sshfs) synchronize() func() {
+	self.lock.Lock()
+	return func() {
+		self.lock.Unlock()
 	}
 }
 
@@ -78,19 +298,83 @@ func (self *Sshfs) Opendir(path string) (errc int, fh uint64) {
 
 func (self *Sshfs) Unlink(path string) (errc int) {
 	
-	err := self.client.Remove(path)
+	if self.readOnly(path) {
+		return -fuse.EROFS
+	}
+
+	if node, found := self.lookup(path); found && node.Pending {
+		self.forget(path)
+		return 0
+	}
+
+	if nil != self.trash {
+		return self.toTrash(path)
+	}
+
+	err := self.fs.Remove(path)
 	if err != nil {
 		fmt.Println(err)
+		return fuseErrc(err)
+	}
+	self.forget(path)
+	if nil != self.xattrs {
+		if err := self.xattrs.Delete(path); err != nil {
+			fmt.Println(err)
+		}
 	}
 	return 0
 }
 
 
 func (self *Sshfs) Rmdir(path string) (errc int) {
-	
-	err := self.client.RemoveDirectory(path)
+
+	if self.readOnly(path) {
+		return -fuse.EROFS
+	}
+
+	if nil != self.trash {
+		// a rename would take a full directory along
+		infos, err := self.fs.ReadDir(path)
+		if err != nil {
+			fmt.Println(err)
+			return fuseErrc(err)
+		}
+		for _, info := range infos {
+			if !self.hidden(path, info.Name()) {
+				return -fuse.ENOTEMPTY
+			}
+		}
+		return self.toTrash(path)
+	}
+
+	if nil != self.xattrs {
+		// ._ files and the sidecar would keep the directory from going away
+		self.removeHidden(path)
+	}
+	err := self.fs.Remove(path)
+	if err != nil {
+		fmt.Println(err)
+		return fuseErrc(err)
+	}
+	self.forget(path)
+	return 0
+}
+
+
+// delete by moving into the trash, xattrs and all
+func (self *Sshfs) toTrash(path string) (errc int) {
+
+	trashed, err := self.trash.Put(path)
 	if err != nil {
 		fmt.Println(err)
+		return fuseErrc(err)
+	}
+	fmt.Printf("trashed %s as %s\n", path, trashed)
+	self.forget(path)
+	if nil != self.xattrs {
+		if err := self.xattrs.Rename(path, trashed); err != nil {
+			fmt.Println(err)
+		}
 	}
 	return 0
 }
@@ -99,43 +383,204 @@ func (self *Sshfs) Rmdir(path string) (errc int) {
 func (self *Sshfs) Rename(oldpath string, newpath string) (errc int) {
 
 	fmt.Printf("Rename() %s %s\n", oldpath, newpath)
+	if self.readOnly(oldpath) || self.readOnly(newpath) {
+		return -fuse.EROFS
+	}
 
-	err := self.client.Rename(oldpath, newpath)
+	newpath, err := self.renameTarget(newpath)
+	if err != nil {
+		return fuseErrc(err)
+	}
+
+	if node, found := self.lookup(oldpath); found && node.Pending {
+		return self.renamePending(node, oldpath, newpath)
+	}
+
+	err = self.fs.Rename(oldpath, newpath)
 	if err != nil {
 		fmt.Println(err)
+		return fuseErrc(err)
 	}	
+	self.invalidate(oldpath)
+	self.invalidate(newpath)
+	if oldpath != newpath {
+		self.discard(newpath)
+	}
+	self.rebase(oldpath, newpath)
+	if nil != self.slocks {
+		self.slocks.Rename(oldpath, newpath)
+	}
+	if nil != self.xattrs {
+		if err := self.xattrs.Rename(oldpath, newpath); err != nil {
+			fmt.Println(err)
+		}
+	}
 	
-	info, err := self.client.Stat(newpath)	
+	info, err := self.fs.Stat(newpath)	
 	if err != nil {
 		fmt.Println(err)
+		return fuseErrc(err)
 	}	
 	
 	node := new(Node)
 	node.IsDir = info.IsDir()
 	node.Size = int(info.Size())
+	node.Mtime = info.ModTime()
+	node.Mode = info.Mode()
 	node.Path = newpath	
+	self.lock.Lock()
+	delete(self.nodes, oldpath)
 	self.nodes[newpath] = node
+	self.lock.Unlock()
 	
 	return 0
 }
 
 
+// a file not on the server yet only changes its name; the upload on
+// release goes to the new one and replaces what is there
+func (self *Sshfs) renamePending(node *Node, oldpath string, newpath string) (errc int) {
+
+	if info, err := self.fs.Stat(newpath); nil == err && info.IsDir() {
+		return -fuse.EISDIR
+	}
+	if oldpath != newpath {
+		self.discard(newpath)
+	}
+
+	self.lock.Lock()
+	delete(self.nodes, oldpath)
+	node.Path = newpath
+	self.nodes[newpath] = node
+	for _, handle := range self.handles {
+		if node == handle.node {
+			handle.target = newpath
+		}
+	}
+	self.lock.Unlock()
+
+	self.invalidate(newpath)
+	if nil != self.slocks {
+		self.slocks.Rename(oldpath, newpath)
+	}
+	return 0
+}
+
+
+func (self *Sshfs) Chmod(path string, mode uint32) (errc int) {
+
+	if self.readOnly(path) {
+		return -fuse.EROFS
+	}
+
+	self.lock.Lock()
+	node, found := self.nodes[path]
+	if found && node.Pending {
+		// applied on upload
+		node.Mode = os.FileMode(mode & 0777)
+		self.lock.Unlock()
+		return 0
+	}
+	self.lock.Unlock()
+
+	err := self.fs.Chmod(path, os.FileMode(mode&07777))
+	if err != nil {
+		fmt.Println(err)
+		return fuseErrc(err)
+	}
+	self.rebase(path, path)
+	return 0
+}
+
+
+func (self *Sshfs) Utimens(path string, tmsp []fuse.Timespec) (errc int) {
+
+	if self.readOnly(path) {
+		return -fuse.EROFS
+	}
+
+	now := time.Now()
+	atime, mtime := now, now
+	if nil != tmsp {
+		atime = tmsp[0].Time()
+		mtime = tmsp[1].Time()
+	}
+
+	if node, found := self.lookup(path); found && node.Pending {
+		// the upload sets its own
+		return 0
+	}
+
+	err := self.fs.Chtimes(path, atime, mtime)
+	if err != nil {
+		fmt.Println(err)
+		return fuseErrc(err)
+	}
+
+	self.lock.Lock()
+	if node, found := self.nodes[path]; found {
+		node.Mtime = mtime
+	}
+	self.lock.Unlock()
+	self.rebase(path, path)
+	return 0
+}
+
+
+func (self *Sshfs) Symlink(target string, newpath string) (errc int) {
+
+	if self.readOnly(newpath) {
+		return -fuse.EROFS
+	}
+
+	err := self.fs.Symlink(target, newpath)
+	if err != nil {
+		fmt.Println(err)
+		return fuseErrc(err)
+	}
+	return 0
+}
+
+
+func (self *Sshfs) Readlink(path string) (errc int, target string) {
+
+	readlinker, ok := self.fs.(Readlinker)
+	if !ok {
+		return -fuse.ENOSYS, ""
+	}
+
+	target, err := readlinker.Readlink(path)
+	if err != nil {
+		fmt.Println(err)
+		return fuseErrc(err), ""
+	}
+	return 0, target
+}
+
+
 func (self *Sshfs) Mkdir(path string, mode uint32) (errc int) {
 	// pre_write
 	// create file 
 	// then open
 	fmt.Printf("Mkdir => %s\n", path)
 	
-	err := self.client.MkdirAll(path)
+	if self.readOnly(path) {
+		return -fuse.EROFS
+	}
+
+	err := self.fs.Mkdir(path)
 	if err != nil {
-		return
+		fmt.Println(err)
+		return fuseErrc(err)
 	}
 	
 	node := new(Node)
 	node.IsDir = true
 	node.Size = 0
 	node.Path = path	
+	self.lock.Lock()
 	self.nodes[path] = node
+	self.lock.Unlock()
 
 	return
 }
@@ -148,18 +593,46 @@ func (self *Sshfs) Mknod(path string, mode uint32, dev uint64) (errc int) {
 	// then open
 	fmt.Printf("Mknod => %s\n", path)
 	
+	if self.readOnly(path) {
+		return -fuse.EROFS
+	}
 
-	fp, err := self.client.Create(path)
-	if err != nil {
-		return
+	if self.atomic {
+		// uploaded under its name when first released
+		node := new(Node)
+		node.Path = path
+		node.Mode = os.FileMode(mode & 0777)
+		node.Mtime = time.Now()
+		node.Pending = true
+		self.lock.Lock()
+		self.nodes[path] = node
+		self.lock.Unlock()
+		return 0
+	}
+
+	fp, err := self.fs.Create(path)
+	if errOffline == err && nil != self.journal {
+		// created on the server when the journal is replayed
+		spool, err := self.journal.Begin(&journalRecord{path, true, 0, 0}, true)
+		if err != nil {
+			fmt.Println(err)
+			return -fuse.EIO
+		}
+		spool.Close()
+	} else if err != nil {
+		fmt.Println(err)
+		return fuseErrc(err)
+	} else {
+		fp.Close()
 	}
 	
 	node := new(Node)
 	node.IsDir = false
 	node.Size = 0
 	node.Path = path	
-	node.mknod = fp
+	self.lock.Lock()
 	self.nodes[path] = node
+	self.lock.Unlock()
 
 	return
 }
@@ -173,14 +646,30 @@ func (self *Sshfs) Getattr(path string, stat *fuse.Stat_t, fh uint64) (errc int)
 	if path == "/" {
 		stat.Mode = fuse.S_IFDIR | 0777
 		return 0	
-	} else if node, found := self.nodes[path]; found {
+	} else if node, found := self.lookup(path); found {
 	
-		if node.IsDir == true {
-			stat.Mode = fuse.S_IFDIR | 0777
+		perm := uint32(0777)
+		if 0 != node.Mode {
+			// real permissions, owned by whoever asks
+			perm = uint32(node.Mode.Perm())
+			stat.Uid, stat.Gid, _ = fuse.Getcontext()
+		}
+		if self.readOnly(path) {
+			perm &^= 0222
+		}
+
+		if 0 != node.Mode&os.ModeSymlink {
+			stat.Mode = fuse.S_IFLNK | 0777
+		} else if node.IsDir == true {
+			stat.Mode = fuse.S_IFDIR | perm
 		} else {
-			stat.Mode = fuse.S_IFREG | 0777
+			stat.Mode = fuse.S_IFREG | perm
 			stat.Size = int64(node.Size)	
 		}
+		if !node.Mtime.IsZero() {
+			stat.Mtim = fuse.NewTimespec(node.Mtime)
+			stat.Ctim = stat.Mtim
+		}
 
 		return 0		
 	} else {
@@ -194,22 +683,35 @@ func (self *Sshfs) Write(path string, buff []byte, ofst int64, fh uint64) (n int
 	fmt.Printf("Write() %s\n", path)
 	fmt.Printf("Write(?) %d\n", len(buff))
 
-	if node, found := self.nodes[path]; found {
-	
-		n, err := node.mknod.WriteAt(buff, ofst)
-		if nil != err && io.EOF != err {
-			//n = fuseErrc(err)
-			return 0
-		}
-		self.nodes[path].Size += n
+	handle := self.getHandle(fh)
+	if nil == handle || (nil == handle.wbuf && nil == handle.spool) {
+		return -fuse.EBADF
+	}
+
+	// nothing is written before the old content is kept
+	err := self.preserve(handle, path)
+	if nil != err {
+		fmt.Println(err)
+		return fuseErrc(err)
+	}
 
-		return n		
+	if nil != handle.spool {
+		n, err = handle.spool.WriteAt(buff, ofst)
 	} else {
-		n = -fuse.EIO
-		return 0 
+		// buffered; errors from earlier chunks surface here or on close
+		n, err = handle.wbuf.WriteAt(buff, ofst)
+	}
+	if nil != err {
+		fmt.Println(err)
+		return fuseErrc(err)
 	}
 
-	return 0
+	defer self.synchronize()()
+	if end := int(ofst) + n; end > handle.node.Size {
+		handle.node.Size = end
+	}
+	handle.dirty = true
+	return n
 }
 
 
@@ -217,24 +719,227 @@ func (self *Sshfs) Read(path string, buff []byte, ofst int64, fh uint64) (n int)
 
 	fmt.Printf("Read() %s\n", path)
 
-	if node, found := self.nodes[path]; found {
-	
-		n, err := node.fp.ReadAt(buff, ofst)
-		if nil != err && io.EOF != err {
-			//n = fuseErrc(err)
-			return 0
+	handle := self.getHandle(fh)
+	if nil == handle {
+		return -fuse.EBADF
+	}
+
+	// read back our own buffered writes
+	if nil != handle.wbuf && handle.wbuf.Dirty() {
+		if err := handle.wbuf.Flush(); nil != err {
+			fmt.Println(err)
+			return fuseErrc(err)
 		}
+	}
 
-		return n		
+	var err error
+	if nil != handle.spool {
+		n, err = handle.spool.ReadAt(buff, ofst)
+	} else if nil != handle.cent {
+		n, err = handle.cent.ReadAt(buff, ofst, handle.fetch)
 	} else {
-		n = -fuse.EIO
-		return 0 
+		n, err = handle.file().ReadAt(buff, ofst)
+	}
+	if nil != err && io.EOF != err {
+		fmt.Println(err)
+		return fuseErrc(err)
+	}
+
+	return n
+}
+
+
+func (self *Sshfs) Flush(path string, fh uint64) (errc int) {
+
+	fmt.Printf("Flush() %s\n", path)
+
+	handle := self.getHandle(fh)
+	if nil == handle {
+		return -fuse.EBADF
+	}
+	if nil == handle.wbuf {
+		return 0
 	}
 
+	err := handle.wbuf.Flush()
+	if nil != err {
+		fmt.Println(err)
+		return fuseErrc(err)
+	}
 	return 0
 }
 
 
+func (self *Sshfs) Fsync(path string, datasync bool, fh uint64) (errc int) {
+
+	errc = self.Flush(path, fh)
+	if 0 != errc {
+		return
+	}
+
+	handle := self.getHandle(fh)
+	if nil != handle.spool {
+		err := handle.spool.Sync()
+		if nil != err {
+			fmt.Println(err)
+			return -fuse.EIO
+		}
+		return 0
+	}
+
+	if syncer, ok := handle.file().(Syncer); ok && nil != handle.wbuf {
+		err := syncer.Sync()
+		if nil != err && -fuse.ENOSYS != fuseErrc(err) {
+			fmt.Println(err)
+			return fuseErrc(err)
+		}
+	}
+	return 0
+}
+
+
+func (self *Sshfs) Release(path string, fh uint64) (errc int) {
+
+	fmt.Printf("Release() %s\n", path)
+
+	self.lock.Lock()
+	handle, found := self.handles[fh]
+	delete(self.handles, fh)
+	self.lock.Unlock()
+	if !found {
+		return -fuse.EBADF
+	}
+
+	// deferred write errors are reported on close
+	if nil != handle.wbuf {
+		if err := handle.wbuf.Flush(); nil != err {
+			fmt.Println(err)
+			errc = fuseErrc(err)
+		}
+	}
+	if handle.trunc && 0 == errc {
+		// opened with O_TRUNC but never written
+		if _, err := self.commit(handle); nil != err {
+			fmt.Println(err)
+			errc = fuseErrc(err)
+		}
+	}
+	if nil != handle.spool {
+		if err := handle.spool.Close(); nil != err {
+			fmt.Println(err)
+			errc = -fuse.EIO
+		}
+	}
+	// what our writes made of the file, for later conflict checks
+	var info os.FileInfo
+	if nil != handle.wbuf && 0 == errc && ("" == handle.temp || handle.dirty) {
+		info, _ = handle.fp.Stat()
+	}
+	if nil != handle.fp {
+		if err := handle.fp.Close(); nil != err && 0 == errc {
+			fmt.Println(err)
+			errc = fuseErrc(err)
+		}
+	}
+	if "" != handle.temp {
+		if err := self.finishAtomic(handle, 0 != errc); nil != err {
+			fmt.Println(err)
+			errc = fuseErrc(err)
+		}
+	}
+	if nil != handle.wbuf {
+		self.invalidate(path)
+		if nil != info && 0 == errc {
+			self.lock.Lock()
+			if path == handle.target {
+				handle.node.Size = int(info.Size())
+				handle.node.Mtime = info.ModTime()
+			}
+			self.lock.Unlock()
+		}
+	}
+	if handle.slocked {
+		self.slocks.Release(path)
+	}
+	return
+}
+
+
+// fetch uncached blocks; fails fast while offline
+func (self *Handle) fetch(buff []byte, ofst int64) (int, error) {
+	fp := self.file()
+	if nil == fp {
+		return offlineFetch(buff, ofst)
+	}
+	return fp.ReadAt(buff, ofst)
+}
+
+
+func (self *Handle) file() File {
+	self.fplock.Lock()
+	defer self.fplock.Unlock()
+	return self.fp
+}
+
+
+func (self *Sshfs) watch(interval time.Duration) {
+	self.watcher = newChangeWatcher(interval)
+	self.watcher.list = self.listDir
+	self.watcher.stat = self.statAttr
+	self.watcher.changed = self.changed
+	if execer, ok := self.fs.(Execer); ok {
+		self.watcher.exec = execer
+	}
+}
+
+
+// keep a remote inotifywait running across reconnects
+func (self *Sshfs) inotify(root string, stop chan struct{}) {
+	for {
+		err := self.watcher.Inotify(root)
+		fmt.Printf("inotify %s: %v\n", root, err)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+
+// upload files written while offline
+func (self *Sshfs) replay() {
+
+	if nil == self.journal {
+		return
+	}
+
+	for _, path := range self.journal.Replay(self.fs) {
+		self.invalidate(path)
+	}
+}
+
+
+// the remote entry is gone
+func (self *Sshfs) forget(path string) {
+	self.lock.Lock()
+	delete(self.nodes, path)
+	delete(self.hashes, path)
+	self.lock.Unlock()
+	self.invalidate(path)
+	self.discard(path)
+}
+
+
+// drop cached content of a changed remote file
+func (self *Sshfs) invalidate(path string) {
+	if nil != self.cache {
+		self.cache.Invalidate(self.host, path)
+	}
+}
+
+
 func stringInSlice(a string, list []string) bool {
     for _, b := range list {
         if b == a {
@@ -286,32 +991,60 @@ func (self *Sshfs) Readdir(path string,
 	fill("..", nil, 0)
 	
 	
-	entries, err := self.client.ReadDir(path)
-	if err != nil {
+	entries, err := self.listDir(path)
+	if err == nil {
+		if nil != self.cache {
+			self.cache.StoreListing(self.host, path, entries)
+		}
+		if nil != self.watcher {
+			self.watcher.Touch(path, entries)
+		}
+	} else if errOffline == err && self.offline {
+		// last listing seen while online
+		var found bool
+		entries, found = self.cache.LoadListing(self.host, path)
+		if !found {
+			return -fuse.EIO
+		}
+	} else if errOffline == err {
+		return -fuse.EIO
+	}
+
+	if err != nil && errOffline != err {
 		fmt.Println(err)
 	} else {
 	
 		//self.updateInodes(path, entries)
+		if self.atomic && nil == err {
+			self.cleanAtomic(path, entries)
+		}
 	
 		for _, entry := range entries {
-		
-			fill(entry.Name(), nil, 0)
+
+			if self.hidden(path, entry.Name) {
+				continue
+			}
+			fill(entry.Name, nil, 0)
 			
 			// add node to Cache for Getattr()
 			node := new(Node)
-			node.IsDir = entry.IsDir()
-			node.Size = int(entry.Size())
+			node.IsDir = entry.IsDir
+			node.Size = int(entry.Size)
+			node.Mtime = time.Unix(entry.Mtime, 0)
+			node.Mode = entry.Mode
 			if path == "/" {
-				node.Path = path + entry.Name()
+				node.Path = path + entry.Name
 			} else {
-				node.Path = path + "/" + entry.Name()
+				node.Path = path + "/" + entry.Name
 			}
 			
 			
 			
 			fmt.Printf("%+v\n", node)
 			
+			self.lock.Lock()
 			self.nodes[node.Path] = node
+			self.lock.Unlock()
 			
 			
 		}
@@ -325,71 +1058,576 @@ func (self *Sshfs) Readdir(path string,
 }
 
 
+// kept versions can be looked at but not changed
+func (self *Sshfs) readOnly(path string) bool {
+	return nil != self.versions && isVersionPath(path)
+}
+
+
+// keep the old content of a file opened for writing, once
+func (self *Sshfs) preserve(handle *Handle, path string) error {
+
+	handle.cowLock.Lock()
+	defer handle.cowLock.Unlock()
+	if !handle.cow {
+		return nil
+	}
+	err := self.versions.Preserve(path)
+	if nil == err {
+		handle.cow = false
+	}
+	return err
+}
+
+
+// our own files on the server, kept out of listings
+func (self *Sshfs) hidden(dir string, name string) bool {
+	switch {
+	case nil != self.xattrs && self.xattrs.Hidden(name):
+		return true
+	case nil != self.slocks && isServerLockName(name):
+		return true
+	case self.atomic && isAtomicTemp(name):
+		return true
+	case nil != self.trash && "/" == dir && path.Base(trashDir) == name:
+		return true
+	}
+	return false
+}
+
+
+func (self *Sshfs) listDir(path string) ([]cacheAttr, error) {
+
+	infos, err := self.fs.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]cacheAttr, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, infoAttr(info))
+	}
+	return entries, nil
+}
+
+
+func (self *Sshfs) statAttr(path string) (*cacheAttr, error) {
+
+	info, err := self.fs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	attr := infoAttr(info)
+	return &attr, nil
+}
+
+
+// a remote change was detected; update the node cache and tell the OS
+func (self *Sshfs) changed(path string, action uint32, attr *cacheAttr) {
+
+	fmt.Printf("[remote change] %s %#x\n", path, action)
+
+	self.lock.Lock()
+	if nil == attr {
+		delete(self.nodes, path)
+	} else {
+		node := new(Node)
+		node.IsDir = attr.IsDir
+		node.Size = int(attr.Size)
+		node.Mtime = time.Unix(attr.Mtime, 0)
+		node.Mode = attr.Mode
+		node.Path = path
+		self.nodes[path] = node
+	}
+	self.lock.Unlock()
+
+	self.invalidate(path)
+	if nil != self.fshost {
+		self.fshost.Notify(path, action)
+	}
+}
+
+
 func (self *Sshfs) Statfs(path string, stat *fuse.Statfs_t) (err int) {
 	
 	fmt.Printf("STAT FS!!! %s\n", path)
 	
 
 	// ssh sftp has StatVFS but ftp, github api, aws sdk might not
-	info, _ := self.client.StatVFS(path)	
-	stat.Bsize = info.Bsize
-	stat.Frsize = info.Frsize
-	stat.Blocks = info.Blocks
-	stat.Bfree  = info.Bfree
-	stat.Bavail = info.Bavail
-	stat.Files  = info.Files
-	stat.Ffree  = info.Ffree
-	stat.Favail = info.Favail
-	stat.Namemax = info.Namemax
+	e := self.fs.StatVFS(path, stat)	
+	if e != nil {
+		fmt.Println(e)
+		return fuseErrc(e)
+	}
 	return 0
 }
 
 
-func main() {
+func (self *Sshfs) exists(path string) bool {
+	if "/" == path {
+		return true
+	}
+	if _, found := self.lookup(path); found {
+		return true
+	}
+	_, err := self.fs.Stat(path)
+	return err == nil
+}
 
 
-	addr := "127.0.0.1:22"
-	config := &ssh.ClientConfig{
-		User: "user1",
-		Auth: []ssh.AuthMethod{
-			ssh.Password("password-here"),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		//Ciphers: []string{"3des-cbc", "aes256-cbc", "aes192-cbc", "aes128-cbc"},
+// remove the xattr files of a directory about to be removed
+func (self *Sshfs) removeHidden(dir string) {
+
+	infos, err := self.fs.ReadDir(dir)
+	if err != nil {
+		return
 	}
-	
-	conn, err := ssh.Dial("tcp", addr, config)
+	for _, info := range infos {
+		if self.xattrs.Hidden(info.Name()) {
+			if err := self.fs.Remove(path.Join(dir, info.Name())); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+}
+
+
+func xattrErrc(err error) int {
+	if errors.Is(err, errors.ErrUnsupported) {
+		return -fuse.ENOTSUP
+	}
+	return fuseErrc(err)
+}
+
+
+func (self *Sshfs) Setxattr(path string, name string, value []byte, flags int) (errc int) {
+
+	fmt.Printf("Setxattr() %s %s\n", path, name)
+
+	if isVirtualXattr(name) {
+		return -fuse.EPERM
+	}
+	if self.readOnly(path) {
+		return -fuse.EROFS
+	}
+	if nil == self.xattrs {
+		return -fuse.ENOTSUP
+	}
+	if !self.exists(path) {
+		return -fuse.ENOENT
+	}
+
+	if fuse.XATTR_CREATE == flags || fuse.XATTR_REPLACE == flags {
+		attrs, err := self.xattrs.List(path)
+		if err != nil {
+			fmt.Println(err)
+			return xattrErrc(err)
+		}
+		_, found := attrs[name]
+		if fuse.XATTR_CREATE == flags && found {
+			return -fuse.EEXIST
+		}
+		if fuse.XATTR_REPLACE == flags && !found {
+			return -fuse.ENOATTR
+		}
+	}
+
+	err := self.xattrs.Set(path, name, value)
 	if err != nil {
-		panic("Failed to dial: " + err.Error())
+		fmt.Println(err)
+		return xattrErrc(err)
 	}
-	
-	client, err := sftp.NewClient(conn)
+	return 0
+}
+
+
+func (self *Sshfs) Getxattr(path string, name string) (errc int, xatr []byte) {
+
+	fmt.Printf("Getxattr() %s %s\n", path, name)
+
+	if !self.exists(path) {
+		return -fuse.ENOENT, nil
+	}
+	if isVirtualXattr(name) {
+		return self.virtualXattr(path, name)
+	}
+	if nil == self.xattrs {
+		return -fuse.ENOTSUP, nil
+	}
+
+	attrs, err := self.xattrs.List(path)
 	if err != nil {
-		panic("Failed to create client: " + err.Error())
+		fmt.Println(err)
+		return xattrErrc(err), nil
 	}
-	
-	cwd, err := client.Getwd()
-	println("Current working directory:", cwd)
+	xatr, found := attrs[name]
+	if !found {
+		return -fuse.ENOATTR, nil
+	}
+	return 0, xatr
+}
 
 
+func (self *Sshfs) Removexattr(path string, name string) (errc int) {
+
+	if isVirtualXattr(name) {
+		return -fuse.EPERM
+	}
+	if self.readOnly(path) {
+		return -fuse.EROFS
+	}
+	if nil == self.xattrs {
+		return -fuse.ENOTSUP
+	}
+	if !self.exists(path) {
+		return -fuse.ENOENT
+	}
+
+	attrs, err := self.xattrs.List(path)
+	if err != nil {
+		fmt.Println(err)
+		return xattrErrc(err)
+	}
+	if _, found := attrs[name]; !found {
+		return -fuse.ENOATTR
+	}
+	err = self.xattrs.Remove(path, name)
+	if err != nil {
+		fmt.Println(err)
+		return xattrErrc(err)
+	}
+	return 0
+}
+
+
+func (self *Sshfs) Listxattr(path string, fill func(name string) bool) (errc int) {
+
+	if !self.exists(path) {
+		return -fuse.ENOENT
+	}
+	for _, name := range self.virtualXattrs(path) {
+		if !fill(name) {
+			return -fuse.ERANGE
+		}
+	}
+	if nil == self.xattrs {
+		return 0
+	}
+
+	attrs, err := self.xattrs.List(path)
+	if err != nil {
+		fmt.Println(err)
+		return xattrErrc(err)
+	}
+	for name := range attrs {
+		if isVirtualXattr(name) {
+			continue
+		}
+		if !fill(name) {
+			return -fuse.ERANGE
+		}
+	}
+	return 0
+}
+
+
+func main() {
+
+	backend := flag.String("backend", "sftp", "storage protocol: sftp, ftp, s3, webdav, http, local or hosts")
+	addr := flag.String("addr", "127.0.0.1:22", "server address (base URL for webdav and http, directory for local, host list file for hosts)")
+	user := flag.String("user", "user1", "login user (access key for s3)")
+	password := flag.String("password", "password-here", "login password (secret key for s3)")
+	ftpTLS := flag.String("ftp-tls", "none", "FTPS mode for -backend ftp: none, explicit or implicit")
+	ftpActive := flag.Bool("ftp-active", false, "use active mode data connections for -backend ftp")
+	ftpInsecure := flag.Bool("ftp-insecure", false, "don't verify the FTPS server certificate")
+	s3Bucket := flag.String("s3-bucket", "", "bucket mounted by -backend s3")
+	s3Prefix := flag.String("s3-prefix", "", "key prefix within the bucket mounted as the root")
+	s3Region := flag.String("s3-region", "", "bucket region (empty to detect)")
+	s3HTTP := flag.Bool("s3-http", false, "talk plain http to the s3 endpoint")
+	httpManifest := flag.String("http-manifest", "", "JSON manifest listing the -backend http tree, as a local file or URL")
+	hostsIdle := flag.Duration("hosts-idle", 5 * time.Minute, "close -backend hosts connections unused for this long (0 to keep them)")
+	unionLower := flag.String("union-lower", "", "comma separated backend URLs stacked read-only under -backend, highest first")
+	archive := flag.String("archive", "", "mount this tar, tar.gz or zip file from the backend read-only instead")
+	injectLatency := flag.Duration("inject-latency", 0, "delay added to every -backend local operation")
+	injectBandwidth := flag.Int64("inject-bandwidth", 0, "-backend local read/write throughput in bytes per second (0 for unlimited)")
+	injectErrors := flag.Float64("inject-errors", 0, "fraction of -backend local operations that fail with EIO")
+	cacheDir := flag.String("cache-dir", "", "persistent content cache directory (disabled if empty)")
+	cacheSize := flag.Int64("cache-size", 1024, "content cache size limit in MiB")
+	cacheVerify := flag.Bool("cache-verify", false, "check fully cached files against a hash computed on the server when opened")
+	hashAlg := flag.String("hash", "sha256", "algorithm for the verify command: md5, sha1, sha224, sha256, sha384 or sha512")
+	offline := flag.Bool("offline", false, "serve cached content while the server is unreachable (needs -cache-dir)")
+	offlineWrites := flag.Bool("offline-writes", false, "journal writes made while offline and replay them on reconnect (needs -offline)")
+	conflict := flag.String("conflict", conflictLWW, "when a file changed remotely while open for writing: off, fail, rename or lww")
+	notify := flag.String("notify", "off", "detect remote changes: off, poll or inotify")
+	notifyInterval := flag.Duration("notify-interval", 10 * time.Second, "poll interval for -notify poll")
+	notifyRoot := flag.String("notify-root", "", "remote directory watched recursively by -notify inotify")
+	lockLease := flag.Duration("lock-lease", 0, "lease of the server locks taken by -lock-on-open, renewed while held")
+	lockOnOpen := flag.Bool("lock-on-open", false, "hold a server lock other mounts see on files open for writing (needs -lock-lease); flock and fcntl (POSIX) locks aren't tracked per handle or shared, they stay local to the mount")
+	trash := flag.Bool("trash", false, "move deleted files and directories into .trash on the server instead of removing them (not with -backend hosts)")
+	trashKeep := flag.Duration("trash-keep", 30 * 24 * time.Hour, "purge trash entries deleted longer ago than this (0 to keep them)")
+	versions := flag.Int("versions", 0, "keep this many earlier versions of overwritten files in a read-only .versions directory (0 for none; not with -backend hosts)")
+	atomicUpload := flag.Bool("atomic-upload", false, "write files to a hidden temp file and rename it into place on close")
+	xattrMode := flag.String("xattr", "off", "keep extended attributes: off, exec (getfattr/setfattr on the server), appledouble (._name files) or sidecar (one file per directory)")
+	var mountOpts mountOptions
+	flag.Var(&mountOpts, "o", "FUSE mount option, may be repeated (anything after -- goes to FUSE as well)")
+	flag.Parse()
+
+
+	if *offline && "" == *cacheDir {
+		panic("-offline needs -cache-dir")
+	}
+	if *cacheVerify && "" == *cacheDir {
+		panic("-cache-verify needs -cache-dir")
+	}
+	if *lockOnOpen && 0 == *lockLease {
+		panic("-lock-on-open needs -lock-lease")
+	}
+	// the top level holds the hosts and nothing else
+	if *trash && "hosts" == *backend {
+		panic("-trash doesn't work with -backend hosts")
+	}
+	if 0 < *versions && "hosts" == *backend {
+		panic("-versions doesn't work with -backend hosts")
+	}
 
 	sshfs := &Sshfs{}
+	online := true
+	var reconnect *Remote // started once everything is in place
+	var err error
+
+	switch *backend {
+	case "sftp":
+		config := &ssh.ClientConfig{
+			User: *user,
+			Auth: []ssh.AuthMethod{
+				ssh.Password(*password),
+			},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			//Ciphers: []string{"3des-cbc", "aes256-cbc", "aes192-cbc", "aes128-cbc"},
+		}
+
+		remote := NewRemote(*addr, config)
+		err = remote.Connect()
+		if err != nil {
+			if !*offline {
+				panic("Failed to dial: " + err.Error())
+			}
+			fmt.Printf("starting offline: %s\n", err)
+			online = false
+			reconnect = remote
+		}
+		sshfs.fs = newSftpBackend(remote)
+		sshfs.host = *user + "@" + *addr
+
+	case "ftp":
+		switch *ftpTLS {
+		case "none", "explicit", "implicit":
+		default:
+			panic("unknown -ftp-tls mode: " + *ftpTLS)
+		}
+		host, _, _ := net.SplitHostPort(*addr)
+		config := &ftpConfig{
+			addr: *addr,
+			user: *user,
+			password: *password,
+			tls: *ftpTLS,
+			active: *ftpActive,
+			tlsConfig: &tls.Config{
+				ServerName: host,
+				InsecureSkipVerify: *ftpInsecure,
+				// servers commonly require data connections to resume the control session
+				ClientSessionCache: tls.NewLRUClientSessionCache(0),
+			},
+		}
+		sshfs.fs, err = newFtpBackend(config)
+		if err != nil {
+			panic("Failed to dial: " + err.Error())
+		}
+		sshfs.host = "ftp://" + *user + "@" + *addr
+
+	case "s3":
+		if "" == *s3Bucket {
+			panic("-backend s3 needs -s3-bucket")
+		}
+		sshfs.fs, err = newS3Backend(*addr, *user, *password, !*s3HTTP, *s3Region, *s3Bucket, *s3Prefix)
+		if err != nil {
+			panic("Failed to open bucket: " + err.Error())
+		}
+		sshfs.host = "s3://" + *addr + "/" + *s3Bucket + "/" + *s3Prefix
+
+	case "webdav":
+		sshfs.fs, err = newDavBackend(*addr, *user, *password)
+		if err != nil {
+			panic("Failed to open collection: " + err.Error())
+		}
+		sshfs.host = *user + "@" + redactSpec(*addr)
+
+	case "http":
+		// public sites: only send the credentials when asked to
+		login := ""
+		flag.Visit(func(f *flag.Flag) {
+			if "user" == f.Name {
+				login = *user
+			}
+		})
+		sshfs.fs, err = newHttpBackend(*addr, login, *password, *httpManifest)
+		if err != nil {
+			panic("Failed to open site: " + err.Error())
+		}
+		sshfs.host = redactSpec(*addr)
+
+	case "local":
+		local, err := newLocalBackend(*addr)
+		if err != nil {
+			panic("Failed to open directory: " + err.Error())
+		}
+		local.latency = *injectLatency
+		local.bandwidth = *injectBandwidth
+		local.errRate = *injectErrors
+		sshfs.fs = local
+		sshfs.host = "file://" + local.root
+
+	case "hosts":
+		specs, err := loadHosts(*addr)
+		if err != nil {
+			panic("Failed to read hosts: " + err.Error())
+		}
+		sshfs.fs = newMultiBackend(specs, *hostsIdle)
+		sshfs.host = "hosts:" + *addr
+
+	default:
+		panic("unknown -backend: " + *backend)
+	}
+
+	if "" != *unionLower {
+		var lowers []Backend
+		var names []string
+		for _, spec := range strings.Split(*unionLower, ",") {
+			lower, err := openBackend(spec)
+			if err != nil {
+				panic("Failed to open lower layer: " + err.Error())
+			}
+			lowers = append(lowers, lower)
+			names = append(names, redactSpec(spec))
+		}
+		sshfs.fs = newUnionBackend(sshfs.fs, lowers)
+		sshfs.host += "+" + strings.Join(names, ",")
+	}
+
+	if "" != *archive {
+		indexDir := ""
+		if "" != *cacheDir {
+			indexDir = filepath.Join(*cacheDir, cacheMetaDir)
+		}
+		sshfs.fs, err = openArchiveFile(sshfs.fs, sshfs.host, *archive, indexDir)
+		if err != nil {
+			panic("Failed to open archive: " + err.Error())
+		}
+		sshfs.host += "!" + *archive
+	}
+
+	sshfs.xattrs, err = newXattrStore(*xattrMode, sshfs.fs)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	switch flag.Arg(0) {
+	case "verify":
+		os.Exit(verifyCommand(sshfs.fs, *hashAlg, flag.Args()[1:]))
+	case "cp":
+		os.Exit(copyCommand(sshfs.fs, flag.Args()[1:]))
+	case "trash":
+		os.Exit(trashCommand(sshfs.fs, *trashKeep, flag.Args()[1:]))
+	}
 	
 	
 	// init
-	sshfs.client = client
 	sshfs.nodes = make(map[string]*Node)
+	sshfs.handles = make(map[uint64]*Handle)
+	sshfs.offline = *offline
+	sshfs.cacheVerify = *cacheVerify
+	if 0 != *lockLease {
+		sshfs.slocks = newServerLocks(sshfs.fs, *lockLease)
+		sshfs.lockOnOpen = *lockOnOpen
+	}
+	sshfs.atomic = *atomicUpload
+	if *trash {
+		sshfs.trash = newTrashBin(sshfs.fs, *trashKeep)
+	}
+	if 0 < *versions {
+		sshfs.versions = newVersionStore(sshfs.fs, *versions)
+	}
+	sshfs.conflict = *conflict
+	switch *conflict {
+	case conflictOff, conflictFail, conflictRename, conflictLWW:
+	default:
+		panic("unknown -conflict policy: " + *conflict)
+	}
 	
+	if "" != *cacheDir {
+		sshfs.cache, err = OpenDiskCache(*cacheDir, *cacheSize * 1024 * 1024)
+		if err != nil {
+			panic("Failed to open cache: " + err.Error())
+		}
+	}
+
+	if *offlineWrites {
+		if !*offline {
+			panic("-offline-writes needs -offline")
+		}
+		sshfs.journal, err = openOfflineJournal(filepath.Join(*cacheDir, cacheJournalDir))
+		if err != nil {
+			panic("Failed to open journal: " + err.Error())
+		}
+		// leftovers from an earlier session
+		if online {
+			sshfs.replay()
+		}
+	}
+	if reconnector, ok := sshfs.fs.(Reconnector); ok {
+		reconnector.OnReconnect(sshfs.replay)
+	}
+	if nil != reconnect {
+		go reconnect.Reconnect()
+	}
 	
 	
 	host := fuse.NewFileSystemHost(sshfs)
+	sshfs.fshost = host
+
+	stop := make(chan struct{})
+	switch *notify {
+	case "off":
+	case "poll":
+		sshfs.watch(*notifyInterval)
+		go sshfs.watcher.Poll(stop)
+	case "inotify":
+		if "" == *notifyRoot {
+			panic("-notify inotify needs -notify-root")
+		}
+		sshfs.watch(*notifyInterval)
+		if _, ok := sshfs.fs.(Execer); !ok {
+			panic("-notify inotify needs a backend that can run commands")
+		}
+		go sshfs.inotify(*notifyRoot, stop)
+	default:
+		panic("unknown -notify mode: " + *notify)
+	}
+	if nil != sshfs.trash && online {
+		go sshfs.trash.Sweep(stop)
+	}
+
 	host.SetCapReaddirPlus(true)
-	host.Mount("", append([]string{
+	host.Mount("", mountOpts.Args([]string{
 		"-o", "ExactFileSystemName=NTFS",
 		"-o", fmt.Sprintf("volname=%s", "Nice"),
-	}, os.Args[1:]...))	
+	}, flag.Args()))	
 	
 	
 	// done
-	client.Close()
+	close(stop)
+	if nil != sshfs.slocks {
+		sshfs.slocks.Close()
+	}
+	sshfs.fs.Close()
 }
@@ -0,0 +1,657 @@
+/*
+ * sshfs_test.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+//go:build !memfs && !sftpfs
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// file system over a local directory, as mounted with no options
+func newTestSshfs(t *testing.T) (*Sshfs, string) {
+	dir := t.TempDir()
+	local, err := newLocalBackend(dir)
+	if nil != err {
+		t.Fatal(err)
+	}
+	fs := &Sshfs{fs: local}
+	fs.nodes = make(map[string]*Node)
+	fs.handles = make(map[uint64]*Handle)
+	fs.conflict = conflictLWW
+	return fs, dir
+}
+
+
+func listNames(fs *Sshfs, path string) []string {
+	var names []string
+	fs.Readdir(path, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if "." != name && ".." != name {
+			names = append(names, name)
+		}
+		return true
+	}, 0, 0)
+	sort.Strings(names)
+	return names
+}
+
+
+func atomicTemps(dir string) []string {
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, entry := range entries {
+		if isAtomicTemp(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+
+func readLocal(t *testing.T, dir string, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if nil != err {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+
+// open, write data at 0 and release
+func writeSshfs(t *testing.T, fs *Sshfs, path string, flags int, data string) int {
+	errc, fh := fs.Open(path, flags)
+	if 0 != errc {
+		t.Fatalf("open %s: %d", path, errc)
+	}
+	if n := fs.Write(path, []byte(data), 0, fh); len(data) != n {
+		t.Fatalf("write %s: %d", path, n)
+	}
+	return fs.Release(path, fh)
+}
+
+
+func TestOpenWriteRelease(t *testing.T) {
+
+	fs, dir := newTestSshfs(t)
+	os.WriteFile(filepath.Join(dir, "a"), []byte("old content"), 0644)
+	listNames(fs, "/")
+
+	errc, fh := fs.Open("/a", fuse.O_RDWR)
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	if n := fs.Write("/a", []byte("NEW"), 0, fh); 3 != n {
+		t.Fatal(n)
+	}
+	if n := fs.Write("/a", []byte(" and more"), 11, fh); 9 != n {
+		t.Fatal(n)
+	}
+	buff := make([]byte, 32)
+	if n := fs.Read("/a", buff, 0, fh); "NEW content and more" != string(buff[:n]) {
+		t.Errorf("read back %q", buff[:n])
+	}
+	if errc = fs.Release("/a", fh); 0 != errc {
+		t.Fatal(errc)
+	}
+	if data := readLocal(t, dir, "a"); "NEW content and more" != data {
+		t.Errorf("got %q", data)
+	}
+
+	stat := fuse.Stat_t{}
+	if errc = fs.Getattr("/a", &stat, ^uint64(0)); 0 != errc || 20 != stat.Size {
+		t.Errorf("getattr got %d, size %d", errc, stat.Size)
+	}
+
+	if errc = writeSshfs(t, fs, "/a", fuse.O_WRONLY|fuse.O_TRUNC, "short"); 0 != errc {
+		t.Fatal(errc)
+	}
+	if data := readLocal(t, dir, "a"); "short" != data {
+		t.Errorf("after truncate got %q", data)
+	}
+
+	if errc, _ = fs.Open("/missing", fuse.O_RDONLY); -fuse.ENOENT != errc {
+		t.Errorf("open of missing file got %d", errc)
+	}
+}
+
+
+func TestConflict(t *testing.T) {
+
+	for _, atomic := range []bool{false, true} {
+		fs, dir := newTestSshfs(t)
+		fs.atomic = atomic
+		os.WriteFile(filepath.Join(dir, "a"), []byte("one"), 0644)
+		listNames(fs, "/")
+
+		// changed under us: fail keeps theirs
+		fs.conflict = conflictFail
+		errc, fh := fs.Open("/a", fuse.O_WRONLY)
+		fs.Write("/a", []byte("ours"), 0, fh)
+		os.WriteFile(filepath.Join(dir, "a"), []byte("theirs!"), 0644)
+		if errc = fs.Release("/a", fh); -fuse.EIO != errc {
+			t.Errorf("atomic=%v: release got %d", atomic, errc)
+		}
+		if data := readLocal(t, dir, "a"); "theirs!" != data {
+			t.Errorf("atomic=%v: got %q", atomic, data)
+		}
+
+		// rename keeps both
+		fs.conflict = conflictRename
+		listNames(fs, "/")
+		errc, fh = fs.Open("/a", fuse.O_WRONLY)
+		fs.Write("/a", []byte("ours"), 0, fh)
+		os.WriteFile(filepath.Join(dir, "a"), []byte("theirs again"), 0644)
+		if errc = fs.Release("/a", fh); 0 != errc {
+			t.Errorf("atomic=%v: release got %d", atomic, errc)
+		}
+		entries, _ := os.ReadDir(dir)
+		if 2 != len(entries) || 0 != len(atomicTemps(dir)) {
+			t.Errorf("atomic=%v: left %v", atomic, entries)
+		}
+		if data := readLocal(t, dir, "a"); "theirs again" != data {
+			t.Errorf("atomic=%v: got %q", atomic, data)
+		}
+		for _, entry := range entries {
+			if "a" != entry.Name() && !strings.HasPrefix(readLocal(t, dir, entry.Name()), "ours") {
+				t.Errorf("atomic=%v: %s has %q", atomic, entry.Name(), readLocal(t, dir, entry.Name()))
+			}
+		}
+
+		// a rename over a file that changed since we saw it
+		fs.conflict = conflictFail
+		os.WriteFile(filepath.Join(dir, "b"), []byte("b"), 0644)
+		listNames(fs, "/")
+		os.WriteFile(filepath.Join(dir, "a"), []byte("changed once more"), 0644)
+		if errc = fs.Rename("/b", "/a"); -fuse.EIO != errc {
+			t.Errorf("atomic=%v: rename got %d", atomic, errc)
+		}
+
+		// but not over one we wrote ourselves
+		listNames(fs, "/")
+		if errc = writeSshfs(t, fs, "/a", fuse.O_WRONLY, "longer content"); 0 != errc {
+			t.Fatal(errc)
+		}
+		if errc = fs.Rename("/b", "/a"); 0 != errc {
+			t.Errorf("atomic=%v: rename after own write got %d", atomic, errc)
+		}
+	}
+}
+
+
+// changes the mount made itself to an open file aren't conflicts
+func TestOwnChanges(t *testing.T) {
+
+	for _, atomic := range []bool{false, true} {
+		fs, dir := newTestSshfs(t)
+		fs.atomic = atomic
+		os.WriteFile(filepath.Join(dir, "c"), []byte("old"), 0644)
+		os.WriteFile(filepath.Join(dir, "d"), []byte("old"), 0644)
+		listNames(fs, "/")
+
+		// cp -p: truncate, write, set the times, close
+		fs.conflict = conflictRename
+		errc, fh := fs.Open("/c", fuse.O_WRONLY|fuse.O_TRUNC)
+		fs.Write("/c", []byte("copied"), 0, fh)
+		then := fuse.NewTimespec(time.Now().Add(-time.Hour))
+		if errc = fs.Utimens("/c", []fuse.Timespec{then, then}); 0 != errc {
+			t.Fatal(errc)
+		}
+		if errc = fs.Chmod("/c", 0600); 0 != errc {
+			t.Fatal(errc)
+		}
+		if errc = fs.Release("/c", fh); 0 != errc {
+			t.Errorf("atomic=%v: release got %d", atomic, errc)
+		}
+		if data := readLocal(t, dir, "c"); "copied" != data {
+			t.Errorf("atomic=%v: got %q", atomic, data)
+		}
+		if names := listNames(fs, "/"); 2 != len(names) {
+			t.Errorf("atomic=%v: left %v", atomic, names)
+		}
+
+		// renamed while open: the data goes to the new name
+		fs.conflict = conflictFail
+		errc, fh = fs.Open("/d", fuse.O_WRONLY)
+		fs.Write("/d", []byte("new"), 0, fh)
+		if errc = fs.Rename("/d", "/e"); 0 != errc {
+			t.Fatal(errc)
+		}
+		if errc = fs.Release("/e", fh); 0 != errc {
+			t.Errorf("atomic=%v: release after rename got %d", atomic, errc)
+		}
+		if data := readLocal(t, dir, "e"); "new" != data {
+			t.Errorf("atomic=%v: got %q", atomic, data)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "d")); nil == err {
+			t.Errorf("atomic=%v: old name came back", atomic)
+		}
+	}
+}
+
+
+func TestAtomicUpload(t *testing.T) {
+
+	fs, dir := newTestSshfs(t)
+	fs.atomic = true
+	os.WriteFile(filepath.Join(dir, "a"), []byte("old content"), 0600)
+	listNames(fs, "/")
+
+	errc, fh := fs.Open("/a", fuse.O_WRONLY)
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	fs.Write("/a", []byte("NEW"), 0, fh)
+	fs.Flush("/a", fh)
+	if data := readLocal(t, dir, "a"); "old content" != data {
+		t.Errorf("visible before release: %q", data)
+	}
+	if 1 != len(atomicTemps(dir)) {
+		t.Errorf("temps %v", atomicTemps(dir))
+	}
+	for _, name := range listNames(fs, "/") {
+		if isAtomicTemp(name) {
+			t.Errorf("%s listed", name)
+		}
+	}
+	if errc = fs.Release("/a", fh); 0 != errc {
+		t.Fatal(errc)
+	}
+	if data := readLocal(t, dir, "a"); "NEW content" != data {
+		t.Errorf("got %q", data)
+	}
+	if info, _ := os.Stat(filepath.Join(dir, "a")); 0600 != info.Mode().Perm() {
+		t.Errorf("mode %v", info.Mode())
+	}
+	if 0 != len(atomicTemps(dir)) {
+		t.Errorf("temps left: %v", atomicTemps(dir))
+	}
+
+	// open without writing leaves the file alone
+	stamp := time.Unix(1000, 0)
+	os.Chtimes(filepath.Join(dir, "a"), stamp, stamp)
+	listNames(fs, "/")
+	errc, fh = fs.Open("/a", fuse.O_RDWR)
+	if errc = fs.Release("/a", fh); 0 != errc {
+		t.Fatal(errc)
+	}
+	if info, _ := os.Stat(filepath.Join(dir, "a")); !stamp.Equal(info.ModTime()) {
+		t.Errorf("untouched file modified at %v", info.ModTime())
+	}
+
+	// new files appear only once complete
+	if errc = fs.Mknod("/b", 0640, 0); 0 != errc {
+		t.Fatal(errc)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b")); nil == err {
+		t.Error("created before release")
+	}
+	stat := fuse.Stat_t{}
+	if errc = fs.Getattr("/b", &stat, ^uint64(0)); 0 != errc {
+		t.Errorf("getattr of pending file got %d", errc)
+	}
+	errc, fh = fs.Open("/b", fuse.O_RDWR)
+	fs.Write("/b", []byte("hello"), 0, fh)
+	buff := make([]byte, 5)
+	if n := fs.Read("/b", buff, 0, fh); "hello" != string(buff[:n]) {
+		t.Errorf("read back %q", buff[:n])
+	}
+	fs.Release("/b", fh)
+	if info, err := os.Stat(filepath.Join(dir, "b")); nil != err || 0640 != info.Mode().Perm() || 5 != info.Size() {
+		t.Errorf("after release %v, %v", info, err)
+	}
+
+	// renamed before release: uploaded under the new name
+	fs.Mknod("/d", 0644, 0)
+	errc, fh = fs.Open("/d", fuse.O_RDWR)
+	fs.Write("/d", []byte("moved"), 0, fh)
+	if errc = fs.Rename("/d", "/e"); 0 != errc {
+		t.Errorf("rename of pending file got %d", errc)
+	}
+	if errc = fs.Getattr("/e", &stat, ^uint64(0)); 0 != errc {
+		t.Errorf("getattr after rename got %d", errc)
+	}
+	fs.Release("/e", fh)
+	if data := readLocal(t, dir, "e"); "moved" != data {
+		t.Errorf("after release got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "d")); nil == err {
+		t.Error("uploaded under the old name")
+	}
+
+	// or never, if removed first
+	fs.Mknod("/c", 0644, 0)
+	if errc = fs.Unlink("/c"); 0 != errc {
+		t.Errorf("unlink of pending file got %d", errc)
+	}
+	if errc = fs.Getattr("/c", &stat, ^uint64(0)); -fuse.ENOENT != errc {
+		t.Errorf("getattr after unlink got %d", errc)
+	}
+
+	// removed while open: nothing comes back on release
+	fs.Mknod("/p", 0644, 0)
+	os.WriteFile(filepath.Join(dir, "u"), []byte("unlinked"), 0644)
+	os.WriteFile(filepath.Join(dir, "t"), []byte("trashed"), 0644)
+	listNames(fs, "/")
+	for _, name := range []string{"/p", "/u", "/t"} {
+		errc, fh = fs.Open(name, fuse.O_RDWR)
+		if 0 != errc {
+			t.Fatal(errc)
+		}
+		fs.Write(name, []byte("written"), 0, fh)
+		if "/t" == name {
+			fs.trash = newTrashBin(fs.fs, time.Hour)
+		}
+		if errc = fs.Unlink(name); 0 != errc {
+			t.Errorf("unlink of open %s got %d", name, errc)
+		}
+		fs.trash = nil
+		fs.Release(name, fh)
+		if _, err := os.Stat(filepath.Join(dir, name)); nil == err {
+			t.Errorf("%s back after release", name)
+		}
+	}
+	if 0 != len(atomicTemps(dir)) {
+		t.Errorf("temps left: %v", atomicTemps(dir))
+	}
+	trashed, _ := filepath.Glob(filepath.Join(dir, trashDir, "*", "t"))
+	if 1 != len(trashed) || "trashed" != readLocal(t, filepath.Dir(trashed[0]), filepath.Base(trashed[0])) {
+		t.Errorf("trash holds %v", trashed)
+	}
+
+	// renamed while open: written under the new name
+	os.WriteFile(filepath.Join(dir, "f"), []byte("old f"), 0644)
+	listNames(fs, "/")
+	errc, fh = fs.Open("/f", fuse.O_RDWR)
+	fs.Write("/f", []byte("NEW"), 0, fh)
+	if errc = fs.Rename("/f", "/g"); 0 != errc {
+		t.Errorf("rename of open file got %d", errc)
+	}
+	fs.Release("/g", fh)
+	if data := readLocal(t, dir, "g"); "NEW f" != data {
+		t.Errorf("after release got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "f")); nil == err {
+		t.Error("old name back after release")
+	}
+
+	// replaced while open: the replacement stays
+	errc, fh = fs.Open("/g", fuse.O_RDWR)
+	fs.Write("/g", []byte("lost"), 0, fh)
+	if errc = fs.Rename("/e", "/g"); 0 != errc {
+		t.Errorf("rename over open file got %d", errc)
+	}
+	fs.Release("/g", fh)
+	if data := readLocal(t, dir, "g"); "moved" != data {
+		t.Errorf("after release got %q", data)
+	}
+
+	// leftovers of crashed uploads go once stale
+	old := filepath.Join(dir, atomicPrefix + "a.123")
+	fresh := filepath.Join(dir, atomicPrefix + "a.456")
+	os.WriteFile(old, nil, 0644)
+	os.WriteFile(fresh, nil, 0644)
+	then := time.Now().Add(-2 * atomicStale)
+	os.Chtimes(old, then, then)
+	listNames(fs, "/")
+	if _, err := os.Stat(old); nil == err {
+		t.Error("stale temp kept")
+	}
+	if _, err := os.Stat(fresh); nil != err {
+		t.Error("fresh temp removed")
+	}
+}
+
+
+func TestTrash(t *testing.T) {
+
+	fs, dir := newTestSshfs(t)
+	fs.trash = newTrashBin(fs.fs, time.Hour)
+	os.MkdirAll(filepath.Join(dir, "d/e"), 0755)
+	os.WriteFile(filepath.Join(dir, "d/a"), []byte("aaa"), 0644)
+	os.WriteFile(filepath.Join(dir, "d/e/b"), []byte("bb"), 0644)
+	os.WriteFile(filepath.Join(dir, "top"), []byte("first"), 0644)
+	listNames(fs, "/")
+	listNames(fs, "/d")
+	listNames(fs, "/d/e")
+
+	if errc := fs.Rmdir("/d"); -fuse.ENOTEMPTY != errc {
+		t.Errorf("rmdir of full directory got %d", errc)
+	}
+
+	// what rm -r does
+	for _, path := range []string{"/d/e/b", "/d/a", "/top"} {
+		if errc := fs.Unlink(path); 0 != errc {
+			t.Fatalf("unlink %s: %d", path, errc)
+		}
+	}
+	for _, path := range []string{"/d/e", "/d"} {
+		if errc := fs.Rmdir(path); 0 != errc {
+			t.Fatalf("rmdir %s: %d", path, errc)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "top"), []byte("second"), 0644)
+	listNames(fs, "/")
+	fs.Unlink("/top")
+
+	if names := listNames(fs, "/"); 0 != len(names) {
+		t.Errorf("listed %v", names)
+	}
+	entries, _ := fs.trash.List()
+	if 6 != len(entries) {
+		t.Fatalf("%d entries in the trash", len(entries))
+	}
+
+	if status := trashCommand(fs.fs, time.Hour, []string{"restore", "/d", "top"}); 0 != status {
+		t.Fatal(status)
+	}
+	for name, want := range map[string]string{"d/a": "aaa", "d/e/b": "bb", "top": "second"} {
+		if data := readLocal(t, dir, name); want != data {
+			t.Errorf("%s: got %q", name, data)
+		}
+	}
+	entries, _ = fs.trash.List()
+	if 1 != len(entries) || "/top" != entries[0].Path {
+		t.Fatalf("left %v", entries)
+	}
+	if status := trashCommand(fs.fs, time.Hour, []string{"restore", entries[0].Id}); 1 != status {
+		t.Errorf("restore over an existing file got %d", status)
+	}
+
+	old := filepath.Join(dir, ".trash", time.Now().Add(-2 * time.Hour).UTC().Format(trashTimeFormat))
+	os.MkdirAll(filepath.Join(old, "x"), 0755)
+	fs.trash.Expire()
+	if _, err := os.Stat(old); nil == err {
+		t.Error("not expired")
+	}
+	if status := trashCommand(fs.fs, time.Hour, []string{"purge"}); 0 != status {
+		t.Fatal(status)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, ".trash")); 0 != len(entries) {
+		t.Errorf("left %v", entries)
+	}
+}
+
+
+func TestVersions(t *testing.T) {
+
+	for _, atomic := range []bool{false, true} {
+		fs, dir := newTestSshfs(t)
+		fs.atomic = atomic
+		fs.versions = newVersionStore(fs.fs, 2)
+		name := filepath.Join(dir, "d/r.psd")
+		os.MkdirAll(filepath.Join(dir, "d"), 0755)
+		os.WriteFile(name, []byte("v1"), 0644)
+		os.Chtimes(name, time.Unix(1000, 0), time.Unix(1000, 0))
+		listNames(fs, "/")
+		listNames(fs, "/d")
+
+		// opening without writing keeps nothing
+		_, fh := fs.Open("/d/r.psd", fuse.O_WRONLY)
+		fs.Release("/d/r.psd", fh)
+		if _, err := os.Stat(filepath.Join(dir, ".versions")); nil == err {
+			t.Errorf("atomic=%v: version kept without a write", atomic)
+		}
+
+		writeSshfs(t, fs, "/d/r.psd", fuse.O_WRONLY, "v2")
+		os.Chtimes(name, time.Unix(2000, 0), time.Unix(2000, 0))
+		writeSshfs(t, fs, "/d/r.psd", fuse.O_WRONLY|fuse.O_TRUNC, "v3")
+		os.Chtimes(name, time.Unix(3000, 0), time.Unix(3000, 0))
+		writeSshfs(t, fs, "/d/r.psd", fuse.O_WRONLY|fuse.O_TRUNC, "v4")
+
+		// v1 is pruned
+		versions := filepath.Join(dir, ".versions/d/r.psd")
+		entries, _ := os.ReadDir(versions)
+		if 2 != len(entries) {
+			t.Fatalf("atomic=%v: versions %v", atomic, entries)
+		}
+		if data := readLocal(t, versions, entries[0].Name()); "v2" != data || ".psd" != filepath.Ext(entries[0].Name()) {
+			t.Errorf("atomic=%v: %s has %q", atomic, entries[0].Name(), data)
+		}
+		if data := readLocal(t, versions, entries[1].Name()); "v3" != data {
+			t.Errorf("atomic=%v: %s has %q", atomic, entries[1].Name(), data)
+		}
+
+		// read only through the mount
+		listNames(fs, "/.versions")
+		listNames(fs, "/.versions/d")
+		names := listNames(fs, "/.versions/d/r.psd")
+		if 2 != len(names) {
+			t.Fatalf("atomic=%v: listed %v", atomic, names)
+		}
+		version := "/.versions/d/r.psd/" + names[1]
+		if errc, _ := fs.Open(version, fuse.O_WRONLY); -fuse.EROFS != errc {
+			t.Errorf("atomic=%v: open for writing got %d", atomic, errc)
+		}
+		if -fuse.EROFS != fs.Unlink(version) || -fuse.EROFS != fs.Rename("/d/r.psd", "/.versions/x") ||
+			-fuse.EROFS != fs.Mknod("/.versions/n", 0644, 0) {
+			t.Errorf("atomic=%v: versions writable", atomic)
+		}
+		stat := fuse.Stat_t{}
+		fs.Getattr(version, &stat, ^uint64(0))
+		if 0 != stat.Mode&0222 {
+			t.Errorf("atomic=%v: mode %o", atomic, stat.Mode)
+		}
+		errc, fh := fs.Open(version, fuse.O_RDONLY)
+		buff := make([]byte, 8)
+		if n := fs.Read(version, buff, 0, fh); 0 != errc || "v3" != string(buff[:n]) {
+			t.Errorf("atomic=%v: read %q, %d", atomic, buff[:n], errc)
+		}
+		fs.Release(version, fh)
+	}
+}
+
+
+// cp onto itself must not truncate the source first
+func TestCopySameFile(t *testing.T) {
+
+	_, dir := newTestSshfs(t)
+	local, _ := newLocalBackend(dir)
+	os.WriteFile(filepath.Join(dir, "a"), []byte("content"), 0644)
+	os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "b"))
+
+	for _, args := range [][]string{{"/a", "/a"}, {"a", "/a/"}, {"/a", "/"}} {
+		if 0 == copyCommand(local, args) {
+			t.Errorf("cp %s %s succeeded", args[0], args[1])
+		}
+	}
+	if err := local.Copy("/a", "/b"); !errors.Is(err, errSameFile) {
+		t.Errorf("copy onto a hard link got %v", err)
+	}
+	if data := readLocal(t, dir, "a"); "content" != data {
+		t.Errorf("source now %q", data)
+	}
+
+	if 0 != copyCommand(local, []string{"/a", "/c"}) || "content" != readLocal(t, dir, "c") {
+		t.Error("plain copy failed")
+	}
+}
+
+
+// flushes of a spooled file stay local until it is closed
+func TestSpoolFlush(t *testing.T) {
+
+	server := newTestDavServer(t)
+	fs := &Sshfs{fs: server.backend(t)}
+	fs.nodes = make(map[string]*Node)
+	fs.handles = make(map[uint64]*Handle)
+	fs.conflict = conflictLWW
+	writeDav(t, fs.fs, "/a", os.O_RDWR|os.O_CREATE|os.O_TRUNC, "old", 0)
+	listNames(fs, "/")
+
+	puts := server.count("PUT")
+	errc, fh := fs.Open("/a", fuse.O_RDWR)
+	if 0 != errc {
+		t.Fatal(errc)
+	}
+	for i := 0; 3 > i; i++ {
+		fs.Write("/a", []byte("new"), int64(3 * i), fh)
+		fs.Flush("/a", fh)
+	}
+	if errc = fs.Release("/a", fh); 0 != errc {
+		t.Fatal(errc)
+	}
+	if 1 != server.count("PUT") - puts {
+		t.Errorf("%d uploads", server.count("PUT") - puts)
+	}
+	if data, _ := readBackendFile(fs.fs, "/a"); "newnewnew" != string(data) {
+		t.Errorf("got %q", data)
+	}
+}
+
+
+// a mount breaking a stale lock late must not take the lock another one
+// broke it for
+func TestServerLockBreak(t *testing.T) {
+
+	_, dir := newTestSshfs(t)
+	local, _ := newLocalBackend(dir)
+	lockName := serverLockName("/a")
+	os.WriteFile(filepath.Join(dir, lockName), []byte("gone:1:00000000 1000\n"), 0644)
+
+	first := newServerLocks(local, time.Minute)
+	defer first.Close()
+	second := newServerLocks(local, time.Minute)
+	defer second.Close()
+
+	// both find it stale
+	owner, expires, err := second.read(lockName)
+	if nil != err || "gone:1:00000000" != owner {
+		t.Fatalf("read %s, %v", owner, err)
+	}
+	if err = first.Acquire("/a", true); nil != err {
+		t.Fatal(err)
+	}
+	if err = second.breakLock(lockName, owner, expires); !errors.Is(err, errLocked) {
+		t.Errorf("late break got %v", err)
+	}
+	if owner, _, err = first.read(lockName); nil != err || first.id != owner {
+		t.Errorf("lock now held by %s, %v", owner, err)
+	}
+	if err = second.Acquire("/a", true); !errors.Is(err, errLocked) {
+		t.Errorf("second acquire got %v", err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if 1 != len(entries) || filepath.Base(lockName) != entries[0].Name() {
+		t.Errorf("left %v", entries)
+	}
+}
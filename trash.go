@@ -0,0 +1,290 @@
+/*
+ * trash.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+
+const (
+	trashDir        = "/.trash"
+	trashInfoName   = ".sshfs-trashinfo"
+	trashTimeFormat = "20060102T150405.000000000Z"
+)
+
+
+// Deleted files and directories, kept on the server
+//
+// Each deleted entry is renamed into its own .trash/<time>/ at the root
+// of the mount, next to a small info file saying where it came from.
+// rm -r deletes the files of a tree one by one and then the directories,
+// so restoring a directory also restores what was deleted under it.
+// Entries older than keep are purged; 0 keeps them forever.
+type trashBin struct {
+	fs   Backend
+	keep time.Duration
+}
+
+
+type trashEntry struct {
+	Id      string // directory under .trash
+	Path    string // where it was
+	Deleted time.Time
+	IsDir   bool
+	Size    int64
+}
+
+
+func newTrashBin(fs Backend, keep time.Duration) *trashBin {
+	self := &trashBin{}
+	self.fs = fs
+	self.keep = keep
+	return self
+}
+
+
+func (self *trashEntry) location() string {
+	return path.Join(trashDir, self.Id, path.Base(self.Path))
+}
+
+
+func (self *trashEntry) under(name string) bool {
+	return self.Path == name || "/" == name || strings.HasPrefix(self.Path, name + "/")
+}
+
+
+// move name into the trash; returns where it went
+func (self *trashBin) Put(name string) (string, error) {
+
+	err := backendMkdirAll(self.fs, trashDir)
+	if nil != err {
+		return "", err
+	}
+
+	var dir string
+	var deleted time.Time
+	for {
+		deleted = time.Now().UTC()
+		dir = path.Join(trashDir, deleted.Format(trashTimeFormat))
+		if _, err := self.fs.Lstat(dir); nil != err {
+			break
+		}
+	}
+	err = self.fs.Mkdir(dir)
+	if nil != err {
+		return "", err
+	}
+
+	info := "[Trash Info]\n" +
+		"Path=" + (&url.URL{Path: name}).EscapedPath() + "\n" +
+		"DeletionDate=" + deleted.Format(time.RFC3339) + "\n"
+	err = writeBackendFile(self.fs, path.Join(dir, trashInfoName), []byte(info))
+	if nil == err {
+		err = self.fs.Rename(name, path.Join(dir, path.Base(name)))
+	}
+	if nil != err {
+		backendRemoveAll(self.fs, dir)
+		return "", err
+	}
+	return path.Join(dir, path.Base(name)), nil
+}
+
+
+// everything in the trash, oldest first
+func (self *trashBin) List() ([]*trashEntry, error) {
+
+	infos, err := self.fs.ReadDir(trashDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	var entries []*trashEntry
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		entry, err := self.entry(info.Name())
+		if nil != err {
+			fmt.Printf("%s: %s\n", path.Join(trashDir, info.Name()), err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Id < entries[j].Id
+	})
+	return entries, nil
+}
+
+
+func (self *trashBin) entry(id string) (*trashEntry, error) {
+
+	data, err := readBackendFile(self.fs, path.Join(trashDir, id, trashInfoName))
+	if nil != err {
+		return nil, err
+	}
+
+	entry := &trashEntry{Id: id}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, _ := strings.Cut(line, "=")
+		switch key {
+		case "Path":
+			entry.Path, err = url.PathUnescape(value)
+		case "DeletionDate":
+			entry.Deleted, err = time.Parse(time.RFC3339, value)
+		}
+		if nil != err {
+			return nil, err
+		}
+	}
+	if "" == entry.Path {
+		return nil, fmt.Errorf("no Path in %s", trashInfoName)
+	}
+
+	info, err := self.fs.Lstat(entry.location())
+	if nil != err {
+		return nil, err
+	}
+	entry.IsDir = info.IsDir()
+	entry.Size = info.Size()
+	return entry, nil
+}
+
+
+// put entry back where it was; never over something that is there now
+func (self *trashBin) Restore(entry *trashEntry) error {
+
+	if _, err := self.fs.Lstat(entry.Path); nil == err {
+		return fmt.Errorf("%s: %w", entry.Path, os.ErrExist)
+	}
+	err := backendMkdirAll(self.fs, path.Dir(entry.Path))
+	if nil != err {
+		return err
+	}
+	err = self.fs.Rename(entry.location(), entry.Path)
+	if nil != err {
+		return err
+	}
+	return backendRemoveAll(self.fs, path.Join(trashDir, entry.Id))
+}
+
+
+func (self *trashBin) Purge(entry *trashEntry) error {
+	return backendRemoveAll(self.fs, path.Join(trashDir, entry.Id))
+}
+
+
+// purge whatever was deleted longer than keep ago
+func (self *trashBin) Expire() error {
+
+	if 0 == self.keep {
+		return nil
+	}
+	infos, err := self.fs.ReadDir(trashDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if nil != err {
+		return err
+	}
+
+	for _, info := range infos {
+		deleted, err := time.Parse(trashTimeFormat, info.Name())
+		if nil != err || time.Since(deleted) < self.keep {
+			continue
+		}
+		fmt.Printf("purging %s from the trash\n", info.Name())
+		if err := backendRemoveAll(self.fs, path.Join(trashDir, info.Name())); nil != err {
+			fmt.Println(err)
+		}
+	}
+	return nil
+}
+
+
+// expire now and then until stop is closed
+func (self *trashBin) Sweep(stop chan struct{}) {
+	for {
+		if err := self.Expire(); nil != err {
+			fmt.Printf("expiring trash: %s\n", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Hour):
+		}
+	}
+}
+
+
+func backendMkdirAll(fs Backend, name string) error {
+
+	if "/" == name || "." == name {
+		return nil
+	}
+	info, err := fs.Stat(name)
+	if nil == err {
+		if !info.IsDir() {
+			return fmt.Errorf("%s: not a directory", name)
+		}
+		return nil
+	}
+	err = backendMkdirAll(fs, path.Dir(name))
+	if nil != err {
+		return err
+	}
+	err = fs.Mkdir(name)
+	if nil != err {
+		// made meanwhile
+		if info, serr := fs.Stat(name); nil == serr && info.IsDir() {
+			return nil
+		}
+	}
+	return err
+}
+
+
+func backendRemoveAll(fs Backend, name string) error {
+
+	info, err := fs.Lstat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if nil != err {
+		return err
+	}
+	if info.IsDir() {
+		infos, err := fs.ReadDir(name)
+		if nil != err {
+			return err
+		}
+		for _, info := range infos {
+			err = backendRemoveAll(fs, path.Join(name, info.Name()))
+			if nil != err {
+				return err
+			}
+		}
+	}
+	return fs.Remove(name)
+}
@@ -0,0 +1,543 @@
+/*
+ * unionbackend.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// markers kept in the upper layer
+const (
+	whiteoutPrefix = ".wh."          // .wh.name: name is deleted from the layers below
+	whiteoutOpaque = ".wh..wh..opq"  // in a directory: hide everything below it
+)
+
+
+// Union of backends
+//
+// The upper layer takes every change; lower layers are only read, highest
+// first. Changing a file that lives in a lower layer copies it up first,
+// and deleting one leaves a whiteout in the upper layer. Renaming a
+// directory that exists in a lower layer is not supported (ENOSYS); a
+// directory made or renamed over a deleted or lower one is marked opaque.
+type unionBackend struct {
+	upper  Backend
+	lowers []Backend
+}
+
+
+func newUnionBackend(upper Backend, lowers []Backend) *unionBackend {
+	self := &unionBackend{}
+	self.upper = upper
+	self.lowers = lowers
+	return self
+}
+
+
+func isWhiteout(name string) bool {
+	return strings.HasPrefix(path.Base(name), whiteoutPrefix)
+}
+
+
+func whiteoutName(name string) string {
+	return path.Join(path.Dir(name), whiteoutPrefix + path.Base(name))
+}
+
+
+func (self *unionBackend) exists(fs Backend, name string) bool {
+	_, err := fs.Lstat(name)
+	return nil == err
+}
+
+
+// whether the lower layers are masked at name
+func (self *unionBackend) hidden(name string) bool {
+	for p := path.Clean("/" + name); "/" != p; p = path.Dir(p) {
+		if self.exists(self.upper, whiteoutName(p)) || self.exists(self.upper, path.Join(path.Dir(p), whiteoutOpaque)) {
+			return true
+		}
+	}
+	return false
+}
+
+
+// layer that provides name
+func (self *unionBackend) find(name string) (Backend, os.FileInfo, error) {
+
+	if isWhiteout(name) {
+		return nil, nil, os.ErrNotExist
+	}
+
+	info, err := self.upper.Lstat(name)
+	if nil == err {
+		return self.upper, info, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+	if self.hidden(name) {
+		return nil, nil, os.ErrNotExist
+	}
+
+	for _, lower := range self.lowers {
+		info, err := lower.Lstat(name)
+		if nil == err {
+			return lower, info, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, os.ErrNotExist
+}
+
+
+// whether removing name from the upper layer would uncover a lower one
+func (self *unionBackend) inLower(name string) bool {
+	if self.hidden(name) {
+		return false
+	}
+	for _, lower := range self.lowers {
+		if self.exists(lower, name) {
+			return true
+		}
+	}
+	return false
+}
+
+
+// make sure dir exists in the upper layer
+func (self *unionBackend) parents(dir string) error {
+
+	if "/" == dir || self.exists(self.upper, dir) {
+		return nil
+	}
+	err := self.parents(path.Dir(dir))
+	if nil != err {
+		return err
+	}
+
+	layer, info, err := self.find(dir)
+	if nil != err {
+		return err
+	}
+	return self.copyUp(layer, dir, info, false)
+}
+
+
+// copy name from a lower layer to the upper one
+func (self *unionBackend) copyUp(layer Backend, name string, info os.FileInfo, content bool) error {
+
+	err := self.parents(path.Dir(name))
+	if nil != err {
+		return err
+	}
+
+	switch {
+	case info.IsDir():
+		err = self.upper.Mkdir(name)
+
+	case 0 != info.Mode()&os.ModeSymlink:
+		readlinker, ok := layer.(Readlinker)
+		if !ok {
+			return errors.ErrUnsupported
+		}
+		target, err := readlinker.Readlink(name)
+		if nil != err {
+			return err
+		}
+		return self.upper.Symlink(target, name)
+
+	default:
+		dst, err := self.upper.Open(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+		if nil != err {
+			return err
+		}
+		if content {
+			var src File
+			src, err = layer.Open(name, os.O_RDONLY)
+			if nil == err {
+				_, err = copyFile(dst, src)
+				src.Close()
+			}
+		}
+		if cerr := dst.Close(); nil == err {
+			err = cerr
+		}
+	}
+	if nil != err {
+		return err
+	}
+
+	// best effort; not every upper layer keeps these
+	self.upper.Chmod(name, info.Mode().Perm())
+	self.upper.Chtimes(name, info.ModTime(), info.ModTime())
+	return nil
+}
+
+
+// whether a directory made at name would show lower layer entries
+func (self *unionBackend) masks(name string) bool {
+	return self.exists(self.upper, whiteoutName(name)) || self.inLower(name)
+}
+
+
+// hide what the lower layers have below dir
+func (self *unionBackend) opaque(dir string) error {
+	fp, err := self.upper.Create(path.Join(dir, whiteoutOpaque))
+	if nil != err {
+		return err
+	}
+	return fp.Close()
+}
+
+
+// remove the markers from an upper directory that looks empty
+func (self *unionBackend) clear(dir string) {
+	entries, _ := self.upper.ReadDir(dir)
+	for _, entry := range entries {
+		self.upper.Remove(path.Join(dir, entry.Name()))
+	}
+}
+
+
+// get ready to create name in the upper layer
+func (self *unionBackend) prepare(name string) error {
+
+	if isWhiteout(name) {
+		return fmt.Errorf("%s: reserved name: %w", name, os.ErrPermission)
+	}
+	err := self.parents(path.Dir(name))
+	if nil != err {
+		return err
+	}
+	if self.exists(self.upper, whiteoutName(name)) {
+		return self.upper.Remove(whiteoutName(name))
+	}
+	return nil
+}
+
+
+func (self *unionBackend) whiteout(name string) error {
+	err := self.parents(path.Dir(name))
+	if nil != err {
+		return err
+	}
+	fp, err := self.upper.Create(whiteoutName(name))
+	if nil != err {
+		return err
+	}
+	return fp.Close()
+}
+
+
+func (self *unionBackend) Stat(name string) (os.FileInfo, error) {
+	layer, info, err := self.find(name)
+	if nil != err {
+		return nil, err
+	}
+	if 0 != info.Mode()&os.ModeSymlink {
+		return layer.Stat(name)
+	}
+	return info, nil
+}
+
+
+func (self *unionBackend) Lstat(name string) (os.FileInfo, error) {
+	_, info, err := self.find(name)
+	return info, err
+}
+
+
+func (self *unionBackend) ReadDir(name string) ([]os.FileInfo, error) {
+
+	if isWhiteout(name) {
+		return nil, os.ErrNotExist
+	}
+
+	var infos []os.FileInfo
+	seen := make(map[string]bool)
+	found := false
+	opaque := false
+
+	upper, err := self.upper.ReadDir(name)
+	if nil == err {
+		found = true
+		for _, info := range upper {
+			switch {
+			case whiteoutOpaque == info.Name():
+				opaque = true
+			case isWhiteout(info.Name()):
+				seen[strings.TrimPrefix(info.Name(), whiteoutPrefix)] = true
+			case !seen[info.Name()]:
+				seen[info.Name()] = true
+				infos = append(infos, info)
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if !opaque && !self.hidden(name) {
+		for _, lower := range self.lowers {
+			entries, err := lower.ReadDir(name)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if nil != err {
+				return nil, err
+			}
+			found = true
+			for _, info := range entries {
+				if !seen[info.Name()] {
+					seen[info.Name()] = true
+					infos = append(infos, info)
+				}
+			}
+		}
+	}
+
+	if !found {
+		return nil, os.ErrNotExist
+	}
+	return infos, nil
+}
+
+
+func (self *unionBackend) Open(name string, flags int) (File, error) {
+
+	layer, info, err := self.find(name)
+	if 0 == flags&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) {
+		if nil != err {
+			return nil, err
+		}
+		return layer.Open(name, flags)
+	}
+
+	switch {
+	case nil == err && 0 != flags&os.O_CREATE && 0 != flags&os.O_EXCL:
+		return nil, os.ErrExist
+	case nil == err && layer != self.upper:
+		err = self.copyUp(layer, name, info, 0 == flags&os.O_TRUNC)
+	case errors.Is(err, os.ErrNotExist) && 0 != flags&os.O_CREATE:
+		err = self.prepare(name)
+	}
+	if nil != err {
+		return nil, err
+	}
+	return self.upper.Open(name, flags)
+}
+
+
+func (self *unionBackend) Create(name string) (File, error) {
+	return self.Open(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+
+func (self *unionBackend) Remove(name string) error {
+
+	layer, info, err := self.find(name)
+	if nil != err {
+		return err
+	}
+	if info.IsDir() {
+		infos, err := self.ReadDir(name)
+		if nil != err {
+			return err
+		}
+		if 0 != len(infos) {
+			return fmt.Errorf("%s: directory not empty: %w", name, os.ErrExist)
+		}
+	}
+
+	lower := self.inLower(name)
+	if layer == self.upper {
+		if info.IsDir() {
+			// only markers are left
+			self.clear(name)
+		}
+		err = self.upper.Remove(name)
+		if nil != err {
+			return err
+		}
+	}
+	if lower {
+		return self.whiteout(name)
+	}
+	return nil
+}
+
+
+func (self *unionBackend) Rename(oldpath string, newpath string) error {
+
+	if isWhiteout(newpath) {
+		return fmt.Errorf("%s: reserved name: %w", newpath, os.ErrPermission)
+	}
+
+	layer, info, err := self.find(oldpath)
+	if nil != err {
+		return err
+	}
+	if path.Clean(oldpath) == path.Clean(newpath) {
+		return nil
+	}
+	lower := self.inLower(oldpath)
+	if info.IsDir() && lower {
+		return fmt.Errorf("rename %s: directory in a lower layer: %w", oldpath, errors.ErrUnsupported)
+	}
+
+	// a directory replaces only an empty one, whatever layers it is in
+	opaque := false
+	if info.IsDir() {
+		target, tinfo, err := self.find(newpath)
+		if nil == err && tinfo.IsDir() {
+			infos, err := self.ReadDir(newpath)
+			if nil != err {
+				return err
+			}
+			if 0 != len(infos) {
+				return fmt.Errorf("rename %s: %w", newpath, errNotEmpty)
+			}
+			// not every upper layer renames over a directory
+			if target == self.upper {
+				self.clear(newpath)
+				err = self.upper.Remove(newpath)
+				if nil != err {
+					return err
+				}
+			}
+		}
+		opaque = self.masks(newpath)
+	}
+
+	if layer != self.upper {
+		err = self.copyUp(layer, oldpath, info, true)
+		if nil != err {
+			return err
+		}
+	}
+	err = self.prepare(newpath)
+	if nil != err {
+		return err
+	}
+
+	err = self.upper.Rename(oldpath, newpath)
+	if nil != err {
+		return err
+	}
+	if opaque {
+		err = self.opaque(newpath)
+		if nil != err {
+			return err
+		}
+	}
+	if lower {
+		return self.whiteout(oldpath)
+	}
+	return nil
+}
+
+
+func (self *unionBackend) Mkdir(name string) error {
+
+	if _, _, err := self.find(name); nil == err {
+		return os.ErrExist
+	}
+
+	// a directory recreated over a deleted one starts empty
+	replaced := self.masks(name)
+	err := self.prepare(name)
+	if nil == err {
+		err = self.upper.Mkdir(name)
+	}
+	if nil == err && replaced {
+		err = self.opaque(name)
+	}
+	return err
+}
+
+
+// bring name into the upper layer for an attribute change
+func (self *unionBackend) modify(name string) error {
+	layer, info, err := self.find(name)
+	if nil != err || layer == self.upper {
+		return err
+	}
+	return self.copyUp(layer, name, info, !info.IsDir())
+}
+
+
+func (self *unionBackend) Chmod(name string, mode os.FileMode) error {
+	err := self.modify(name)
+	if nil != err {
+		return err
+	}
+	return self.upper.Chmod(name, mode)
+}
+
+
+func (self *unionBackend) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	err := self.modify(name)
+	if nil != err {
+		return err
+	}
+	return self.upper.Chtimes(name, atime, mtime)
+}
+
+
+func (self *unionBackend) Symlink(target string, newpath string) error {
+	if _, _, err := self.find(newpath); nil == err {
+		return os.ErrExist
+	}
+	err := self.prepare(newpath)
+	if nil != err {
+		return err
+	}
+	return self.upper.Symlink(target, newpath)
+}
+
+
+func (self *unionBackend) Readlink(name string) (string, error) {
+	layer, _, err := self.find(name)
+	if nil != err {
+		return "", err
+	}
+	readlinker, ok := layer.(Readlinker)
+	if !ok {
+		return "", errors.ErrUnsupported
+	}
+	return readlinker.Readlink(name)
+}
+
+
+// space is what the upper layer has left
+func (self *unionBackend) StatVFS(name string, stat *fuse.Statfs_t) error {
+	return self.upper.StatVFS("/", stat)
+}
+
+
+func (self *unionBackend) Close() error {
+	err := self.upper.Close()
+	for _, lower := range self.lowers {
+		lower.Close()
+	}
+	return err
+}
@@ -0,0 +1,233 @@
+/*
+ * unionbackend_test.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// union of two local directories; the lower one holds /d/a, /d/secret,
+// /e/x and /f
+func newTestUnion(t *testing.T) (*unionBackend, string, string) {
+	upperDir := t.TempDir()
+	lowerDir := t.TempDir()
+	for name, data := range map[string]string{"d/a": "lower a", "d/secret": "secret", "e/x": "x", "f": "lower f"} {
+		os.MkdirAll(filepath.Join(lowerDir, filepath.Dir(name)), 0755)
+		if err := os.WriteFile(filepath.Join(lowerDir, name), []byte(data), 0644); nil != err {
+			t.Fatal(err)
+		}
+	}
+	upper, err := newLocalBackend(upperDir)
+	if nil != err {
+		t.Fatal(err)
+	}
+	lower, err := newLocalBackend(lowerDir)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return newUnionBackend(upper, []Backend{lower}), upperDir, lowerDir
+}
+
+
+func unionNames(fs Backend, name string) string {
+	infos, err := fs.ReadDir(name)
+	if nil != err {
+		return err.Error()
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+
+func TestUnionCopyUp(t *testing.T) {
+
+	fs, upperDir, lowerDir := newTestUnion(t)
+
+	writeDav(t, fs, "/d/a", os.O_RDWR, "UPPER", 0)
+	if data, err := readBackendFile(fs, "/d/a"); nil != err || "UPPER a" != string(data) {
+		t.Errorf("got %q, %v", data, err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(upperDir, "d/a")); "UPPER a" != string(data) {
+		t.Errorf("upper has %q", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(lowerDir, "d/a")); "lower a" != string(data) {
+		t.Errorf("lower changed to %q", data)
+	}
+	// only the parent came up, not its other entries
+	if _, err := os.Stat(filepath.Join(upperDir, "d/secret")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("sibling copied up: %v", err)
+	}
+	if got := unionNames(fs, "/d"); "a,secret" != got {
+		t.Errorf("listing got %s", got)
+	}
+
+	// truncating doesn't copy the content
+	writeDav(t, fs, "/f", os.O_RDWR|os.O_TRUNC, "new", 0)
+	if data, err := readBackendFile(fs, "/f"); nil != err || "new" != string(data) {
+		t.Errorf("got %q, %v", data, err)
+	}
+
+	err := fs.Chmod("/e/x", 0600)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(upperDir, "e/x")); "x" != string(data) {
+		t.Errorf("chmod copied up %q", data)
+	}
+}
+
+
+func TestUnionWhiteout(t *testing.T) {
+
+	fs, upperDir, lowerDir := newTestUnion(t)
+
+	err := fs.Remove("/d/secret")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(lowerDir, "d/secret")); nil != err {
+		t.Errorf("lower file removed: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(upperDir, "d/.wh.secret")); nil != err {
+		t.Errorf("no whiteout: %v", err)
+	}
+	if _, err = fs.Stat("/d/secret"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stat of deleted got %v", err)
+	}
+	if got := unionNames(fs, "/d"); "a" != got {
+		t.Errorf("listing got %s", got)
+	}
+	if _, err = fs.Open("/d/.wh.secret", os.O_RDONLY); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("whiteout visible: %v", err)
+	}
+	if _, err = fs.Create("/d/.wh.other"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("create of a marker name got %v", err)
+	}
+
+	// creating it again drops the whiteout
+	writeDav(t, fs, "/d/secret", os.O_RDWR|os.O_CREATE|os.O_EXCL, "new", 0)
+	if data, err := readBackendFile(fs, "/d/secret"); nil != err || "new" != string(data) {
+		t.Errorf("got %q, %v", data, err)
+	}
+	if got := unionNames(fs, "/d"); "a,secret" != got {
+		t.Errorf("listing got %s", got)
+	}
+
+	// a directory deleted and made again starts empty
+	if err = fs.Remove("/e"); nil == err {
+		t.Error("removed a full directory")
+	}
+	for _, name := range []string{"/e/x", "/e"} {
+		if err = fs.Remove(name); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if _, err = fs.Stat("/e"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stat of deleted directory got %v", err)
+	}
+	err = fs.Mkdir("/e")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if got := unionNames(fs, "/e"); "" != got {
+		t.Errorf("new directory lists %s", got)
+	}
+	if _, err = fs.Stat("/e/x"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stat below new directory got %v", err)
+	}
+}
+
+
+func TestUnionRename(t *testing.T) {
+
+	fs, upperDir, _ := newTestUnion(t)
+
+	// a lower file comes up and leaves a whiteout
+	err := fs.Rename("/f", "/g")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if data, err := readBackendFile(fs, "/g"); nil != err || "lower f" != string(data) {
+		t.Errorf("got %q, %v", data, err)
+	}
+	if _, err = fs.Stat("/f"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("old name got %v", err)
+	}
+
+	if err = fs.Rename("/e", "/h"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("rename of lower directory got %v", err)
+	}
+
+	// over a lower directory with entries
+	err = fs.Mkdir("/n")
+	if nil != err {
+		t.Fatal(err)
+	}
+	err = fs.Rename("/n", "/e")
+	if !errors.Is(err, errNotEmpty) || -fuse.ENOTEMPTY != fuseErrc(err) {
+		t.Errorf("rename over full directory got %v", err)
+	}
+	if got := unionNames(fs, "/e"); "x" != got {
+		t.Errorf("listing after refused rename got %s", got)
+	}
+
+	// over a directory deleted from the lower layer
+	for _, name := range []string{"/d/a", "/d/secret", "/d"} {
+		if err = fs.Remove(name); nil != err {
+			t.Fatal(err)
+		}
+	}
+	writeDav(t, fs, "/n/mine", os.O_RDWR|os.O_CREATE, "mine", 0)
+	err = fs.Rename("/n", "/d")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if got := unionNames(fs, "/d"); "mine" != got {
+		t.Errorf("renamed directory lists %s", got)
+	}
+	if _, err = fs.Stat("/d/secret"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stat of lower entry got %v", err)
+	}
+
+	// over a lower directory emptied through whiteouts
+	err = fs.Remove("/e/x")
+	if nil != err {
+		t.Fatal(err)
+	}
+	err = fs.Mkdir("/m")
+	if nil != err {
+		t.Fatal(err)
+	}
+	err = fs.Rename("/m", "/e")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if got := unionNames(fs, "/e"); "" != got {
+		t.Errorf("renamed directory lists %s", got)
+	}
+	if _, err = os.Stat(filepath.Join(upperDir, "e", whiteoutOpaque)); nil != err {
+		t.Errorf("no opaque marker: %v", err)
+	}
+}
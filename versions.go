@@ -0,0 +1,121 @@
+/*
+ * versions.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+
+const (
+	versionsDir       = "/.versions"
+	versionTimeFormat = "20060102T150405.000000000Z"
+	versionPartSuffix = ".part"
+)
+
+
+// Earlier content of overwritten files, kept on the server
+//
+// Versions of /dir/name live in /.versions/dir/name/, one file each,
+// named after the modification time of the content they hold plus the
+// original extension, so applications still know what they are. Content
+// that was already kept isn't copied again. Only the newest keep versions
+// of a file stay around.
+type versionStore struct {
+	fs   Backend
+	keep int
+}
+
+
+func newVersionStore(fs Backend, keep int) *versionStore {
+	self := &versionStore{}
+	self.fs = fs
+	self.keep = keep
+	return self
+}
+
+
+func isVersionPath(name string) bool {
+	return versionsDir == name || strings.HasPrefix(name, versionsDir + "/")
+}
+
+
+// keep the current content of name before it changes
+func (self *versionStore) Preserve(name string) error {
+
+	info, err := self.fs.Stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if nil != err {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	dir := path.Join(versionsDir, name)
+	version := path.Join(dir, info.ModTime().UTC().Format(versionTimeFormat) + path.Ext(name))
+	if _, err := self.fs.Lstat(version); nil == err {
+		return nil
+	}
+	err = backendMkdirAll(self.fs, dir)
+	if nil != err {
+		return err
+	}
+
+	// under its final name only once complete
+	part := version + versionPartSuffix
+	err = backendCopy(self.fs, name, part)
+	if nil == err {
+		err = self.fs.Rename(part, version)
+	}
+	if nil != err {
+		self.fs.Remove(part)
+		return err
+	}
+	fmt.Printf("kept version %s\n", version)
+	self.fs.Chtimes(version, info.ModTime(), info.ModTime())
+
+	self.prune(dir)
+	return nil
+}
+
+
+// drop all but the newest keep versions
+func (self *versionStore) prune(dir string) {
+
+	infos, err := self.fs.ReadDir(dir)
+	if nil != err {
+		fmt.Println(err)
+		return
+	}
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() && !strings.HasSuffix(info.Name(), versionPartSuffix) {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	for len(names) > self.keep {
+		if err := self.fs.Remove(path.Join(dir, names[0])); nil != err {
+			fmt.Println(err)
+		}
+		names = names[1:]
+	}
+}
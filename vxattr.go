@@ -0,0 +1,170 @@
+//go:build !memfs && !sftpfs
+
+/*
+ * vxattr.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// Read-only xattrs made up from what the server knows about a file
+const (
+	vxattrPrefix     = "user.sshfs."
+	vxattrRemotePath = "user.sshfs.remote_path"
+	vxattrHost       = "user.sshfs.host"
+	vxattrOwner      = "user.sshfs.owner"
+	vxattrSha256     = "user.sshfs.sha256"
+)
+
+
+// Hash of a file as of its size and mtime, so asking for the size of the
+// value and then the value doesn't hash twice
+type vxattrHash struct {
+	size  int64
+	mtime time.Time
+	sum   []byte
+}
+
+
+func isVirtualXattr(name string) bool {
+	return strings.HasPrefix(name, vxattrPrefix)
+}
+
+
+// names the backend can answer for path
+func (self *Sshfs) virtualXattrs(path string) []string {
+
+	names := []string{vxattrRemotePath, vxattrHost}
+	if _, ok := self.fs.(Describer); ok && "/" != path {
+		names = append(names, vxattrOwner)
+	}
+	if _, ok := self.fs.(Hasher); ok {
+		if node, found := self.lookup(path); found && !node.IsDir {
+			names = append(names, vxattrSha256)
+		}
+	}
+	return names
+}
+
+
+func (self *Sshfs) virtualXattr(path string, name string) (errc int, xatr []byte) {
+
+	describer, _ := self.fs.(Describer)
+
+	switch name {
+	case vxattrRemotePath:
+		if nil == describer {
+			return 0, []byte(path)
+		}
+		remote, err := describer.RealPath(path)
+		if err != nil {
+			fmt.Println(err)
+			return xattrErrc(err), nil
+		}
+		return 0, []byte(remote)
+
+	case vxattrHost:
+		// each top level directory is its own server
+		if multi, ok := self.fs.(*multiBackend); ok {
+			if spec, ok := multi.hostSpec(path); ok {
+				return 0, []byte(spec)
+			}
+		}
+		return 0, []byte(self.host)
+
+	case vxattrOwner:
+		if nil == describer || "/" == path {
+			return -fuse.ENOATTR, nil
+		}
+		owner, err := describer.Owner(path)
+		if errors.Is(err, errors.ErrUnsupported) {
+			return -fuse.ENOATTR, nil
+		}
+		if err != nil {
+			fmt.Println(err)
+			return xattrErrc(err), nil
+		}
+		return 0, []byte(owner)
+
+	case vxattrSha256:
+		sum, err := self.sha256(path)
+		if errors.Is(err, errors.ErrUnsupported) {
+			return -fuse.ENOATTR, nil
+		}
+		if err != nil {
+			fmt.Println(err)
+			return xattrErrc(err), nil
+		}
+		return 0, []byte(hex.EncodeToString(sum))
+	}
+	return -fuse.ENOATTR, nil
+}
+
+
+// sha256 of a remote file, hashed on the server
+func (self *Sshfs) sha256(path string) ([]byte, error) {
+
+	hasher, ok := self.fs.(Hasher)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	info, err := self.fs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, errors.ErrUnsupported
+	}
+
+	self.lock.Lock()
+	cached, found := self.hashes[path]
+	self.lock.Unlock()
+	if found && cached.size == info.Size() && cached.mtime.Equal(info.ModTime()) {
+		return cached.sum, nil
+	}
+
+	sum, err := hasher.Hash(path, "sha256")
+	if err != nil {
+		return nil, err
+	}
+	entry := &vxattrHash{info.Size(), info.ModTime(), sum}
+	self.lock.Lock()
+	if nil == self.hashes {
+		self.hashes = make(map[string]*vxattrHash)
+	}
+	self.hashes[path] = entry
+	self.lock.Unlock()
+	return entry.sum, nil
+}
+
+
+// same size and mtime but different content still gets caught
+func (self *Sshfs) verifyCache(path string, cent *cacheEntry) {
+	sum, err := self.sha256(path)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	cent.Verify("sha256", sum)
+}
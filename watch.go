@@ -0,0 +1,234 @@
+/*
+ * watch.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// directories not listed for this long are no longer polled
+const watchIdle = 10 * time.Minute
+
+
+// content of a file changed
+const notifyChange = fuse.NOTIFY_TRUNCATE | fuse.NOTIFY_UTIME
+
+
+// Remote change detection
+//
+// Directories recently listed through the mount are polled and compared
+// with the previous listing; differences are reported through changed
+// with a fuse.NOTIFY_* action and the new attributes (nil when removed).
+type changeWatcher struct {
+	list     func(dir string) ([]cacheAttr, error)
+	stat     func(path string) (*cacheAttr, error)
+	changed  func(path string, action uint32, attr *cacheAttr)
+	exec     Execer
+	interval time.Duration
+	lock     sync.Mutex
+	dirs     map[string]*watchedDir
+}
+
+
+type watchedDir struct {
+	entries  map[string]cacheAttr
+	accessed time.Time
+}
+
+
+func newChangeWatcher(interval time.Duration) *changeWatcher {
+	self := &changeWatcher{}
+	self.interval = interval
+	self.dirs = make(map[string]*watchedDir)
+	return self
+}
+
+
+// remember a listing made through the mount
+func (self *changeWatcher) Touch(dir string, entries []cacheAttr) {
+
+	snapshot := make(map[string]cacheAttr, len(entries))
+	for _, entry := range entries {
+		snapshot[entry.Name] = entry
+	}
+
+	defer self.synchronize()()
+	self.dirs[dir] = &watchedDir{snapshot, time.Now()}
+}
+
+
+// poll watched directories until stop is closed
+func (self *changeWatcher) Poll(stop chan struct{}) {
+
+	ticker := time.NewTicker(self.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		self.lock.Lock()
+		var dirs []string
+		for dir, watched := range self.dirs {
+			if time.Since(watched.accessed) > watchIdle {
+				delete(self.dirs, dir)
+			} else {
+				dirs = append(dirs, dir)
+			}
+		}
+		self.lock.Unlock()
+
+		for _, dir := range dirs {
+			self.poll(dir)
+		}
+	}
+}
+
+
+func (self *changeWatcher) poll(dir string) {
+
+	entries, err := self.list(dir)
+	if nil != err {
+		// offline or removed; the parent listing reports removal
+		return
+	}
+
+	self.lock.Lock()
+	watched, found := self.dirs[dir]
+	if !found {
+		self.lock.Unlock()
+		return
+	}
+	old := watched.entries
+	watched.entries = make(map[string]cacheAttr, len(entries))
+	for _, entry := range entries {
+		watched.entries[entry.Name] = entry
+	}
+	self.lock.Unlock()
+
+	for _, entry := range entries {
+		entry := entry
+		prev, found := old[entry.Name]
+		switch {
+		case !found && entry.IsDir:
+			self.changed(path.Join(dir, entry.Name), fuse.NOTIFY_MKDIR, &entry)
+		case !found:
+			self.changed(path.Join(dir, entry.Name), fuse.NOTIFY_CREATE, &entry)
+		case prev.Size != entry.Size || prev.Mtime != entry.Mtime:
+			self.changed(path.Join(dir, entry.Name), notifyChange, &entry)
+		}
+	}
+
+	for name, prev := range old {
+		if _, found := watched.entries[name]; found {
+			continue
+		}
+		if prev.IsDir {
+			self.changed(path.Join(dir, name), fuse.NOTIFY_RMDIR, nil)
+		} else {
+			self.changed(path.Join(dir, name), fuse.NOTIFY_UNLINK, nil)
+		}
+	}
+}
+
+
+// follow a remote inotifywait over an exec channel until it exits
+func (self *changeWatcher) Inotify(root string) error {
+
+	cmd := fmt.Sprintf("inotifywait -m -r -q -e create,delete,modify,attrib,moved_to,moved_from --format '%%e|%%w%%f' %s", shellQuote(root))
+	out, err := self.exec.Exec(cmd)
+	if nil != err {
+		return err
+	}
+
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		events, name, found := strings.Cut(scanner.Text(), "|")
+		if !found {
+			continue
+		}
+		self.event(strings.Split(events, ","), path.Clean(name))
+	}
+	return out.Close()
+}
+
+
+func (self *changeWatcher) event(events []string, name string) {
+
+	isdir := false
+	action := uint32(0)
+	for _, event := range events {
+		switch event {
+		case "ISDIR":
+			isdir = true
+		case "CREATE", "MOVED_TO":
+			action = fuse.NOTIFY_CREATE
+		case "DELETE", "MOVED_FROM":
+			action = fuse.NOTIFY_UNLINK
+		case "MODIFY":
+			action = notifyChange
+		case "ATTRIB":
+			if 0 == action {
+				action = fuse.NOTIFY_CHMOD
+			}
+		}
+	}
+	if 0 == action {
+		return
+	}
+
+	if isdir {
+		switch action {
+		case fuse.NOTIFY_CREATE:
+			action = fuse.NOTIFY_MKDIR
+		case fuse.NOTIFY_UNLINK:
+			action = fuse.NOTIFY_RMDIR
+		}
+	}
+
+	var attr *cacheAttr
+	if fuse.NOTIFY_UNLINK != action && fuse.NOTIFY_RMDIR != action {
+		var err error
+		attr, err = self.stat(name)
+		if nil != err {
+			// already gone again
+			return
+		}
+	}
+	self.changed(name, action, attr)
+}
+
+
+// single-quote s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+
+func (self *changeWatcher) synchronize() func() {
+	self.lock.Lock()
+	return func() {
+		self.lock.Unlock()
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ * writebuf.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+
+const (
+	// coalesce small fuse writes into chunks of this size
+	writeChunkSize = 1024 * 1024
+
+	// outstanding chunk writes per handle
+	writeDepth = 4
+)
+
+
+// Write-back buffer
+//
+// Adjacent writes are appended to a single chunk; the chunk is sent to the
+// remote file in the background once it is full or the next write is not
+// contiguous. Chunks start in the order they were cut, so an older chunk
+// never lands over newer data. The first error from a background write
+// sticks and is reported by every later WriteAt and Flush.
+//
+// If set, precommit is called before the first chunk after open or after a
+// Flush and may veto the commit or redirect it to another writer;
+// postcommit is called once those chunks have been written.
+type writeBuffer struct {
+	w        io.WriterAt
+	lock     sync.Mutex
+	cond     *sync.Cond
+	buf      []byte
+	ofst     int64
+	inflight map[int64]int64
+	next     uint64 // tickets of cut chunks, started in order
+	serving  uint64
+	err      error
+	checked  bool
+
+	precommit  func() (io.WriterAt, error)
+	postcommit func()
+}
+
+
+func newWriteBuffer(w io.WriterAt) *writeBuffer {
+	self := &writeBuffer{}
+	self.w = w
+	self.cond = sync.NewCond(&self.lock)
+	self.inflight = make(map[int64]int64)
+	return self
+}
+
+
+func (self *writeBuffer) WriteAt(buff []byte, ofst int64) (int, error) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if nil != self.err {
+		return 0, self.err
+	}
+
+	if 0 < len(self.buf) && ofst != self.ofst+int64(len(self.buf)) {
+		self.dispatch()
+	}
+	if 0 == len(self.buf) {
+		self.ofst = ofst
+	}
+	self.buf = append(self.buf, buff...)
+
+	if writeChunkSize <= len(self.buf) {
+		self.dispatch()
+	}
+	return len(buff), nil
+}
+
+
+// send all buffered data and wait for outstanding writes
+func (self *writeBuffer) Flush() error {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if 0 < len(self.buf) {
+		self.dispatch()
+	}
+	for 0 < len(self.inflight) || self.serving != self.next {
+		self.cond.Wait()
+	}
+
+	if self.checked && nil != self.postcommit {
+		self.postcommit()
+	}
+	self.checked = false
+
+	// kept, so closing still reports what an earlier flush did
+	return self.err
+}
+
+
+// buffered data not yet sent
+func (self *writeBuffer) Dirty() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return 0 < len(self.buf) || 0 < len(self.inflight) || self.serving != self.next
+}
+
+
+// called with lock held
+func (self *writeBuffer) dispatch() {
+
+	data := self.buf
+	ofst := self.ofst
+	end := ofst + int64(len(data))
+	self.buf = nil
+
+	if !self.checked && nil != self.precommit {
+		w, err := self.precommit()
+		if nil != err {
+			if nil == self.err {
+				self.err = err
+			}
+			return
+		}
+		if nil != w {
+			self.w = w
+		}
+	}
+	self.checked = true
+
+	// limit the pipeline and never let overlapping writes race; waiting
+	// gives up the lock, so take a turn first
+	ticket := self.next
+	self.next++
+	for ticket != self.serving || writeDepth <= len(self.inflight) || self.overlaps(ofst, end) {
+		self.cond.Wait()
+	}
+	self.serving++
+	self.inflight[ofst] = end
+	self.cond.Broadcast()
+
+	w := self.w
+	go func() {
+		_, err := w.WriteAt(data, ofst)
+
+		self.lock.Lock()
+		if nil != err && nil == self.err {
+			self.err = err
+		}
+		delete(self.inflight, ofst)
+		self.cond.Broadcast()
+		self.lock.Unlock()
+	}()
+}
+
+
+func (self *writeBuffer) overlaps(ofst int64, end int64) bool {
+	for o, e := range self.inflight {
+		if ofst < e && o < end {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,319 @@
+/*
+ * xattr.go
+ *
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+
+// Extended attributes kept somewhere SFTP v3 can reach
+//
+// Paths are backend paths. Stores also follow files around, so renaming or
+// deleting a file does the same to its attributes.
+type xattrStore interface {
+	List(path string) (map[string][]byte, error)
+	Set(path string, name string, value []byte) error
+	Remove(path string, name string) error
+
+	Rename(oldpath string, newpath string) error
+	Delete(path string) error
+
+	// directory entries that belong to the store rather than the user
+	Hidden(name string) bool
+}
+
+
+// store for -xattr mode; nil means extended attributes are rejected
+func newXattrStore(mode string, fs Backend) (xattrStore, error) {
+	switch mode {
+	case "off":
+		return nil, nil
+	case "exec":
+		execer, ok := fs.(Execer)
+		if !ok {
+			return nil, errors.New("-xattr exec needs a backend that can run commands")
+		}
+		return &execXattrs{exec: execer}, nil
+	case "appledouble":
+		return &appleDoubleXattrs{fs: fs}, nil
+	case "sidecar":
+		return &sidecarXattrs{fs: fs}, nil
+	}
+	return nil, fmt.Errorf("unknown -xattr mode %q", mode)
+}
+
+
+// Attributes of the remote file system itself, through getfattr/setfattr
+type execXattrs struct {
+	exec  Execer
+	probe sync.Once
+	found bool
+}
+
+
+// whether the server has the attr tools
+func (self *execXattrs) available() bool {
+	self.probe.Do(func() {
+		_, err := execOutput(self.exec, "command -v getfattr && command -v setfattr")
+		self.found = nil == err
+		if !self.found {
+			fmt.Println("xattr: getfattr/setfattr not found on the server")
+		}
+	})
+	return self.found
+}
+
+
+func (self *execXattrs) run(cmd string) ([]byte, error) {
+	if !self.available() {
+		return nil, errors.ErrUnsupported
+	}
+	out, err := execOutput(self.exec, cmd)
+	if nil != err {
+		// setfattr says why on stderr, which we don't get
+		return nil, fmt.Errorf("%s: %w", cmd, errors.ErrUnsupported)
+	}
+	return out, nil
+}
+
+
+func (self *execXattrs) List(name string) (map[string][]byte, error) {
+
+	out, err := self.run("getfattr -d -m - -e base64 --absolute-names -- " + shellQuote(name))
+	if nil != err {
+		return nil, err
+	}
+
+	attrs := make(map[string][]byte)
+	for _, line := range strings.Split(string(out), "\n") {
+		if "" == line || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, _ := strings.Cut(line, "=")
+		attrs[key], err = decodeAttrValue(value)
+		if nil != err {
+			return nil, fmt.Errorf("getfattr %s: %s: %w", name, key, err)
+		}
+	}
+	return attrs, nil
+}
+
+
+// value as printed by getfattr
+func decodeAttrValue(value string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(value, "0s"):
+		return base64.StdEncoding.DecodeString(value[2:])
+	case strings.HasPrefix(value, "0x"):
+		return hex.DecodeString(value[2:])
+	case strings.HasPrefix(value, `"`):
+		text, err := strconv.Unquote(value)
+		return []byte(text), err
+	}
+	return []byte(value), nil
+}
+
+
+func (self *execXattrs) Set(name string, attr string, value []byte) error {
+	encoded := `""`
+	if 0 != len(value) {
+		encoded = "0s" + base64.StdEncoding.EncodeToString(value)
+	}
+	_, err := self.run(fmt.Sprintf("setfattr -n %s -v %s -- %s", shellQuote(attr), encoded, shellQuote(name)))
+	return err
+}
+
+
+func (self *execXattrs) Remove(name string, attr string) error {
+	_, err := self.run(fmt.Sprintf("setfattr -x %s -- %s", shellQuote(attr), shellQuote(name)))
+	return err
+}
+
+
+// the file system moves them along by itself
+func (self *execXattrs) Rename(oldpath string, newpath string) error { return nil }
+func (self *execXattrs) Delete(path string) error                    { return nil }
+func (self *execXattrs) Hidden(name string) bool                     { return false }
+
+
+// name of the per-directory attribute database
+const xattrSidecar = ".sshfs-xattrs"
+
+
+// Attributes of a whole directory in one JSON file inside it
+type sidecarXattrs struct {
+	fs   Backend
+	lock sync.Mutex
+}
+
+
+func (self *sidecarXattrs) load(dir string) (map[string]map[string][]byte, error) {
+
+	db := make(map[string]map[string][]byte)
+	data, err := readBackendFile(self.fs, path.Join(dir, xattrSidecar))
+	if errors.Is(err, os.ErrNotExist) {
+		return db, nil
+	}
+	if nil != err {
+		return nil, err
+	}
+	if 0 != len(data) {
+		err = json.Unmarshal(data, &db)
+	}
+	return db, err
+}
+
+
+func (self *sidecarXattrs) store(dir string, db map[string]map[string][]byte) error {
+
+	name := path.Join(dir, xattrSidecar)
+	if 0 == len(db) {
+		err := self.fs.Remove(name)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	data, err := json.Marshal(db)
+	if nil != err {
+		return err
+	}
+	return writeBackendFile(self.fs, name, data)
+}
+
+
+// change the entry of name in its directory database
+func (self *sidecarXattrs) update(name string, fn func(attrs map[string][]byte) map[string][]byte) error {
+
+	defer self.synchronize()()
+
+	dir, base := path.Split(name)
+	db, err := self.load(dir)
+	if nil != err {
+		return err
+	}
+	old, found := db[base]
+	attrs := fn(old)
+	if !found && 0 == len(attrs) {
+		return nil
+	}
+	if 0 == len(attrs) {
+		delete(db, base)
+	} else {
+		db[base] = attrs
+	}
+	return self.store(dir, db)
+}
+
+
+func (self *sidecarXattrs) List(name string) (map[string][]byte, error) {
+	defer self.synchronize()()
+	dir, base := path.Split(name)
+	db, err := self.load(dir)
+	if nil != err {
+		return nil, err
+	}
+	return db[base], nil
+}
+
+
+func (self *sidecarXattrs) Set(name string, attr string, value []byte) error {
+	return self.update(name, func(attrs map[string][]byte) map[string][]byte {
+		if nil == attrs {
+			attrs = make(map[string][]byte)
+		}
+		attrs[attr] = bytes.Clone(value)
+		return attrs
+	})
+}
+
+
+func (self *sidecarXattrs) Remove(name string, attr string) error {
+	return self.update(name, func(attrs map[string][]byte) map[string][]byte {
+		delete(attrs, attr)
+		return attrs
+	})
+}
+
+
+func (self *sidecarXattrs) Rename(oldpath string, newpath string) error {
+
+	// whatever the replaced file had goes with it
+	attrs, err := self.List(oldpath)
+	if nil != err {
+		return err
+	}
+	err = self.update(newpath, func(map[string][]byte) map[string][]byte {
+		return attrs
+	})
+	if nil != err {
+		return err
+	}
+	return self.Delete(oldpath)
+}
+
+
+func (self *sidecarXattrs) Delete(name string) error {
+	return self.update(name, func(map[string][]byte) map[string][]byte {
+		return nil
+	})
+}
+
+
+func (self *sidecarXattrs) Hidden(name string) bool {
+	return xattrSidecar == name
+}
+
+
+func (self *sidecarXattrs) synchronize() func() {
+	self.lock.Lock()
+	return func() {
+		self.lock.Unlock()
+	}
+}
+
+
+func readBackendFile(fs Backend, name string) ([]byte, error) {
+	fp, err := fs.Open(name, os.O_RDONLY)
+	if nil != err {
+		return nil, err
+	}
+	defer fp.Close()
+	return io.ReadAll(io.NewSectionReader(fp, 0, 1<<62))
+}
+
+
+func writeBackendFile(fs Backend, name string, data []byte) error {
+	fp, err := fs.Open(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if nil != err {
+		return err
+	}
+	_, err = fp.WriteAt(data, 0)
+	if cerr := fp.Close(); nil == err {
+		err = cerr
+	}
+	return err
+}